@@ -1,131 +1,89 @@
 package circuitbreaker
 
 import (
-	"FluxGate/configuration"
-	"sync"
+	"fmt"
+	"sync/atomic"
 	"time"
 )
 
-// type CircuitBreaker interface {
-// 	Allow() bool
-// 	OnSuccess()
-// 	OnFailure()
-// }
+// State is where a breaker is in its Closed -> Open -> HalfOpen cycle.
+type State int
 
-type CircuitBreaker struct {
-	mu sync.Mutex
-
-	state int // 0: "Closed", 1: "Open", 2: "HalfOpen"
-
-	// counters
-	failures        int
-	successes       int
-	trialsInFlight  int
-	lastFailureTime time.Time
-
-	// config
-	failureThreshold int
-	window           time.Duration
-	openTimeout      time.Duration
-	halfOpenLimit    int
-	successThreshold int
-
-	openUntil time.Time
-}
-
-func New(cfg configuration.CircuitBreakerConfig) *CircuitBreaker {
-	return &CircuitBreaker{
-		state:            0,
-		failureThreshold: cfg.FailureThreshold,
-		window:           time.Duration(cfg.WindowSeconds) * time.Second,
-		openTimeout:      time.Duration(cfg.OpenSeconds) * time.Second,
-		halfOpenLimit:    cfg.HalfOpenRequests,
-		successThreshold: cfg.SuccessThreshold,
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
 
-		failures:       0,
-		successes:      0,
-		trialsInFlight: 0,
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
 	}
+	return "unknown"
 }
 
-func (cb *CircuitBreaker) Allow() bool {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
-
-	now := time.Now()
-
-	switch cb.state {
-	case 1: //open
-		if now.After(cb.openUntil) {
-			//move to half open
-			cb.state = 2 // half open
-			cb.successes = 0
-			cb.failures = 0
-			cb.trialsInFlight = 0
-		} else {
-			return false
-		}
-	case 0: //closed
-		if !cb.lastFailureTime.IsZero() && now.Sub(cb.lastFailureTime) > cb.window {
-			cb.failures = 0
-		}
-		return true
-
-	case 2: //half open
-		if cb.trialsInFlight >= cb.halfOpenLimit {
-			return false
-		}
-
-		cb.trialsInFlight++
-		return true
-	}
-	return true
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
 }
 
-func (cb *CircuitBreaker) OnSuccess() {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
-
-	if cb.state == 2 { // half open
-		cb.successes++
-		cb.trialsInFlight--
-
-		if cb.successes >= cb.successThreshold {
-			//back to normal
-			cb.state = 0 //closed
-			cb.failures = 0
-			cb.successes = 0
-			cb.trialsInFlight = 0
+func (s *State) UnmarshalText(text []byte) error {
+	for _, state := range []State{StateClosed, StateOpen, StateHalfOpen} {
+		if state.String() == string(text) {
+			*s = state
+			return nil
 		}
-		return
 	}
-
-	//closed state
-	//Eat five star and do nothing :)
+	return fmt.Errorf("unknown circuit breaker state %q", text)
 }
 
-func (cb *CircuitBreaker) OnFailure() {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
+// Generation identifies a stretch of a breaker's life between two opens or
+// closes. Allow stamps each call with the current one, and an outcome
+// reported under an older generation says nothing about the upstream as the
+// breaker now sees it, so it is ignored. Generations are unique across
+// breakers, so one from a breaker that has since been replaced never matches.
+type Generation uint64
 
-	now := time.Now()
-	cb.lastFailureTime = now
+var generations atomic.Uint64
 
-	//if in hald open : -> open
-	if cb.state == 2 {
-		cb.state = 1
-		cb.openUntil = now.Add(cb.openTimeout)
-		cb.failures = 0
-		cb.successes = 0
-		cb.trialsInFlight = 0
-		return
-	} else {
-		//closed state
-		cb.failures++
-		if cb.failures >= cb.failureThreshold {
-			cb.state = 1 //open
-			cb.openUntil = now.Add(cb.openTimeout)
-		}
+func nextGeneration() Generation {
+	return Generation(generations.Add(1))
+}
 
-	}
+// Listener is told about every state change of a breaker. It runs after the
+// change, without the breaker locked, so it may call back into it.
+type Listener func(from, to State)
+
+type CircuitBreaker interface {
+	// Allow reports whether a call may go through now, and the generation
+	// to report its outcome under. A half-open breaker counts the calls it
+	// lets through as trials.
+	Allow() (Generation, bool)
+
+	// OnSuccess and OnFailure report an outcome under the current
+	// generation, for callers that don't keep the one Allow gave them.
+	OnSuccess()
+	OnFailure()
+	// Record reports the outcome of a call let through in generation gen
+	// along with how long it took.
+	Record(gen Generation, failed bool, latency time.Duration)
+	// Cancel reports that a call let through in generation gen ended
+	// without an outcome worth judging the upstream on.
+	Cancel(gen Generation)
+
+	State() State
+	// Forced reports whether the state was set by ForceOpen / ForceClose
+	// and holds regardless of calls until Reset.
+	Forced() bool
+
+	ForceOpen()
+	ForceClose()
+	// Reset closes the breaker, forgets every call and ends any forcing.
+	Reset()
+
+	OnStateChange(l Listener)
 }
@@ -2,10 +2,22 @@ package circuitbreaker
 
 import (
 	"FluxGate/configuration"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// allowed asks cb to let a call through, for tests that report outcomes
+// under the current generation.
+func allowed(cb CircuitBreaker) bool {
+	_, ok := cb.Allow()
+	return ok
+}
+
 func TestCircuitBreakerTransitions(t *testing.T) {
 	cb := New(configuration.CircuitBreakerConfig{
 		Enabled:          true,
@@ -17,26 +29,492 @@ func TestCircuitBreakerTransitions(t *testing.T) {
 	})
 
 	// Initially closed
-	if !cb.Allow() {
+	if !allowed(cb) {
 		t.Fatalf("expected allow in closed state")
 	}
 
 	// Two failures should open the breaker
 	cb.OnFailure()
 	cb.OnFailure()
-	if cb.Allow() {
+	if allowed(cb) {
 		t.Fatalf("expected breaker to be open after failures")
 	}
 
 	// Wait for open timeout to expire, should move to half-open on next Allow
 	time.Sleep(1100 * time.Millisecond)
-	if !cb.Allow() {
+	if !allowed(cb) {
 		t.Fatalf("expected half-open to allow a trial request")
 	}
 
 	// Success in half-open should close the breaker
 	cb.OnSuccess()
-	if !cb.Allow() {
+	if !allowed(cb) {
 		t.Fatalf("expected closed state after successful half-open trial")
 	}
 }
+
+func TestCircuitBreakerFailureRateNeedsMinimumCalls(t *testing.T) {
+	cb := New(configuration.CircuitBreakerConfig{
+		Enabled:            true,
+		SlidingWindowType:  configuration.SlidingWindowCount,
+		SlidingWindowSize:  10,
+		MinimumCalls:       4,
+		FailureRatePercent: 50,
+		OpenSeconds:        60,
+	})
+
+	cb.OnFailure()
+	cb.OnFailure()
+	cb.OnFailure()
+	if !allowed(cb) {
+		t.Fatal("opened before the minimum number of calls")
+	}
+	cb.OnSuccess() // 3 of 4 failed
+	if allowed(cb) {
+		t.Fatal("expected 75% failures to open the breaker")
+	}
+}
+
+func TestCircuitBreakerFailureRateIgnoresRareFailures(t *testing.T) {
+	cb := New(configuration.CircuitBreakerConfig{
+		Enabled:            true,
+		SlidingWindowType:  configuration.SlidingWindowCount,
+		SlidingWindowSize:  100,
+		FailureRatePercent: 50,
+		OpenSeconds:        60,
+	})
+
+	for i := 0; i < 1000; i++ {
+		if i%20 == 0 {
+			cb.OnFailure()
+		} else {
+			cb.OnSuccess()
+		}
+	}
+	if !allowed(cb) {
+		t.Fatal("5% failures should not open a 50% breaker")
+	}
+}
+
+func TestCircuitBreakerCountWindowForgetsOldCalls(t *testing.T) {
+	cb := New(configuration.CircuitBreakerConfig{
+		Enabled:            true,
+		SlidingWindowType:  configuration.SlidingWindowCount,
+		SlidingWindowSize:  4,
+		MinimumCalls:       4,
+		FailureRatePercent: 75,
+		OpenSeconds:        60,
+	})
+
+	// the two early failures slide out before the last two arrive
+	for _, failed := range []bool{true, true, false, false, false, false, true, true} {
+		gen, _ := cb.Allow()
+		cb.Record(gen, failed, 0)
+	}
+	if !allowed(cb) {
+		t.Fatal("failures outside the window counted")
+	}
+	cb.OnFailure() // 3 of the last 4
+	if allowed(cb) {
+		t.Fatal("expected the breaker to open")
+	}
+}
+
+func TestCircuitBreakerSlowCallRate(t *testing.T) {
+	cb := New(configuration.CircuitBreakerConfig{
+		Enabled:             true,
+		MinimumCalls:        4,
+		SlowCallRatePercent: 50,
+		SlowCallMs:          100,
+		OpenSeconds:         60,
+	})
+
+	gen, _ := cb.Allow()
+	cb.Record(gen, false, 10*time.Millisecond)
+	cb.Record(gen, false, 150*time.Millisecond)
+	cb.Record(gen, false, 20*time.Millisecond)
+	if !allowed(cb) {
+		t.Fatal("opened before the minimum number of calls")
+	}
+	cb.Record(gen, false, 100*time.Millisecond) // 2 of 4 slow
+	if allowed(cb) {
+		t.Fatal("expected slow calls to open the breaker")
+	}
+}
+
+func TestTimeWindowAgesOutBuckets(t *testing.T) {
+	w := newTimeWindow(3)
+	start := time.Unix(1000, 0)
+
+	w.record(start, true, false)
+	w.record(start.Add(time.Second), false, true)
+	w.record(start.Add(2*time.Second), false, false)
+	if got := w.totals(start.Add(2 * time.Second)); got != (tally{calls: 3, failures: 1, slow: 1}) {
+		t.Fatalf("got %+v", got)
+	}
+
+	// the first second has left the window
+	if got := w.totals(start.Add(3 * time.Second)); got != (tally{calls: 2, slow: 1}) {
+		t.Fatalf("got %+v", got)
+	}
+
+	// a bucket is reused for a later second
+	w.record(start.Add(3*time.Second), true, false)
+	if got := w.totals(start.Add(3 * time.Second)); got != (tally{calls: 3, failures: 1, slow: 1}) {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestCircuitBreakerListenersAndManualControl(t *testing.T) {
+	cb := New(configuration.CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, OpenSeconds: 60})
+
+	var transitions []string
+	cb.OnStateChange(func(from, to State) {
+		// listeners run unlocked and may look at the breaker
+		transitions = append(transitions, from.String()+">"+to.String()+"="+cb.State().String())
+	})
+
+	cb.OnFailure()
+	if cb.State() != StateOpen || allowed(cb) {
+		t.Fatal("expected the breaker to open")
+	}
+
+	cb.ForceClose()
+	cb.OnFailure()
+	if cb.State() != StateClosed || !cb.Forced() || !allowed(cb) {
+		t.Fatal("a force-closed breaker should ignore failures")
+	}
+
+	cb.ForceOpen()
+	if allowed(cb) {
+		t.Fatal("a force-opened breaker should reject calls")
+	}
+
+	cb.Reset()
+	if cb.State() != StateClosed || cb.Forced() || !allowed(cb) {
+		t.Fatal("reset should close the breaker and end forcing")
+	}
+
+	want := "[closed>open=open open>closed=closed closed>open=open open>closed=closed]"
+	if got := fmt.Sprint(transitions); got != want {
+		t.Fatalf("transitions %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreakerFirstProbeSuccessCloses(t *testing.T) {
+	cb := NewSlidingWindow(configuration.CircuitBreakerConfig{FailureThreshold: 1, OpenSeconds: 1, HalfOpenRequests: 1})
+	now := time.Unix(1000, 0)
+	cb.now = func() time.Time { return now }
+
+	cb.OnFailure()
+	now = now.Add(time.Second)
+	if !allowed(cb) || cb.State() != StateHalfOpen {
+		t.Fatal("expected the first call after the timeout to be a trial")
+	}
+	if allowed(cb) {
+		t.Fatal("the first call should have taken the only trial")
+	}
+	cb.OnSuccess()
+	if cb.State() != StateClosed || !allowed(cb) || !allowed(cb) {
+		t.Fatal("a successful first trial should close the breaker")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailureCount(t *testing.T) {
+	cb := New(configuration.CircuitBreakerConfig{FailureThreshold: 3, OpenSeconds: 60})
+	for range 10 {
+		cb.OnFailure()
+		cb.OnFailure()
+		cb.OnSuccess()
+	}
+	if cb.State() != StateClosed {
+		t.Fatal("failures broken up by successes should not open the breaker")
+	}
+	cb.OnFailure()
+	cb.OnFailure()
+	cb.OnFailure()
+	if cb.State() != StateOpen {
+		t.Fatal("expected three failures in a row to open the breaker")
+	}
+}
+
+func TestCircuitBreakerCancelFreesTrial(t *testing.T) {
+	cb := NewSlidingWindow(configuration.CircuitBreakerConfig{FailureThreshold: 1, OpenSeconds: 1, HalfOpenRequests: 1})
+	now := time.Unix(1000, 0)
+	cb.now = func() time.Time { return now }
+
+	cb.OnFailure()
+	now = now.Add(time.Second)
+	gen, ok := cb.Allow()
+	if !ok || allowed(cb) {
+		t.Fatal("expected exactly one trial")
+	}
+	cb.Cancel(gen)
+	if !allowed(cb) {
+		t.Fatal("a canceled trial should be handed to the next call")
+	}
+}
+
+func TestCircuitBreakerUnpairedOutcomesKeepTrialLimit(t *testing.T) {
+	cb := NewSlidingWindow(configuration.CircuitBreakerConfig{FailureThreshold: 1, OpenSeconds: 1, HalfOpenRequests: 1, SuccessThreshold: 5})
+	now := time.Unix(1000, 0)
+	cb.now = func() time.Time { return now }
+
+	cb.OnFailure()
+	now = now.Add(time.Second)
+	gen, ok := cb.Allow()
+	if !ok {
+		t.Fatal("expected the first call after the timeout to be a trial")
+	}
+	cb.Record(gen, false, 0)
+
+	// outcomes with no trial out, from callers that skipped Allow
+	cb.OnSuccess()
+	cb.OnSuccess()
+	cb.Cancel(gen)
+	if cb.State() != StateHalfOpen {
+		t.Fatalf("state %s, want half_open", cb.State())
+	}
+	if !allowed(cb) {
+		t.Fatal("expected the free trial slot to be handed out")
+	}
+	if allowed(cb) {
+		t.Fatal("let more than half_open_requests trials through")
+	}
+}
+
+func TestCircuitBreakerIgnoresCallsFromEarlierGenerations(t *testing.T) {
+	cb := NewSlidingWindow(configuration.CircuitBreakerConfig{FailureThreshold: 1, OpenSeconds: 1, HalfOpenRequests: 1, SuccessThreshold: 1})
+	now := time.Unix(1000, 0)
+	cb.now = func() time.Time { return now }
+
+	before, _ := cb.Allow()
+	cb.OnFailure()
+	now = now.Add(time.Second)
+	trial, ok := cb.Allow()
+	if !ok {
+		t.Fatal("expected a trial")
+	}
+
+	// a call let through before the breaker opened neither frees nor
+	// judges the trial
+	cb.Cancel(before)
+	cb.Record(before, false, 0)
+	if cb.State() != StateHalfOpen || allowed(cb) {
+		t.Fatal("a stale outcome was counted")
+	}
+
+	cb.Record(trial, false, 0)
+	cb.Record(trial, true, 0) // reported twice, after the breaker closed
+	if cb.State() != StateClosed {
+		t.Fatal("a stale failure reopened the breaker")
+	}
+}
+
+// model is the breaker's state machine written out plainly, with only
+// failure_threshold judging calls while closed.
+type model struct {
+	state                          State
+	consecutive, successes, trials int
+	openUntil                      time.Time
+	gen                            int // bumped on every open and close
+
+	threshold, limit, needed int
+	timeout                  time.Duration
+}
+
+func (m *model) allow(now time.Time) (int, bool) {
+	switch m.state {
+	case StateClosed:
+		return m.gen, true
+	case StateOpen:
+		if now.Before(m.openUntil) {
+			return m.gen, false
+		}
+		m.state, m.successes, m.trials = StateHalfOpen, 0, 0
+	}
+	if m.trials == m.limit {
+		return m.gen, false
+	}
+	m.trials++
+	return m.gen, true
+}
+
+func (m *model) record(now time.Time, gen int, failed bool) {
+	if gen != m.gen {
+		return
+	}
+	switch m.state {
+	case StateClosed:
+		m.consecutive++
+		if !failed {
+			m.consecutive = 0
+		}
+		if m.consecutive == m.threshold {
+			m.state, m.consecutive, m.openUntil = StateOpen, 0, now.Add(m.timeout)
+			m.gen++
+		}
+	case StateHalfOpen:
+		m.trials--
+		if failed {
+			m.state, m.openUntil = StateOpen, now.Add(m.timeout)
+			m.gen++
+			return
+		}
+		if m.successes++; m.successes == m.needed {
+			m.state, m.trials = StateClosed, 0
+			m.gen++
+		}
+	}
+}
+
+func (m *model) cancel(gen int) {
+	if m.state == StateHalfOpen && gen == m.gen {
+		m.trials--
+	}
+}
+
+// TestCircuitBreakerMatchesModel drives breakers with random sequences of
+// calls, outcomes and clock ticks and checks every answer against model.
+// Outstanding calls are reported in random order, so many are still out
+// when the breaker opens or closes and report into a later generation.
+func TestCircuitBreakerMatchesModel(t *testing.T) {
+	for seed := range uint64(200) {
+		rng := rand.New(rand.NewPCG(seed, seed))
+		cfg := configuration.CircuitBreakerConfig{
+			FailureThreshold: 1 + rng.IntN(4),
+			OpenSeconds:      1,
+			HalfOpenRequests: 1 + rng.IntN(3),
+			SuccessThreshold: 1 + rng.IntN(3),
+		}
+		cb := NewSlidingWindow(cfg)
+		now := time.Unix(1000, 0)
+		cb.now = func() time.Time { return now }
+		m := &model{threshold: cfg.FailureThreshold, limit: cfg.HalfOpenRequests, needed: cfg.SuccessThreshold, timeout: time.Second}
+
+		// calls let through and not yet reported
+		type call struct {
+			gen   Generation
+			model int
+		}
+		var outstanding []call
+		take := func() call {
+			i := rng.IntN(len(outstanding))
+			c := outstanding[i]
+			outstanding = slices.Delete(outstanding, i, i+1)
+			return c
+		}
+
+		var log []string
+		for step := range 300 {
+			var op string
+			switch n := rng.IntN(10); {
+			case n < 4:
+				op = "allow"
+				gen, got := cb.Allow()
+				mgen, want := m.allow(now)
+				if got != want {
+					t.Fatalf("seed %d step %d: Allow = %v, model says %v after %v", seed, step, got, want, log)
+				}
+				if got {
+					outstanding = append(outstanding, call{gen, mgen})
+				}
+			case n < 8 && len(outstanding) > 0:
+				c := take()
+				failed := rng.IntN(2) == 0
+				op = fmt.Sprintf("record gen=%d failed=%v", c.model, failed)
+				cb.Record(c.gen, failed, 0)
+				m.record(now, c.model, failed)
+			case n < 9 && len(outstanding) > 0:
+				c := take()
+				op = fmt.Sprint("cancel gen=", c.model)
+				cb.Cancel(c.gen)
+				m.cancel(c.model)
+			default:
+				op = "tick"
+				now = now.Add(time.Duration(rng.IntN(600)) * time.Millisecond)
+			}
+			log = append(log, op)
+
+			if cb.State() != m.state {
+				t.Fatalf("seed %d step %d: state %v, model says %v after %v", seed, step, cb.State(), m.state, log)
+			}
+		}
+	}
+}
+
+// TestCircuitBreakerInvariantsUnderConcurrency hammers a breaker from many
+// goroutines while the clock jumps ahead, checking that half-open never has
+// more trials out than allowed, that it ends as soon as enough of them
+// succeed, and that only legal transitions happen.
+func TestCircuitBreakerInvariantsUnderConcurrency(t *testing.T) {
+	cfg := configuration.CircuitBreakerConfig{FailureThreshold: 3, OpenSeconds: 1, HalfOpenRequests: 2, SuccessThreshold: 3}
+	cb := NewSlidingWindow(cfg)
+	var clock atomic.Int64
+	cb.now = func() time.Time { return time.Unix(0, clock.Load()) }
+
+	legal := map[[2]State]bool{
+		{StateClosed, StateOpen}:     true,
+		{StateOpen, StateHalfOpen}:   true,
+		{StateHalfOpen, StateOpen}:   true,
+		{StateHalfOpen, StateClosed}: true,
+	}
+	var transitions sync.Map
+	var illegal atomic.Value
+	cb.OnStateChange(func(from, to State) {
+		if !legal[[2]State{from, to}] {
+			illegal.Store(from.String() + " -> " + to.String())
+		}
+		n, _ := transitions.LoadOrStore(to, new(atomic.Int64))
+		n.(*atomic.Int64).Add(1)
+	})
+
+	check := func() {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		if cb.trialsInFlight < 0 || cb.trialsInFlight > cb.halfOpenLimit {
+			t.Errorf("%d trials in flight, limit %d", cb.trialsInFlight, cb.halfOpenLimit)
+		}
+		if cb.state == StateHalfOpen && cb.successes >= cb.successThreshold {
+			t.Errorf("still half-open after %d successes", cb.successes)
+		}
+		if cb.state == StateClosed && cb.consecutive >= cb.failureThreshold {
+			t.Errorf("still closed after %d failures in a row", cb.consecutive)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(g), 1))
+			for range 5000 {
+				if rng.IntN(20) == 0 {
+					clock.Add(int64(100 * time.Millisecond))
+				}
+				if gen, ok := cb.Allow(); ok {
+					switch n := rng.IntN(10); {
+					case n < 4:
+						cb.Record(gen, true, 0)
+					case n < 9:
+						cb.Record(gen, false, 0)
+					default:
+						cb.Cancel(gen)
+					}
+				}
+				check()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := illegal.Load(); v != nil {
+		t.Fatalf("illegal transition %s", v)
+	}
+	for _, s := range []State{StateOpen, StateHalfOpen, StateClosed} {
+		if n, ok := transitions.Load(s); !ok || n.(*atomic.Int64).Load() == 0 {
+			t.Fatalf("never moved to %s", s)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package circuitbreaker
+
+import "FluxGate/configuration"
+
+const defaultType = "sliding_window"
+
+// New builds the breaker of cfg's type, or returns nil if the type is
+// unknown.
+func New(cfg configuration.CircuitBreakerConfig) CircuitBreaker {
+	kind := cfg.Type
+	if kind == "" {
+		kind = defaultType
+	}
+	f, ok := Registry[kind]
+	if ok {
+		return f(cfg)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package circuitbreaker
+
+import "FluxGate/configuration"
+
+var Registry = make(map[string]func(configuration.CircuitBreakerConfig) CircuitBreaker)
+
+func RegisterCircuitBreaker(name string, constructor func(configuration.CircuitBreakerConfig) CircuitBreaker) {
+	Registry[name] = constructor
+}
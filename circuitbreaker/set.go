@@ -0,0 +1,131 @@
+package circuitbreaker
+
+import (
+	"FluxGate/configuration"
+	"cmp"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Key identifies a breaker: the upstream it guards and the route or tenant
+// it is shared within ("" when it is shared by everyone).
+type Key struct {
+	Scope  string
+	Server string
+}
+
+func (k Key) String() string {
+	if k.Scope == "" {
+		return k.Server
+	}
+	return k.Server + " (" + k.Scope + ")"
+}
+
+// KeyFor returns the key of the breaker guarding server for requests on
+// route, according to the route's breaker_scope.
+func KeyFor(route *configuration.RouteConfig, server string) Key {
+	switch route.BreakerScope {
+	case configuration.BreakerScopeRoute:
+		return Key{Scope: "route " + route.ID(), Server: server}
+	case configuration.BreakerScopeTenant:
+		return Key{Scope: "tenant " + route.Tenant, Server: server}
+	}
+	return Key{Server: server}
+}
+
+type entry struct {
+	breaker CircuitBreaker
+	cfg     configuration.CircuitBreakerConfig
+}
+
+// Set holds the gateway's breakers. It is safe for concurrent use so
+// upstreams can join and leave while requests are in flight.
+type Set struct {
+	mu        sync.RWMutex
+	breakers  map[Key]entry
+	listeners []func(key Key, from, to State)
+}
+
+func NewSet() *Set {
+	return &Set{breakers: make(map[Key]entry)}
+}
+
+// Get returns the breaker guarding server on route, or nil if it has none.
+func (s *Set) Get(route *configuration.RouteConfig, server string) CircuitBreaker {
+	if s == nil || route == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.breakers[KeyFor(route, server)].breaker
+}
+
+// Status describes one breaker of a Set.
+type Status struct {
+	Scope  string `json:"scope,omitempty"`
+	Server string `json:"url"`
+	State  State  `json:"state"`
+	Forced bool   `json:"forced"`
+}
+
+// List describes every breaker.
+func (s *Set) List() []Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Status, 0, len(s.breakers))
+	for key, e := range s.breakers {
+		out = append(out, Status{Scope: key.Scope, Server: key.Server, State: e.breaker.State(), Forced: e.breaker.Forced()})
+	}
+	slices.SortFunc(out, func(a, b Status) int {
+		return cmp.Or(strings.Compare(a.Server, b.Server), strings.Compare(a.Scope, b.Scope))
+	})
+	return out
+}
+
+// OnStateChange registers fn to hear about the state changes of every
+// breaker the set creates from now on.
+func (s *Set) OnStateChange(fn func(key Key, from, to State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Config returns the config the breaker under key was built from.
+func (s *Set) Config(key Key) (configuration.CircuitBreakerConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.breakers[key]
+	return e.cfg, ok
+}
+
+// Sync makes the set hold a breaker for every key in want, built from its
+// config. Breakers whose key and config are unchanged keep their state,
+// the rest are dropped.
+func (s *Set) Sync(want map[Key]configuration.CircuitBreakerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.breakers {
+		if cfg, ok := want[key]; !ok || !reflect.DeepEqual(cfg, e.cfg) {
+			delete(s.breakers, key)
+		}
+	}
+	for key, cfg := range want {
+		if _, ok := s.breakers[key]; ok {
+			continue
+		}
+		cb := New(cfg)
+		if cb == nil {
+			log.Printf("circuit breaker for %s: unknown type %q", key.Server, cfg.Type)
+			continue
+		}
+		for _, fn := range s.listeners {
+			cb.OnStateChange(func(from, to State) { fn(key, from, to) })
+		}
+		s.breakers[key] = entry{breaker: cb, cfg: cfg}
+	}
+}
@@ -0,0 +1,106 @@
+package circuitbreaker
+
+import (
+	"FluxGate/configuration"
+	"testing"
+)
+
+func TestSetSyncKeepsExistingBreakers(t *testing.T) {
+	s := NewSet()
+	route := &configuration.RouteConfig{Tenant: "demo", Method: "GET", Path: "/a"}
+	cfg := configuration.CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, WindowSeconds: 10, OpenSeconds: 10}
+
+	s.Sync(map[Key]configuration.CircuitBreakerConfig{{Server: "a"}: cfg, {Server: "b"}: cfg})
+	a := s.Get(route, "a")
+	if a == nil || s.Get(route, "b") == nil {
+		t.Fatal("breakers not created")
+	}
+
+	s.Sync(map[Key]configuration.CircuitBreakerConfig{{Server: "a"}: cfg})
+	if s.Get(route, "a") != a {
+		t.Fatal("existing breaker was replaced")
+	}
+	if s.Get(route, "b") != nil {
+		t.Fatal("breaker of a removed upstream kept")
+	}
+
+	cfg.FailureThreshold = 3
+	s.Sync(map[Key]configuration.CircuitBreakerConfig{{Server: "a"}: cfg})
+	if s.Get(route, "a") == a {
+		t.Fatal("breaker not rebuilt after its config changed")
+	}
+	if (*Set)(nil).Get(route, "a") != nil {
+		t.Fatal("nil set should have no breakers")
+	}
+}
+
+func TestKeyForScopes(t *testing.T) {
+	route := func(tenant, path, scope string) *configuration.RouteConfig {
+		return &configuration.RouteConfig{Tenant: tenant, Method: "GET", Path: path, BreakerScope: scope}
+	}
+
+	tests := []struct {
+		name   string
+		a, b   *configuration.RouteConfig
+		shared bool
+	}{
+		{"upstream scope is shared across tenants", route("t1", "/a", ""), route("t2", "/b", "upstream"), true},
+		{"route scope is per route", route("t1", "/a", "route"), route("t1", "/b", "route"), false},
+		{"tenant scope is shared by a tenant's routes", route("t1", "/a", "tenant"), route("t1", "/b", "tenant"), true},
+		{"tenant scope is per tenant", route("t1", "/a", "tenant"), route("t2", "/a", "tenant"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if shared := KeyFor(tt.a, "http://u") == KeyFor(tt.b, "http://u"); shared != tt.shared {
+				t.Fatalf("shared = %v, want %v", shared, tt.shared)
+			}
+		})
+	}
+}
+
+// alwaysOpen is a breaker implementation registered by a test.
+type alwaysOpen struct{ *SlidingWindow }
+
+func (alwaysOpen) Allow() (Generation, bool) { return 0, false }
+
+func TestSetBuildsRegisteredTypes(t *testing.T) {
+	RegisterCircuitBreaker("test_always_open", func(cfg configuration.CircuitBreakerConfig) CircuitBreaker {
+		return alwaysOpen{NewSlidingWindow(cfg)}
+	})
+	t.Cleanup(func() { delete(Registry, "test_always_open") })
+
+	s := NewSet()
+	route := &configuration.RouteConfig{}
+	s.Sync(map[Key]configuration.CircuitBreakerConfig{
+		{Server: "custom"}:  {Enabled: true, Type: "test_always_open"},
+		{Server: "unknown"}: {Enabled: true, Type: "no_such_breaker"},
+	})
+	if cb := s.Get(route, "custom"); cb == nil || allowed(cb) {
+		t.Fatal("registered implementation not used")
+	}
+	if s.Get(route, "unknown") != nil {
+		t.Fatal("unknown type should get no breaker")
+	}
+}
+
+func TestSetListenersHearEveryBreaker(t *testing.T) {
+	s := NewSet()
+	var opened []Key
+	s.OnStateChange(func(key Key, from, to State) {
+		if to == StateOpen {
+			opened = append(opened, key)
+		}
+	})
+
+	cfg := configuration.CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, OpenSeconds: 60}
+	s.Sync(map[Key]configuration.CircuitBreakerConfig{{Server: "a"}: cfg, {Scope: "tenant t1", Server: "a"}: cfg})
+	s.Get(&configuration.RouteConfig{}, "a").OnFailure()
+	s.Get(&configuration.RouteConfig{Tenant: "t1", BreakerScope: "tenant"}, "a").OnFailure()
+
+	if len(opened) != 2 || opened[1] != (Key{Scope: "tenant t1", Server: "a"}) {
+		t.Fatalf("opened %v", opened)
+	}
+	if list := s.List(); len(list) != 2 || list[0].State != StateOpen {
+		t.Fatalf("list %+v", list)
+	}
+}
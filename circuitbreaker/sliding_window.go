@@ -0,0 +1,308 @@
+package circuitbreaker
+
+import (
+	"FluxGate/configuration"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWindowSeconds = 60
+	defaultWindowCalls   = 100
+	defaultMinimumCalls  = 10
+)
+
+func init() {
+	RegisterCircuitBreaker("sliding_window", func(cfg configuration.CircuitBreakerConfig) CircuitBreaker {
+		return NewSlidingWindow(cfg)
+	})
+}
+
+// SlidingWindow is the default breaker: it judges the outcomes of recent
+// calls, kept in a count or time based sliding window.
+type SlidingWindow struct {
+	mu sync.Mutex
+
+	state      State
+	forced     bool
+	generation Generation // bumped on every open and close
+
+	// outcomes of recent calls while closed
+	window window
+
+	// counters
+	consecutive    int // failures in a row while closed
+	successes      int // successful trials since entering half-open
+	trialsInFlight int // trials let through in half-open and not yet reported
+
+	// config
+	failureThreshold int     // consecutive failures, 0 = off
+	failureRate      float64 // percent of calls in the window, 0 = off
+	slowRate         float64 // percent of calls slower than slowCall, 0 = off
+	slowCall         time.Duration
+	minimumCalls     int // calls the window needs before rates are judged
+	openTimeout      time.Duration
+	halfOpenLimit    int
+	successThreshold int
+
+	openUntil time.Time
+	now       func() time.Time
+
+	listeners []Listener
+	pending   [][2]State // transitions to announce once unlocked
+}
+
+func NewSlidingWindow(cfg configuration.CircuitBreakerConfig) *SlidingWindow {
+	cb := &SlidingWindow{
+		state:            StateClosed,
+		failureThreshold: cfg.FailureThreshold,
+		failureRate:      cfg.FailureRatePercent,
+		slowRate:         cfg.SlowCallRatePercent,
+		slowCall:         time.Duration(cfg.SlowCallMs) * time.Millisecond,
+		minimumCalls:     cfg.MinimumCalls,
+		openTimeout:      time.Duration(cfg.OpenSeconds) * time.Second,
+		halfOpenLimit:    cfg.HalfOpenRequests,
+		successThreshold: cfg.SuccessThreshold,
+
+		generation: nextGeneration(),
+		now:        time.Now,
+	}
+	if cb.minimumCalls <= 0 {
+		cb.minimumCalls = defaultMinimumCalls
+	}
+	// with no trials or no successes asked for, half-open could never end
+	if cb.halfOpenLimit <= 0 {
+		cb.halfOpenLimit = 1
+	}
+	if cb.successThreshold <= 0 {
+		cb.successThreshold = 1
+	}
+
+	size := cfg.SlidingWindowSize
+	if cfg.SlidingWindowType == configuration.SlidingWindowCount {
+		if size <= 0 {
+			size = defaultWindowCalls
+		}
+		cb.window = newCountWindow(size)
+	} else {
+		if size <= 0 {
+			size = cfg.WindowSeconds
+		}
+		if size <= 0 {
+			size = defaultWindowSeconds
+		}
+		cb.window = newTimeWindow(size)
+	}
+	return cb
+}
+
+// Allow lets every call through while closed and none while open. Once the
+// open timeout has passed, the next call moves the breaker to half-open and
+// becomes its first trial; at most half_open_requests trials are out at a
+// time. Half-open trials belong to the generation the breaker opened in.
+func (cb *SlidingWindow) Allow() (Generation, bool) {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	switch cb.state {
+	case StateClosed:
+		return cb.generation, true
+	case StateOpen:
+		if cb.forced || cb.now().Before(cb.openUntil) {
+			return cb.generation, false
+		}
+		cb.transition(StateHalfOpen)
+		cb.successes = 0
+		cb.trialsInFlight = 0
+	}
+
+	if cb.trialsInFlight >= cb.halfOpenLimit {
+		return cb.generation, false
+	}
+	cb.trialsInFlight++
+	return cb.generation, true
+}
+
+// OnSuccess records a call that succeeded, with no regard to its latency.
+func (cb *SlidingWindow) OnSuccess() {
+	cb.mu.Lock()
+	defer cb.unlock()
+	cb.record(cb.generation, false, 0)
+}
+
+// OnFailure records a failed call.
+func (cb *SlidingWindow) OnFailure() {
+	cb.mu.Lock()
+	defer cb.unlock()
+	cb.record(cb.generation, true, 0)
+}
+
+// Record records a call that took latency.
+//
+// While closed the call goes into the sliding window, and the breaker opens
+// after failure_threshold failures in a row, or, once the window holds at
+// least minimum_calls calls, when the failure rate or the rate of calls
+// taking slow_call_ms or longer reaches its limit.
+//
+// In half-open, a failed trial (or a slow one, when slow calls are judged)
+// opens the breaker again, and success_threshold successful ones close it.
+// Results of calls let through before the breaker last opened or closed are
+// ignored; a forced breaker ignores every call.
+func (cb *SlidingWindow) Record(gen Generation, failed bool, latency time.Duration) {
+	cb.mu.Lock()
+	defer cb.unlock()
+	cb.record(gen, failed, latency)
+}
+
+func (cb *SlidingWindow) record(gen Generation, failed bool, latency time.Duration) {
+	if cb.forced || gen != cb.generation {
+		return
+	}
+
+	now := cb.now()
+	slow := cb.slowCall > 0 && latency >= cb.slowCall
+
+	switch cb.state {
+	case StateHalfOpen:
+		cb.endTrial()
+		if failed || (slow && cb.slowRate > 0) {
+			cb.open(now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.successThreshold {
+			cb.close()
+		}
+
+	case StateClosed:
+		if failed {
+			cb.consecutive++
+		} else {
+			cb.consecutive = 0
+		}
+		cb.window.record(now, failed, slow)
+		if cb.tripped(cb.window.totals(now)) {
+			cb.open(now)
+		}
+	}
+}
+
+// Cancel reports that a call let through by Allow ended without an outcome
+// (the client went away, or a hedged attempt lost), so a half-open breaker
+// can hand its trial to another call.
+func (cb *SlidingWindow) Cancel(gen Generation) {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	if cb.state == StateHalfOpen && gen == cb.generation {
+		cb.endTrial()
+	}
+}
+
+func (cb *SlidingWindow) State() State {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+func (cb *SlidingWindow) Forced() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.forced
+}
+
+// ForceOpen rejects every call until ForceClose or Reset.
+func (cb *SlidingWindow) ForceOpen() {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	cb.forced = true
+	cb.transition(StateOpen)
+}
+
+// ForceClose lets every call through, whatever its outcome, until ForceOpen
+// or Reset.
+func (cb *SlidingWindow) ForceClose() {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	cb.forced = true
+	cb.close()
+}
+
+func (cb *SlidingWindow) Reset() {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	cb.forced = false
+	cb.close()
+}
+
+func (cb *SlidingWindow) OnStateChange(l Listener) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.listeners = append(cb.listeners, l)
+}
+
+func (cb *SlidingWindow) tripped(t tally) bool {
+	if cb.failureThreshold > 0 && cb.consecutive >= cb.failureThreshold {
+		return true
+	}
+	if t.calls < cb.minimumCalls {
+		return false
+	}
+	if cb.failureRate > 0 && float64(t.failures)*100 >= cb.failureRate*float64(t.calls) {
+		return true
+	}
+	return cb.slowRate > 0 && float64(t.slow)*100 >= cb.slowRate*float64(t.calls)
+}
+
+func (cb *SlidingWindow) open(now time.Time) {
+	cb.transition(StateOpen)
+	cb.generation = nextGeneration()
+	cb.openUntil = now.Add(cb.openTimeout)
+	cb.consecutive = 0
+	cb.successes = 0
+	cb.trialsInFlight = 0
+	cb.window.reset()
+}
+
+func (cb *SlidingWindow) close() {
+	cb.transition(StateClosed)
+	cb.generation = nextGeneration()
+	cb.consecutive = 0
+	cb.successes = 0
+	cb.trialsInFlight = 0
+	cb.window.reset()
+}
+
+// endTrial frees a half-open trial slot. An outcome reported without a
+// trial out (OnSuccess or OnFailure with no Allow before it) has no slot
+// to free, and must not make room for more than halfOpenLimit trials.
+func (cb *SlidingWindow) endTrial() {
+	if cb.trialsInFlight > 0 {
+		cb.trialsInFlight--
+	}
+}
+
+// transition moves to state to, to be announced by unlock.
+func (cb *SlidingWindow) transition(to State) {
+	if cb.state != to {
+		cb.pending = append(cb.pending, [2]State{cb.state, to})
+	}
+	cb.state = to
+}
+
+// unlock releases the breaker and then tells the listeners about the
+// transitions made while it was held.
+func (cb *SlidingWindow) unlock() {
+	pending, listeners := cb.pending, cb.listeners
+	cb.pending = nil
+	cb.mu.Unlock()
+
+	for _, t := range pending {
+		for _, l := range listeners {
+			l(t[0], t[1])
+		}
+	}
+}
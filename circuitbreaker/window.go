@@ -0,0 +1,109 @@
+package circuitbreaker
+
+import "time"
+
+// tally counts the calls a window holds.
+type tally struct {
+	calls    int
+	failures int
+	slow     int
+}
+
+func (t *tally) add(failed, slow bool) {
+	t.calls++
+	if failed {
+		t.failures++
+	}
+	if slow {
+		t.slow++
+	}
+}
+
+func (t *tally) sub(o tally) {
+	t.calls -= o.calls
+	t.failures -= o.failures
+	t.slow -= o.slow
+}
+
+// window aggregates the outcomes of recent calls. Callers hold the
+// breaker's lock.
+type window interface {
+	record(now time.Time, failed, slow bool)
+	totals(now time.Time) tally
+	reset()
+}
+
+// countWindow holds the outcomes of the last size calls.
+type countWindow struct {
+	outcomes []tally // one call each
+	next     int
+	total    tally
+}
+
+func newCountWindow(size int) *countWindow {
+	return &countWindow{outcomes: make([]tally, 0, size)}
+}
+
+func (w *countWindow) record(_ time.Time, failed, slow bool) {
+	var t tally
+	t.add(failed, slow)
+
+	if len(w.outcomes) < cap(w.outcomes) {
+		w.outcomes = append(w.outcomes, t)
+	} else {
+		w.total.sub(w.outcomes[w.next])
+		w.outcomes[w.next] = t
+		w.next = (w.next + 1) % len(w.outcomes)
+	}
+	w.total.add(failed, slow)
+}
+
+func (w *countWindow) totals(time.Time) tally {
+	return w.total
+}
+
+func (w *countWindow) reset() {
+	w.outcomes = w.outcomes[:0]
+	w.next = 0
+	w.total = tally{}
+}
+
+// timeWindow holds the outcomes of the last size seconds in one bucket per
+// second, so old calls age out a second at a time rather than all at once.
+type timeWindow struct {
+	buckets []tally
+	epochs  []int64 // the second each bucket currently counts
+}
+
+func newTimeWindow(seconds int) *timeWindow {
+	return &timeWindow{buckets: make([]tally, seconds), epochs: make([]int64, seconds)}
+}
+
+func (w *timeWindow) record(now time.Time, failed, slow bool) {
+	sec := now.Unix()
+	i := int(sec % int64(len(w.buckets)))
+	if w.epochs[i] != sec {
+		w.buckets[i] = tally{}
+		w.epochs[i] = sec
+	}
+	w.buckets[i].add(failed, slow)
+}
+
+func (w *timeWindow) totals(now time.Time) tally {
+	oldest := now.Unix() - int64(len(w.buckets)) + 1
+
+	var total tally
+	for i, b := range w.buckets {
+		if w.epochs[i] >= oldest {
+			total.calls += b.calls
+			total.failures += b.failures
+			total.slow += b.slow
+		}
+	}
+	return total
+}
+
+func (w *timeWindow) reset() {
+	clear(w.buckets)
+	clear(w.epochs)
+}
@@ -51,13 +51,15 @@ func main() {
 	}
 
 	routes := []map[string]interface{}{
-		// fast route has two upstreams to demonstrate LB behavior
+		// fast route has two upstreams to demonstrate LB behavior;
+		// p2c_ewma ignores weights, it learns the slow one's latency and
+		// steers around it
 		mergeMaps(map[string]interface{}{
 			"path":           "/fast",
 			"method":         "GET",
-			"load_balancing": "round_robin",
+			"load_balancing": "p2c_ewma",
 			"upstreams": []map[string]interface{}{
-				{"url": ups["fast"], "weight": 2},
+				{"url": ups["fast"], "weight": 1},
 				{"url": ups["slow"], "weight": 1},
 			},
 			"cache": map[string]interface{}{"enabled": true, "ttl_ms": 60000, "max_entry": 100},
@@ -66,6 +68,8 @@ func main() {
 				"max_tries":    3,
 				"base_time_ms": 100,
 			},
+			// give up on the slow upstream quickly and retry elsewhere
+			"timeouts": map[string]interface{}{"per_try_ms": 500, "total_ms": 2000},
 		}, commonRateLimit),
 		// slow-only
 		mergeMaps(map[string]interface{}{
@@ -81,6 +85,7 @@ func main() {
 				"max_tries":    0,
 				"base_time_ms": 0,
 			},
+			"timeouts": map[string]interface{}{"per_try_ms": 2000},
 		}, commonRateLimit),
 		// faulty has two upstreams
 		mergeMaps(map[string]interface{}{
@@ -136,6 +141,10 @@ func main() {
 	if err := store.LoadConfig("demo", data); err != nil {
 		log.Fatalf("failed to load demo config: %v", err)
 	}
+	// a load balancer on this machine may front the demo; believe its X-Forwarded-For
+	if err := store.LoadSettings([]byte(`{"trusted_proxies": ["127.0.0.1", "::1"]}`)); err != nil {
+		log.Fatalf("failed to load demo settings: %v", err)
+	}
 
 	gw := gateway.NewGateway(store)
 	metrics.StartFlusher("bench_metrics.jsonl")
@@ -143,7 +152,12 @@ func main() {
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
 	http.HandleFunc("/", gw.Handler)
 
-	srv := &http.Server{Addr: ":8080", ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	// no server-wide WriteTimeout: upstream deadlines are set per route/upstream
+	srv := &http.Server{Addr: ":8080", ReadHeaderTimeout: 10 * time.Second, IdleTimeout: 120 * time.Second}
+	// accept cleartext HTTP/2 as well so gRPC clients can talk to the gateway
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
 	fmt.Println("Gateway demo running on :8080 — use X-User-ID: demo header")
 
 	go func() {
@@ -151,6 +165,12 @@ func main() {
 			log.Fatalf("failed to start pprof server: %v", err)
 		}
 	}()
+	// upstream membership changes, local only
+	go func() {
+		if err := http.ListenAndServe("localhost:9090", gw.AdminHandler()); err != nil {
+			log.Fatalf("failed to start admin server: %v", err)
+		}
+	}()
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatalf("gateway failed: %v", err)
 	}
@@ -2,14 +2,55 @@ package configuration
 
 import (
 	"FluxGate/loadbalancer"
+	"FluxGate/outlier"
 	"FluxGate/ratelimit"
+	"FluxGate/retrybudget"
 	"FluxGate/storage"
+	"fmt"
+	"net"
+	"strings"
 	"sync"
 )
 
 type GatewayConfigStore struct {
-	mu    sync.RWMutex
-	Users map[string][]*RouteConfig
+	mu       sync.RWMutex
+	Users    map[string][]*RouteConfig
+	Services map[string]ServiceConfig
+	Settings GatewaySettings
+}
+
+// GatewaySettings configure the gateway as a whole rather than one user's
+// routes.
+type GatewaySettings struct {
+	// proxies (IPs or CIDRs) in front of the gateway whose X-Forwarded-For /
+	// Forwarded headers are believed
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// ParseNetworks parses a list of IPs and CIDRs; a bare IP is a network of
+// one address.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, p := range list {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", p)
+			}
+			if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
 // shared context key type and keys used across packages
@@ -18,15 +59,49 @@ type CtxKey string
 const RouteCtxKey CtxKey = "route"
 const UpstreamCtxKey CtxKey = "upstream"
 
+// BreakerGenerationCtxKey holds the circuitbreaker.Generation the upstream's
+// breaker let the attempt through in.
+const BreakerGenerationCtxKey CtxKey = "breaker_generation"
+
+// TrustedProxiesCtxKey holds the utils.TrustedProxies of the gateway serving
+// the request.
+const TrustedProxiesCtxKey CtxKey = "trusted_proxies"
+
 type RouteConfig struct {
 	Path        string           `json:"path"`
 	Method      string           `json:"method"`
 	Upstreams   []UpstreamConfig `json:"upstreams"`
 	LoadBalance string           `json:"load_balancing"`
 
+	// take the upstreams from a discovered service instead of Upstreams
+	Service string `json:"service"`
+
+	// user whose config the route belongs to
+	Tenant string `json:"-"`
+
+	// what the upstreams' circuit breakers are shared within: "upstream"
+	// (default, every route using the URL), "route" or "tenant"
+	BreakerScope string `json:"breaker_scope"`
+
+	// guards Upstreams and UpstreamRetryBudgets once the route is serving,
+	// as upstreams can be added and removed at runtime
+	upstreamsMu sync.RWMutex
+
 	// LB instance
 	LoadBalancer loadbalancer.LoadBalancer `json:"-"`
 
+	// request attribute ring_hash / maglev balance on: "header:<name>",
+	// "cookie:<name>", "query:<name>", "param:<name>" (path parameter),
+	// "ip" or "identity" (the user_id_key identity)
+	HashKey string `json:"hash_key"`
+
+	// pin clients to an upstream with a cookie issued by the gateway
+	Sticky StickyConfig `json:"sticky"`
+
+	// eject upstreams that misbehave compared to the rest of the route's pool
+	Outlier         OutlierConfig     `json:"outlier_detection"`
+	OutlierDetector *outlier.Detector `json:"-"`
+
 	// Rate limit
 	RouteRateLimit RouteRateLimitConfig `json:"route_rate_limit"`
 	UserRateLimit  UserRateLimitConfig  `json:"user_rate_limit"`
@@ -38,9 +113,33 @@ type RouteConfig struct {
 	// Retry configuration (route-level)
 	Retry RetryConfig `json:"retry"`
 
+	// Retry budget instances: route-wide and per upstream URL
+	RetryBudget          *retrybudget.Budget            `json:"-"`
+	UpstreamRetryBudgets map[string]*retrybudget.Budget `json:"-"`
+
+	// Timeouts for every upstream of the route, overridable per upstream
+	Timeouts TimeoutConfig `json:"timeouts"`
+
+	// Active health check for upstreams that don't configure their own
+	HealthCheck HealthCheckConfig `json:"health_check"`
+
 	Cache         CacheConfig       `json:"cache"`
 	CacheInstance *storage.LRUCache `json:"-"`
 
+	// what to answer with when none of the upstreams can take a request
+	Fallback FallbackConfig `json:"fallback"`
+	// route over the fallback's secondary upstreams, nil if it has none
+	FallbackRoute *RouteConfig `json:"-"`
+	// the static fallback's body, read from body_file at load time
+	FallbackBody []byte `json:"-"`
+
+	// Connection: Upgrade (WebSocket etc.) handling
+	Upgrade UpgradeConfig `json:"upgrade"`
+
+	// Streaming marks routes whose responses are flushed to the client as
+	// they arrive (text/event-stream responses are detected automatically)
+	Streaming bool `json:"streaming"`
+
 	UserIdentityKey []string `json:"user_id_key"`
 	Plugins         []string `json:"plugins"`
 }
@@ -69,30 +168,228 @@ type RetryConfig struct {
 	Enabled    bool  `json:"enabled"`
 	MaxTries   int   `json:"max_tries"`
 	BaseTimeMs int64 `json:"base_time_ms"`
+
+	// "exponential" (default) / "decorrelated_jitter" / "constant"
+	Backoff      string `json:"backoff"`
+	MaxBackoffMs int64  `json:"max_backoff_ms"` // cap on any single wait, incl. Retry-After (0 = none)
+
+	// request bodies larger than this are streamed and never retried (0 = 1MiB)
+	MaxBufferBytes int64 `json:"max_buffer_bytes"`
+
+	// conditions that make an attempt retryable: "5xx", "connect_error",
+	// "timeout", "reset" (default: all four)
+	RetryOn []string `json:"retry_on"`
+	// additional status codes to retry on, e.g. 429
+	RetryableStatus []int `json:"retryable_status"`
+	// allow replaying POST/PATCH; off by default
+	RetryNonIdempotent bool `json:"retry_non_idempotent"`
+
+	// caps retries across all requests of the route
+	Budget RetryBudgetConfig `json:"budget"`
+
+	// send a duplicate request to another upstream when the first is slow
+	Hedge HedgeConfig `json:"hedge"`
+}
+
+type HedgeConfig struct {
+	Enabled bool  `json:"enabled"`
+	DelayMs int64 `json:"delay_ms"` // wait this long for the first response (0 = 100ms)
+	// use the last observed p95 latency as the delay when available; it is
+	// gateway-wide (every route, cache hits included), not this route's
+	UseP95 bool `json:"use_p95"`
+}
+
+type RetryBudgetConfig struct {
+	Enabled          bool    `json:"enabled"`
+	Percent          float64 `json:"percent"`             // retries allowed per 100 requests
+	MinRetriesPerSec float64 `json:"min_retries_per_sec"` // floor for low-traffic routes
+	WindowSeconds    int     `json:"window_seconds"`      // 0 = 10s
 }
 
 type UpstreamConfig struct {
 	URL            string               `json:"url"`
 	Weight         int                  `json:"weight"`
-	RetryEnabled   bool                 `json:"retry_enabled"`
-	Retries        int                  `json:"retries"`
+	Protocol       string               `json:"protocol"`      // "http1" (default) / "h2" (TLS) / "h2c" (cleartext HTTP/2)
+	RetryEnabled   bool                 `json:"retry_enabled"` // overrides the route's tries/backoff for this upstream
+	Retries        int                  `json:"retries"`       // retries after the first try
 	BaseTimeMs     int64                `json:"base_time_ms"`
 	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+	Timeouts       TimeoutConfig        `json:"timeouts"` // non-zero fields override the route's
+	RetryBudget    RetryBudgetConfig    `json:"retry_budget"`
+	HealthCheck    HealthCheckConfig    `json:"health_check"` // overrides the route's
+}
+
+// TimeoutConfig values are in milliseconds, 0 means "inherit / default".
+type TimeoutConfig struct {
+	ConnectMs        int64 `json:"connect_ms"`
+	TLSHandshakeMs   int64 `json:"tls_handshake_ms"`
+	ResponseHeaderMs int64 `json:"response_header_ms"`
+	PerTryMs         int64 `json:"per_try_ms"` // default 10s
+	TotalMs          int64 `json:"total_ms"`   // whole request incl. retries, route-level only
+}
+
+// Merge returns t with every non-zero field of override applied on top,
+// except TotalMs: the request deadline belongs to the route, not to one of
+// its upstreams.
+func (t TimeoutConfig) Merge(override TimeoutConfig) TimeoutConfig {
+	if override.ConnectMs > 0 {
+		t.ConnectMs = override.ConnectMs
+	}
+	if override.TLSHandshakeMs > 0 {
+		t.TLSHandshakeMs = override.TLSHandshakeMs
+	}
+	if override.ResponseHeaderMs > 0 {
+		t.ResponseHeaderMs = override.ResponseHeaderMs
+	}
+	if override.PerTryMs > 0 {
+		t.PerTryMs = override.PerTryMs
+	}
+	return t
 }
 
+const (
+	BreakerScopeUpstream = "upstream"
+	BreakerScopeRoute    = "route"
+	BreakerScopeTenant   = "tenant"
+)
+
+const (
+	SlidingWindowTime  = "time"
+	SlidingWindowCount = "count"
+)
+
+// CircuitBreakerConfig trips a breaker on whichever of its limits is reached
+// first, judged over a sliding window of recent calls.
 type CircuitBreakerConfig struct {
-	Enabled bool `json:"enabled"`
+	Enabled bool   `json:"enabled"`
+	Type    string `json:"type"` // registered implementation, "" = sliding_window
+
+	FailureThreshold int `json:"failure_threshold"` // failures in a row, 0 = off
+	WindowSeconds    int `json:"window_seconds"`    // time window size, 0 = 60
 
-	FailureThreshold int `json:"failure_threshold"`
-	WindowSeconds    int `json:"window_seconds"`
+	// "time" (default): the last sliding_window_size seconds, in one-second
+	// buckets; "count": the last sliding_window_size calls (0 = 100)
+	SlidingWindowType string `json:"sliding_window_type"`
+	SlidingWindowSize int    `json:"sliding_window_size"` // 0 = window_seconds for "time"
+
+	// rate limits, judged once the window holds minimum_calls (0 = 10)
+	MinimumCalls        int     `json:"minimum_calls"`
+	FailureRatePercent  float64 `json:"failure_rate_percent"`   // 0 = off
+	SlowCallRatePercent float64 `json:"slow_call_rate_percent"` // 0 = off
+	SlowCallMs          int64   `json:"slow_call_ms"`           // calls this slow or slower count as slow
 
 	OpenSeconds      int `json:"open_seconds"`
-	HalfOpenRequests int `json:"half_open_requests"`
-	SuccessThreshold int `json:"success_threshold"`
+	HalfOpenRequests int `json:"half_open_requests"` // trials out at once in half-open, 0 = 1
+	SuccessThreshold int `json:"success_threshold"`  // successful trials to close, 0 = 1
+}
+
+// HealthCheckConfig describes an active probe run against an upstream in the
+// background. Unhealthy upstreams are skipped until they pass again.
+type HealthCheckConfig struct {
+	Enabled bool   `json:"enabled"`
+	Type    string `json:"type"` // "http" (default) / "tcp" (connect only)
+
+	// http only
+	Path           string `json:"path"`            // "" = "/"
+	ExpectedStatus []int  `json:"expected_status"` // empty = any 2xx
+	ExpectedBody   string `json:"expected_body"`   // substring the body must contain
+
+	IntervalMs         int64 `json:"interval_ms"`         // 0 = 5s
+	TimeoutMs          int64 `json:"timeout_ms"`          // 0 = 1s
+	HealthyThreshold   int   `json:"healthy_threshold"`   // consecutive passes to recover, 0 = 2
+	UnhealthyThreshold int   `json:"unhealthy_threshold"` // consecutive failures to eject, 0 = 3
+
+	// the checked upstream's protocol, so http probes speak it; set by
+	// RouteConfig.HealthCheckFor
+	Protocol string `json:"-"`
+}
+
+// OutlierConfig values of 0 pick the defaults noted.
+type OutlierConfig struct {
+	Enabled            bool  `json:"enabled"`
+	Consecutive5xx     int   `json:"consecutive_5xx"`      // 0 = 5
+	IntervalMs         int64 `json:"interval_ms"`          // success rate / latency analysis, 0 = 10s
+	BaseEjectionMs     int64 `json:"base_ejection_ms"`     // doubled per repeat ejection, 0 = 30s
+	MaxEjectionMs      int64 `json:"max_ejection_ms"`      // 0 = 300s
+	MaxEjectionPercent int   `json:"max_ejection_percent"` // 0 = 10, one upstream can always go
+
+	SuccessRateStdevFactor float64 `json:"success_rate_stdev_factor"` // 0 = 1.9
+	LatencyFactor          float64 `json:"latency_factor"`            // x pool median, 0 = off
+	MinHosts               int     `json:"min_hosts"`                 // 0 = 5
+	MinRequests            int64   `json:"min_requests"`              // per interval, 0 = 100
+}
+
+// ServiceConfig describes a named set of upstreams found at runtime. Routes
+// refer to it with "service" and get its membership changes.
+type ServiceConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "dns" (A/AAAA) / "srv" / "file" / "http"
+
+	// dns: host to resolve, srv: record name, e.g. _http._tcp.payments.internal
+	Host      string `json:"host"`
+	Port      int    `json:"port"`       // dns only, srv records carry their own
+	Scheme    string `json:"scheme"`     // "" = http
+	DNSServer string `json:"dns_server"` // host:port, "" = first nameserver in /etc/resolv.conf
+
+	Path string `json:"path"` // file: JSON list of {"url", "weight"}
+	URL  string `json:"url"`  // http: endpoint answering with the same list
+
+	// file / http polling interval, 0 = 5s. DNS is re-resolved when its
+	// records expire, but no sooner than min_ttl_ms (0 = 1s).
+	RefreshMs int64 `json:"refresh_ms"`
+	MinTTLMs  int64 `json:"min_ttl_ms"`
+
+	// settings for every discovered upstream; url and weight come from discovery
+	Upstream UpstreamConfig `json:"upstream"`
+}
+
+const defaultStickyCookie = "fg_sticky"
+
+type StickyConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CookieName string `json:"cookie_name"` // "" = fg_sticky
+	TTLSeconds int    `json:"ttl_seconds"` // 0 = session cookie
+}
+
+// Cookie returns the name of the sticky-session cookie.
+func (c StickyConfig) Cookie() string {
+	if c.CookieName == "" {
+		return defaultStickyCookie
+	}
+	return c.CookieName
+}
+
+type UpgradeConfig struct {
+	// upgraded connections idle in both directions for this long are closed (0 = 60s)
+	IdleTimeoutMs int64 `json:"idle_timeout_ms"`
+}
+
+// FallbackConfig lists what the gateway falls back to, in the order tried,
+// when every upstream of a route is failing its health check or has its
+// circuit open.
+type FallbackConfig struct {
+	// serve the last cached response for the request even if it has expired
+	// (needs the route's cache)
+	StaleIfError bool `json:"stale_if_error"`
+	// how long past expiry a cached response may still be served (0 = for as long as it stays cached)
+	MaxStaleMs int64 `json:"max_stale_ms"`
+
+	// secondary pool to send the request to, tried once with no retries
+	Upstreams   []UpstreamConfig `json:"upstreams"`
+	LoadBalance string           `json:"load_balancing"` // "" = round_robin
+
+	// static response, used if Status is set
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	BodyFile string            `json:"body_file"` // read at load time, overrides body
 }
 
 type CacheConfig struct {
 	Enabled  bool  `json:"enabled"`
-	TTL      int64 `json:"ttl_ms"`
+	TTL      int64 `json:"ttl_ms"` // lifetime of responses that give none in Cache-Control or Expires
 	MaxEntry int   `json:"max_entry"`
+
+	// responses larger than this are streamed to the client but not cached (0 = 1MiB)
+	MaxBodyBytes int64 `json:"max_body_bytes"`
 }
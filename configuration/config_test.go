@@ -2,6 +2,9 @@ package configuration
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -110,3 +113,107 @@ func TestMatchPathPicksMostSpecific(t *testing.T) {
 		t.Fatalf("expected param route, got %s", route.Path)
 	}
 }
+
+func TestRoutePathParam(t *testing.T) {
+	route := &RouteConfig{Path: "/users/:uid/carts/{cart}"}
+
+	if got := route.PathParam("/users/7/carts/42", "uid"); got != "7" {
+		t.Fatalf("uid: got %q", got)
+	}
+	if got := route.PathParam("/users/7/carts/42", "cart"); got != "42" {
+		t.Fatalf("cart: got %q", got)
+	}
+	if got := route.PathParam("/users/7/carts/42", "missing"); got != "" {
+		t.Fatalf("missing: got %q", got)
+	}
+}
+
+func TestLoadConfigReadsFallbacks(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "down.html"), []byte("down"), 0o644)
+
+	load := func(fallback map[string]interface{}) (*RouteConfig, error) {
+		store := NewGatewayConfigStore()
+		data, _ := json.Marshal([]map[string]interface{}{{
+			"path": "/x", "method": "GET", "load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{{"url": "http://localhost:9001", "weight": 1}},
+			"fallback":  fallback,
+		}})
+		if err := store.LoadConfig("demo", data); err != nil {
+			return nil, err
+		}
+		return store.Users["demo"][0], nil
+	}
+
+	route, err := load(map[string]interface{}{
+		"status":    503,
+		"body_file": filepath.Join(dir, "down.html"),
+		"upstreams": []map[string]interface{}{{"url": "http://localhost:9002", "weight": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(route.FallbackBody) != "down" {
+		t.Fatalf("fallback body %q", route.FallbackBody)
+	}
+	if fb := route.FallbackRoute; fb == nil || fb.LoadBalancer == nil || fb.Tenant != "demo" || fb.Path != "/x" {
+		t.Fatalf("expected a route over the secondary pool, got %+v", fb)
+	}
+
+	if _, err := load(map[string]interface{}{"status": 503, "body_file": filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("expected an error for an unreadable body_file")
+	}
+}
+
+func TestLoadSettingsValidatesTrustedProxies(t *testing.T) {
+	store := NewGatewayConfigStore()
+	if err := store.LoadSettings([]byte(`{"trusted_proxies": ["10.0.0.1", "192.168.0.0/16", "::1"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Settings.TrustedProxies) != 3 {
+		t.Fatalf("settings %+v", store.Settings)
+	}
+	if err := store.LoadSettings([]byte(`{"trusted_proxies": ["proxy.internal"]}`)); err == nil {
+		t.Fatal("expected an error for a host name")
+	}
+	if len(store.Settings.TrustedProxies) != 3 {
+		t.Fatal("invalid settings should leave the old ones in place")
+	}
+}
+
+func TestTimeoutMergeKeepsRouteTotal(t *testing.T) {
+	route := TimeoutConfig{PerTryMs: 500, TotalMs: 2000}
+	got := route.Merge(TimeoutConfig{ConnectMs: 100, PerTryMs: 200, TotalMs: 9000})
+	want := TimeoutConfig{ConnectMs: 100, PerTryMs: 200, TotalMs: 2000}
+	if got != want {
+		t.Fatalf("Merge = %+v, want %+v", got, want)
+	}
+}
+
+func TestMembershipCallbacksSeeTheRoute(t *testing.T) {
+	store := NewGatewayConfigStore()
+	err := store.LoadConfig("demo", []byte(`[{"path": "/a", "method": "GET", "load_balancing": "round_robin",
+		"upstreams": [{"url": "http://a", "weight": 1}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, _ := store.Route("demo", "GET", "/a")
+	pool, _ := route.pool()
+
+	var seen []int
+	pool.OnChange(func() { seen = append(seen, len(route.UpstreamList())) })
+
+	if err := route.AddUpstream(UpstreamConfig{URL: "http://b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := route.RemoveUpstream("http://a"); err != nil {
+		t.Fatal(err)
+	}
+	err = route.SetUpstreams([]UpstreamConfig{{URL: "http://c"}, {URL: "http://d"}, {URL: "http://e"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(seen) != "[2 1 3]" {
+		t.Fatalf("callbacks saw upstream counts %v, want [2 1 3]", seen)
+	}
+}
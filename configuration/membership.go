@@ -0,0 +1,180 @@
+package configuration
+
+import (
+	"FluxGate/loadbalancer"
+	"FluxGate/retrybudget"
+	"fmt"
+)
+
+// pool returns the route's runtime-changeable balancer.
+func (route *RouteConfig) pool() (*loadbalancer.Pool, error) {
+	pool, ok := loadbalancer.As[*loadbalancer.Pool](route.LoadBalancer)
+	if !ok {
+		return nil, fmt.Errorf("route %s %s has no dynamic load balancer", route.Method, route.Path)
+	}
+	return pool, nil
+}
+
+// Members lists the route's upstreams as its balancer sees them, including
+// draining ones and removed ones still finishing requests.
+func (route *RouteConfig) Members() ([]loadbalancer.Member, error) {
+	pool, err := route.pool()
+	if err != nil {
+		return nil, err
+	}
+	return pool.Members(), nil
+}
+
+// AddUpstream adds upstream to the route, or re-admits it if it was draining
+// or removed. Its retry budget starts fresh.
+func (route *RouteConfig) AddUpstream(upstream UpstreamConfig) error {
+	pool, err := route.pool()
+	if err != nil {
+		return err
+	}
+	if upstream.URL == "" {
+		return fmt.Errorf("upstream url is required")
+	}
+	if upstream.Weight <= 0 {
+		upstream.Weight = 1
+	}
+
+	// change callbacks read the route, so they wait for it to be updated too
+	return pool.Batch(func() error {
+		if err := pool.Add(upstream.URL, upstream.Weight); err != nil {
+			return err
+		}
+
+		route.upstreamsMu.Lock()
+		defer route.upstreamsMu.Unlock()
+
+		replaced := false
+		for i := range route.Upstreams {
+			if route.Upstreams[i].URL == upstream.URL {
+				route.Upstreams[i] = upstream
+				replaced = true
+			}
+		}
+		if !replaced {
+			route.Upstreams = append(route.Upstreams, upstream)
+		}
+
+		delete(route.UpstreamRetryBudgets, upstream.URL)
+		if upstream.RetryBudget.Enabled {
+			if route.UpstreamRetryBudgets == nil {
+				route.UpstreamRetryBudgets = make(map[string]*retrybudget.Budget)
+			}
+			route.UpstreamRetryBudgets[upstream.URL] = newRetryBudget(upstream.RetryBudget)
+		}
+		return nil
+	})
+}
+
+// RemoveUpstream takes url out of the route. Requests already sent to it
+// are allowed to finish.
+func (route *RouteConfig) RemoveUpstream(url string) error {
+	pool, err := route.pool()
+	if err != nil {
+		return err
+	}
+
+	return pool.Batch(func() error {
+		if err := pool.Remove(url); err != nil {
+			return err
+		}
+
+		route.upstreamsMu.Lock()
+		defer route.upstreamsMu.Unlock()
+		for i := range route.Upstreams {
+			if route.Upstreams[i].URL == url {
+				route.Upstreams = append(route.Upstreams[:i:i], route.Upstreams[i+1:]...)
+				break
+			}
+		}
+		delete(route.UpstreamRetryBudgets, url)
+		return nil
+	})
+}
+
+// DrainUpstream stops new requests to url while keeping it configured.
+func (route *RouteConfig) DrainUpstream(url string) error {
+	pool, err := route.pool()
+	if err != nil {
+		return err
+	}
+	return pool.Drain(url)
+}
+
+// SetUpstreamWeight changes url's share of the route's traffic.
+func (route *RouteConfig) SetUpstreamWeight(url string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("weight must be positive")
+	}
+	pool, err := route.pool()
+	if err != nil {
+		return err
+	}
+
+	return pool.Batch(func() error {
+		if err := pool.SetWeight(url, weight); err != nil {
+			return err
+		}
+
+		route.upstreamsMu.Lock()
+		defer route.upstreamsMu.Unlock()
+		for i := range route.Upstreams {
+			if route.Upstreams[i].URL == url {
+				route.Upstreams[i].Weight = weight
+			}
+		}
+		return nil
+	})
+}
+
+// SetUpstreams makes upstreams the route's membership: missing ones are
+// added, ones whose weight changed are reweighted and the rest are removed,
+// finishing their in-flight requests. Upstreams whose weight is unchanged
+// keep their state. Change callbacks run once, after the whole update.
+func (route *RouteConfig) SetUpstreams(upstreams []UpstreamConfig) error {
+	pool, err := route.pool()
+	if err != nil {
+		return err
+	}
+	return pool.Batch(func() error { return route.setUpstreams(upstreams) })
+}
+
+func (route *RouteConfig) setUpstreams(upstreams []UpstreamConfig) error {
+	current := make(map[string]UpstreamConfig)
+	for _, upstream := range route.UpstreamList() {
+		current[upstream.URL] = upstream
+	}
+
+	want := make(map[string]bool)
+	for _, upstream := range upstreams {
+		if upstream.Weight <= 0 {
+			upstream.Weight = 1
+		}
+		want[upstream.URL] = true
+
+		existing, ok := current[upstream.URL]
+		switch {
+		case !ok:
+			if err := route.AddUpstream(upstream); err != nil {
+				return err
+			}
+		case existing.Weight != upstream.Weight:
+			if err := route.SetUpstreamWeight(upstream.URL, upstream.Weight); err != nil {
+				return err
+			}
+		}
+	}
+
+	for url := range current {
+		if !want[url] {
+			if err := route.RemoveUpstream(url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,10 +2,13 @@ package configuration
 
 import (
 	"FluxGate/loadbalancer"
+	"FluxGate/outlier"
 	"FluxGate/ratelimit"
+	"FluxGate/retrybudget"
 	"FluxGate/storage"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +17,8 @@ import (
 // constructor
 func NewGatewayConfigStore() *GatewayConfigStore {
 	return &GatewayConfigStore{
-		Users: make(map[string][]*RouteConfig),
+		Users:    make(map[string][]*RouteConfig),
+		Services: make(map[string]ServiceConfig),
 	}
 }
 
@@ -28,12 +32,20 @@ func (store *GatewayConfigStore) GetConfig(userId string) ([]byte, error) {
 		return nil, fmt.Errorf("no config found for user: %s", userId)
 	}
 
-	data, err := json.Marshal(routes)
-	if err != nil {
-		return nil, err
+	// upstreams may be changing at runtime, so each route is snapshotted
+	// under its own lock
+	snapshots := make([]json.RawMessage, 0, len(routes))
+	for _, route := range routes {
+		route.upstreamsMu.RLock()
+		data, err := json.Marshal(route)
+		route.upstreamsMu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, data)
 	}
 
-	return data, nil
+	return json.Marshal(snapshots)
 }
 
 func (store *GatewayConfigStore) LoadConfig(userId string, configData []byte) error {
@@ -49,9 +61,14 @@ func (store *GatewayConfigStore) LoadConfig(userId string, configData []byte) er
 
 	// spin up loadbalancer, ratelimiter and LRU cache instances for each route
 
+	assignTenant(routes, userId)
 	assignLoadBalancer(routes)
 	assignRateLimiter(routes)
 	assignCacheInstances(routes)
+	assignRetryBudgets(routes)
+	if err := assignFallbacks(routes); err != nil {
+		return err
+	}
 
 	store.Users[userId] = routes
 	return nil
@@ -73,9 +90,14 @@ func (store *GatewayConfigStore) UpdateConfig(userId string, configData []byte)
 		return err
 	}
 
+	assignTenant(routes, userId)
 	assignLoadBalancer(routes)
 	assignRateLimiter(routes)
 	assignCacheInstances(routes)
+	assignRetryBudgets(routes)
+	if err := assignFallbacks(routes); err != nil {
+		return err
+	}
 
 	store.mu.Lock()
 	store.Users[userId] = routes
@@ -83,6 +105,77 @@ func (store *GatewayConfigStore) UpdateConfig(userId string, configData []byte)
 	return nil
 }
 
+// LoadSettings replaces the gateway-wide settings with the JSON object in
+// data. They take effect when a gateway is built from the store.
+func (store *GatewayConfigStore) LoadSettings(data []byte) error {
+	var settings GatewaySettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	if _, err := ParseNetworks(settings.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.Settings = settings
+	return nil
+}
+
+// LoadServices adds the JSON list of services to the ones routes can refer
+// to, replacing any with the same name.
+func (store *GatewayConfigStore) LoadServices(data []byte) error {
+	var services []ServiceConfig
+	if err := json.Unmarshal(data, &services); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, service := range services {
+		if service.Name == "" {
+			return fmt.Errorf("service without a name")
+		}
+		store.Services[service.Name] = service
+	}
+	return nil
+}
+
+// Service returns the named service.
+func (store *GatewayConfigStore) Service(name string) (ServiceConfig, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	service, ok := store.Services[name]
+	return service, ok
+}
+
+// Routes returns every route of every user.
+func (store *GatewayConfigStore) Routes() []*RouteConfig {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var out []*RouteConfig
+	for _, routes := range store.Users {
+		out = append(out, routes...)
+	}
+	return out
+}
+
+// Route finds a user's route by its configured method and path (not by
+// matching a request path against it).
+func (store *GatewayConfigStore) Route(userId, method, path string) (*RouteConfig, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, route := range store.Users[userId] {
+		if route.Method == method && route.Path == path {
+			return route, nil
+		}
+	}
+	return nil, fmt.Errorf("no route %s %s for user %s", method, path, userId)
+}
+
 func (store *GatewayConfigStore) MatchPath(userId string, path string, method string) (*RouteConfig, error) {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
@@ -137,6 +230,28 @@ func (store *GatewayConfigStore) MatchPath(userId string, path string, method st
 	return nil, fmt.Errorf("no matching route found")
 }
 
+// ID names the route uniquely across tenants.
+func (route *RouteConfig) ID() string {
+	return route.Tenant + " " + route.Method + " " + route.Path
+}
+
+// PathParam returns the segment of reqPath matched by the ":name" or "{name}"
+// segment of the route's path, or "" if the route has no such parameter.
+func (route *RouteConfig) PathParam(reqPath, name string) string {
+	pSegs := strings.Split(strings.Trim(route.Path, "/"), "/")
+	rSegs := strings.Split(strings.Trim(reqPath, "/"), "/")
+
+	for i, ps := range pSegs {
+		if i >= len(rSegs) {
+			break
+		}
+		if ps == ":"+name || ps == "{"+name+"}" {
+			return rSegs[i]
+		}
+	}
+	return ""
+}
+
 func matchAndScore(pattern, req string) (bool, int) {
 	// trim leading slash for splitting
 	p := strings.Trim(pattern, "/")
@@ -196,10 +311,90 @@ func matchAndScore(pattern, req string) (bool, int) {
 	return true, score
 }
 
+// UpstreamFor returns the config of the route's upstream with the given URL.
+func (route *RouteConfig) UpstreamFor(url string) (UpstreamConfig, bool) {
+	route.upstreamsMu.RLock()
+	defer route.upstreamsMu.RUnlock()
+
+	for _, upstream := range route.Upstreams {
+		if upstream.URL == url {
+			return upstream, true
+		}
+	}
+	return UpstreamConfig{}, false
+}
+
+// UpstreamList returns a snapshot of the route's upstreams.
+func (route *RouteConfig) UpstreamList() []UpstreamConfig {
+	route.upstreamsMu.RLock()
+	defer route.upstreamsMu.RUnlock()
+
+	return append([]UpstreamConfig(nil), route.Upstreams...)
+}
+
+// RetryBudgetFor returns the upstream's own retry budget, or nil.
+func (route *RouteConfig) RetryBudgetFor(url string) *retrybudget.Budget {
+	route.upstreamsMu.RLock()
+	defer route.upstreamsMu.RUnlock()
+
+	return route.UpstreamRetryBudgets[url]
+}
+
+// HealthCheckFor returns the health check that applies to upstream: its own
+// if enabled, otherwise the route's, probing in the upstream's protocol.
+func (route *RouteConfig) HealthCheckFor(upstream UpstreamConfig) HealthCheckConfig {
+	cfg := route.HealthCheck
+	if upstream.HealthCheck.Enabled {
+		cfg = upstream.HealthCheck
+	}
+	cfg.Protocol = upstream.Protocol
+	return cfg
+}
+
 // utils
+func assignTenant(routes []*RouteConfig, userId string) {
+	for _, route := range routes {
+		route.Tenant = userId
+	}
+}
+
 func assignLoadBalancer(routes []*RouteConfig) {
 	for _, route := range routes {
-		route.LoadBalancer = loadbalancer.New(route.LoadBalance, getUpstreamURLs(route.Upstreams), getUpstreamWeights(route.Upstreams))
+		urls := getUpstreamURLs(route.Upstreams)
+		// pools let upstreams be added, drained and removed at runtime
+		pool := loadbalancer.NewPool(route.LoadBalance, urls, getUpstreamWeights(route.Upstreams))
+		if pool == nil {
+			route.LoadBalancer = nil
+			continue
+		}
+		route.LoadBalancer = pool
+
+		if route.Outlier.Enabled {
+			detector := outlier.New(urls, outlierOptions(route.Outlier))
+			pool.OnChange(func() {
+				servers := []string{}
+				for _, m := range pool.Members() {
+					servers = append(servers, m.Server)
+				}
+				detector.SetServers(servers)
+			})
+			route.OutlierDetector = detector
+			route.LoadBalancer = outlier.Wrap(pool, detector)
+		}
+	}
+}
+
+func outlierOptions(cfg OutlierConfig) outlier.Options {
+	return outlier.Options{
+		Consecutive5xx:     cfg.Consecutive5xx,
+		Interval:           time.Duration(cfg.IntervalMs) * time.Millisecond,
+		BaseEjection:       time.Duration(cfg.BaseEjectionMs) * time.Millisecond,
+		MaxEjection:        time.Duration(cfg.MaxEjectionMs) * time.Millisecond,
+		MaxEjectionPercent: cfg.MaxEjectionPercent,
+		SuccessRateFactor:  cfg.SuccessRateStdevFactor,
+		LatencyFactor:      cfg.LatencyFactor,
+		MinHosts:           cfg.MinHosts,
+		MinRequests:        cfg.MinRequests,
 	}
 }
 
@@ -250,3 +445,69 @@ func assignCacheInstances(routes []*RouteConfig) {
 		}
 	}
 }
+
+func assignRetryBudgets(routes []*RouteConfig) {
+	for _, route := range routes {
+		if route.Retry.Budget.Enabled {
+			route.RetryBudget = newRetryBudget(route.Retry.Budget)
+		}
+
+		route.UpstreamRetryBudgets = make(map[string]*retrybudget.Budget)
+		for _, upstream := range route.Upstreams {
+			if upstream.RetryBudget.Enabled {
+				route.UpstreamRetryBudgets[upstream.URL] = newRetryBudget(upstream.RetryBudget)
+			}
+		}
+	}
+}
+
+// assignFallbacks reads the routes' static fallback bodies and builds a
+// route over each secondary pool, sharing the primary route's path, tenant,
+// timeouts and health check so breakers and checks treat it like any other.
+func assignFallbacks(routes []*RouteConfig) error {
+	for _, route := range routes {
+		fb := route.Fallback
+		if fb.BodyFile != "" {
+			body, err := os.ReadFile(fb.BodyFile)
+			if err != nil {
+				return fmt.Errorf("fallback for route %s %s: %w", route.Method, route.Path, err)
+			}
+			route.FallbackBody = body
+		} else if fb.Body != "" {
+			route.FallbackBody = []byte(fb.Body)
+		}
+
+		if len(fb.Upstreams) == 0 {
+			continue
+		}
+		lb := fb.LoadBalance
+		if lb == "" {
+			lb = "round_robin"
+		}
+		secondary := &RouteConfig{
+			Path:         route.Path,
+			Method:       route.Method,
+			Upstreams:    fb.Upstreams,
+			LoadBalance:  lb,
+			Tenant:       route.Tenant,
+			BreakerScope: route.BreakerScope,
+			Timeouts:     route.Timeouts,
+			HealthCheck:  route.HealthCheck,
+			Streaming:    route.Streaming,
+		}
+		assignLoadBalancer([]*RouteConfig{secondary})
+		if secondary.LoadBalancer == nil {
+			return fmt.Errorf("fallback for route %s %s: unknown load balancer %q", route.Method, route.Path, lb)
+		}
+		route.FallbackRoute = secondary
+	}
+	return nil
+}
+
+func newRetryBudget(cfg RetryBudgetConfig) *retrybudget.Budget {
+	window := time.Duration(cfg.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	return retrybudget.New(cfg.Percent, cfg.MinRetriesPerSec, window)
+}
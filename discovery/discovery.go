@@ -0,0 +1,192 @@
+package discovery
+
+import (
+	"FluxGate/configuration"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefresh = 5 * time.Second
+	defaultMinTTL  = 1 * time.Second
+
+	// first wait after a failed resolve, doubled up to the refresh interval
+	retryDelay = 500 * time.Millisecond
+)
+
+var errNoEndpoints = errors.New("discovery returned no endpoints")
+
+// Endpoint is one upstream of a discovered service.
+type Endpoint struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// RefreshNow is the ttl of an answer that mustn't be reused: the watcher
+// asks again after its minimum TTL.
+const RefreshNow time.Duration = 1
+
+// Provider looks up a service's current endpoints. ttl is how long the
+// answer may be used, 0 meaning the provider has no opinion.
+type Provider interface {
+	Resolve(ctx context.Context) (endpoints []Endpoint, ttl time.Duration, err error)
+}
+
+// New returns the provider for cfg.
+func New(cfg configuration.ServiceConfig) (Provider, error) {
+	switch cfg.Type {
+	case "dns":
+		if cfg.Host == "" || cfg.Port == 0 {
+			return nil, fmt.Errorf("service %s: dns needs host and port", cfg.Name)
+		}
+		return NewDNS(cfg.Host, cfg.Port, cfg.Scheme, cfg.DNSServer), nil
+	case "srv":
+		if cfg.Host == "" {
+			return nil, fmt.Errorf("service %s: srv needs host", cfg.Name)
+		}
+		return NewSRV(cfg.Host, cfg.Scheme, cfg.DNSServer), nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("service %s: file needs path", cfg.Name)
+		}
+		return NewFile(cfg.Path), nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("service %s: http needs url", cfg.Name)
+		}
+		return NewHTTP(cfg.URL), nil
+	}
+	return nil, fmt.Errorf("service %s: unknown discovery type %q", cfg.Name, cfg.Type)
+}
+
+// Watcher re-resolves a provider for as long as it runs and reports every
+// change of the endpoint set. A failed or empty resolve keeps the last
+// endpoints, so an outage of the discovery source doesn't empty the pool.
+type Watcher struct {
+	name     string
+	provider Provider
+	update   func([]Endpoint)
+
+	refresh time.Duration
+	minTTL  time.Duration
+	retry   int // failed resolves in a row, only touched by the watch loop
+
+	mu      sync.RWMutex
+	current []Endpoint
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWatcher returns a watcher calling update with every new endpoint set
+// of the service. Call Start to begin.
+func NewWatcher(cfg configuration.ServiceConfig, provider Provider, update func([]Endpoint)) *Watcher {
+	w := &Watcher{
+		name:     cfg.Name,
+		provider: provider,
+		update:   update,
+		refresh:  time.Duration(cfg.RefreshMs) * time.Millisecond,
+		minTTL:   time.Duration(cfg.MinTTLMs) * time.Millisecond,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if w.refresh <= 0 {
+		w.refresh = defaultRefresh
+	}
+	if w.minTTL <= 0 {
+		w.minTTL = defaultMinTTL
+	}
+	return w
+}
+
+// Start resolves the service once, so routes have upstreams before the
+// gateway serves, then keeps it up to date in the background.
+func (w *Watcher) Start() {
+	next := w.resolve()
+	go w.loop(next)
+}
+
+// Stop ends the watch and waits for an in-flight resolve.
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// Endpoints returns the last endpoints reported.
+func (w *Watcher) Endpoints() []Endpoint {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.Clone(w.current)
+}
+
+func (w *Watcher) loop(wait time.Duration) {
+	defer close(w.done)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+			timer.Reset(w.resolve())
+		}
+	}
+}
+
+// resolve asks the provider once and returns when to ask again.
+func (w *Watcher) resolve() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), w.refresh)
+	defer cancel()
+
+	endpoints, ttl, err := w.provider.Resolve(ctx)
+	if err == nil && len(endpoints) == 0 {
+		err = errNoEndpoints
+	}
+	if err != nil {
+		log.Printf("discovery: service %s: %v", w.name, err)
+		return w.backoff()
+	}
+	w.retry = 0
+
+	for i := range endpoints {
+		if endpoints[i].Weight <= 0 {
+			endpoints[i].Weight = 1
+		}
+	}
+	slices.SortFunc(endpoints, func(a, b Endpoint) int { return strings.Compare(a.URL, b.URL) })
+	endpoints = slices.CompactFunc(endpoints, func(a, b Endpoint) bool { return a.URL == b.URL })
+
+	w.mu.Lock()
+	changed := !slices.Equal(endpoints, w.current)
+	if changed {
+		w.current = endpoints
+	}
+	w.mu.Unlock()
+	if changed {
+		w.update(slices.Clone(endpoints))
+	}
+
+	switch {
+	case ttl <= 0:
+		return w.refresh
+	case ttl < w.minTTL:
+		return w.minTTL
+	}
+	return ttl
+}
+
+func (w *Watcher) backoff() time.Duration {
+	wait := retryDelay << w.retry
+	if wait >= w.refresh || wait <= 0 {
+		return w.refresh
+	}
+	w.retry++
+	return wait
+}
@@ -0,0 +1,334 @@
+package discovery
+
+import (
+	"FluxGate/configuration"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDNS answers queries from a fixed table over UDP and TCP. With
+// truncate set, UDP answers only say "ask over TCP"; with spoof set, each
+// UDP answer is preceded by one with the wrong id and one to another
+// question.
+type stubDNS struct {
+	mu       sync.Mutex
+	records  map[string][]record // "name type"
+	truncate bool
+	spoof    bool
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func newStubDNS(t *testing.T) *stubDNS {
+	t.Helper()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubDNS{records: make(map[string][]record), udp: udp, tcp: tcp}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := s.answer(buf[:n], true)
+			s.mu.Lock()
+			spoof := s.spoof
+			s.mu.Unlock()
+			if spoof {
+				wrongID := append([]byte(nil), resp...)
+				wrongID[1]++
+				udp.WriteTo(wrongID, addr)
+				// same id, but asking for the records of another type
+				_, off, _ := readName(resp, 12)
+				wrongQuestion := append([]byte(nil), resp...)
+				wrongQuestion[off+1]++
+				udp.WriteTo(wrongQuestion, addr)
+			}
+			udp.WriteTo(resp, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var size [2]byte
+			io.ReadFull(conn, size[:])
+			query := make([]byte, binary.BigEndian.Uint16(size[:]))
+			io.ReadFull(conn, query)
+			resp := s.answer(query, false)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			conn.Close()
+		}
+	}()
+	return s
+}
+
+func (s *stubDNS) addr() string { return s.udp.LocalAddr().String() }
+
+func (s *stubDNS) set(name string, typ uint16, records ...record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[fmt.Sprintf("%s %d", name, typ)] = records
+}
+
+func (s *stubDNS) answer(query []byte, overUDP bool) []byte {
+	name, off, _ := readName(query, 12)
+	typ := binary.BigEndian.Uint16(query[off:])
+	question := query[12 : off+4]
+
+	s.mu.Lock()
+	answers := s.records[fmt.Sprintf("%s %d", name, typ)]
+	var additional []record
+	for _, rr := range answers {
+		if rr.typ == typeSRV {
+			additional = append(additional, s.records[fmt.Sprintf("%s %d", rr.target, typeA)]...)
+		}
+	}
+	_, hasA := s.records[fmt.Sprintf("%s %d", name, typeA)]
+	truncated := overUDP && s.truncate
+	s.mu.Unlock()
+
+	flags := uint16(0x8000 | flagRD | 0x80) // response, recursion available
+	if !hasA && len(answers) == 0 {
+		flags |= rcodeNXDomain
+	}
+	if truncated {
+		flags |= flagTC
+		answers, additional = nil, nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(additional)))
+	msg = append(msg, question...)
+	for _, rr := range append(answers, additional...) {
+		if rr.name == name {
+			msg = append(msg, 0xc0, 12) // compressed: the question's name
+		} else {
+			msg, _ = appendName(msg, rr.name)
+		}
+		msg = binary.BigEndian.AppendUint16(msg, rr.typ)
+		msg = binary.BigEndian.AppendUint16(msg, classIN)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(rr.ttl/time.Second))
+
+		var data []byte
+		switch rr.typ {
+		case typeA, typeAAAA:
+			data = rr.addr.AsSlice()
+		case typeSRV:
+			data = binary.BigEndian.AppendUint16(data, rr.priority)
+			data = binary.BigEndian.AppendUint16(data, rr.weight)
+			data = binary.BigEndian.AppendUint16(data, rr.port)
+			data, _ = appendName(data, rr.target)
+		}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+	}
+	return msg
+}
+
+func a(name, ip string, ttl time.Duration) record {
+	addr := netip.MustParseAddr(ip)
+	typ := typeA
+	if addr.Is6() {
+		typ = typeAAAA
+	}
+	return record{name: name, typ: typ, ttl: ttl, addr: addr}
+}
+
+func TestDNSResolvesAAndAAAA(t *testing.T) {
+	dns := newStubDNS(t)
+	dns.set("payments.test.", typeA, a("payments.test.", "10.0.0.1", 30*time.Second), a("payments.test.", "10.0.0.2", 10*time.Second))
+	dns.set("payments.test.", typeAAAA, a("payments.test.", "fd00::1", 60*time.Second))
+
+	endpoints, ttl, err := NewDNS("payments.test", 8080, "", dns.addr()).Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Endpoint{{"http://10.0.0.1:8080", 1}, {"http://10.0.0.2:8080", 1}, {"http://[fd00::1]:8080", 1}}
+	if fmt.Sprint(endpoints) != fmt.Sprint(want) || ttl != 10*time.Second {
+		t.Fatalf("got %v ttl %v", endpoints, ttl)
+	}
+
+	if _, _, err := NewDNS("missing.test", 80, "", dns.addr()).Resolve(context.Background()); err == nil {
+		t.Fatal("expected an error for an unknown host")
+	}
+}
+
+func TestSRVUsesBestPriorityAndFallsBackToTCP(t *testing.T) {
+	dns := newStubDNS(t)
+	dns.truncate = true
+	dns.set("_http._tcp.payments.test.", typeSRV,
+		record{name: "_http._tcp.payments.test.", typ: typeSRV, ttl: 20 * time.Second, priority: 10, weight: 3, port: 9001, target: "p1.test."},
+		record{name: "_http._tcp.payments.test.", typ: typeSRV, ttl: 20 * time.Second, priority: 10, weight: 1, port: 9002, target: "p2.test."},
+		record{name: "_http._tcp.payments.test.", typ: typeSRV, ttl: 20 * time.Second, priority: 20, weight: 1, port: 9003, target: "backup.test."},
+	)
+	dns.set("p1.test.", typeA, a("p1.test.", "10.0.0.1", time.Minute))
+
+	endpoints, ttl, err := NewSRV("_http._tcp.payments.test", "", dns.addr()).Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// p2 has no address in the answer, so its name is used
+	want := []Endpoint{{"http://10.0.0.1:9001", 3}, {"http://p2.test:9002", 1}}
+	if fmt.Sprint(endpoints) != fmt.Sprint(want) || ttl != 20*time.Second {
+		t.Fatalf("got %v ttl %v", endpoints, ttl)
+	}
+}
+
+func TestDNSZeroTTLMeansRefreshSoon(t *testing.T) {
+	dns := newStubDNS(t)
+	for _, order := range [][]time.Duration{{0, 300 * time.Second}, {300 * time.Second, 0}} {
+		dns.set("payments.test.", typeA, a("payments.test.", "10.0.0.1", order[0]), a("payments.test.", "10.0.0.2", order[1]))
+		_, ttl, err := NewDNS("payments.test", 8080, "", dns.addr()).Resolve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != RefreshNow {
+			t.Fatalf("TTLs %v: got ttl %v, want RefreshNow", order, ttl)
+		}
+	}
+
+	// a zero TTL on a less preferred SRV target doesn't count
+	dns.set("_http._tcp.payments.test.", typeSRV,
+		record{name: "_http._tcp.payments.test.", typ: typeSRV, ttl: 0, priority: 20, port: 9003, target: "backup.test."},
+		record{name: "_http._tcp.payments.test.", typ: typeSRV, ttl: 20 * time.Second, priority: 10, port: 9001, target: "p1.test."},
+	)
+	_, ttl, err := NewSRV("_http._tcp.payments.test", "", dns.addr()).Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 20*time.Second {
+		t.Fatalf("got ttl %v, want 20s", ttl)
+	}
+}
+
+func writeEndpoints(t *testing.T, path string, endpoints ...Endpoint) {
+	t.Helper()
+	data, _ := json.Marshal(endpoints)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRereadsOnlyWhenModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.json")
+	writeEndpoints(t, path, Endpoint{URL: "http://a:1", Weight: 2})
+
+	f := NewFile(path)
+	first, _, err := f.Resolve(context.Background())
+	if err != nil || fmt.Sprint(first) != "[{http://a:1 2}]" {
+		t.Fatalf("got %v, %v", first, err)
+	}
+
+	writeEndpoints(t, path, Endpoint{URL: "http://a:1"}, Endpoint{URL: "http://b:1"})
+	second, _, err := f.Resolve(context.Background())
+	if err != nil || len(second) != 2 {
+		t.Fatalf("modified file not reread: %v, %v", second, err)
+	}
+}
+
+func TestHTTPUsesMaxAgeAsTTL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=15")
+		w.Write([]byte(`[{"url": "http://a:1", "weight": 1}]`))
+	}))
+	defer srv.Close()
+
+	endpoints, ttl, err := NewHTTP(srv.URL).Resolve(context.Background())
+	if err != nil || len(endpoints) != 1 || ttl != 15*time.Second {
+		t.Fatalf("got %v ttl %v err %v", endpoints, ttl, err)
+	}
+}
+
+// flakyProvider answers from its list, failing while err is set.
+type flakyProvider struct {
+	mu        sync.Mutex
+	endpoints []Endpoint
+	err       error
+}
+
+func (p *flakyProvider) Resolve(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Endpoint(nil), p.endpoints...), 0, p.err
+}
+
+func (p *flakyProvider) set(err error, endpoints ...Endpoint) {
+	p.mu.Lock()
+	p.endpoints, p.err = endpoints, err
+	p.mu.Unlock()
+}
+
+func TestWatcherReportsChangesAndKeepsLastSetOnFailure(t *testing.T) {
+	p := &flakyProvider{endpoints: []Endpoint{{URL: "http://b:1"}, {URL: "http://a:1"}}}
+	updates := make(chan []Endpoint, 10)
+
+	w := NewWatcher(configuration.ServiceConfig{Name: "payments", RefreshMs: 10}, p, func(e []Endpoint) { updates <- e })
+	w.Start()
+	defer w.Stop()
+
+	if got := fmt.Sprint(<-updates); got != "[{http://a:1 1} {http://b:1 1}]" {
+		t.Fatalf("first update: %s", got)
+	}
+
+	p.set(fmt.Errorf("source down"))
+	time.Sleep(50 * time.Millisecond)
+	p.set(nil) // resolves, but empty
+	time.Sleep(50 * time.Millisecond)
+	if len(updates) != 0 || len(w.Endpoints()) != 2 {
+		t.Fatalf("failed resolves should keep the last endpoints, got %v", w.Endpoints())
+	}
+
+	p.set(nil, Endpoint{URL: "http://a:1", Weight: 5})
+	select {
+	case got := <-updates:
+		if fmt.Sprint(got) != "[{http://a:1 5}]" {
+			t.Fatalf("second update: %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("change not reported")
+	}
+}
+
+func TestDNSSkipsResponsesToOtherQueries(t *testing.T) {
+	dns := newStubDNS(t)
+	dns.spoof = true
+	dns.set("payments.test.", typeA, a("payments.test.", "10.0.0.1", 30*time.Second))
+
+	endpoints, _, err := NewDNS("payments.test", 8080, "", dns.addr()).Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Endpoint{{"http://10.0.0.1:8080", 1}}; fmt.Sprint(endpoints) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", endpoints, want)
+	}
+}
@@ -0,0 +1,142 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS finds a service's endpoints in the A and AAAA records of a host, all
+// on the same port.
+type DNS struct {
+	host   string
+	port   int
+	scheme string
+	client *dnsClient
+}
+
+// NewDNS resolves host against server ("" = the system's nameserver).
+func NewDNS(host string, port int, scheme, server string) *DNS {
+	return &DNS{host: host, port: port, scheme: schemeOrHTTP(scheme), client: newDNSClient(server)}
+}
+
+// Resolve returns an endpoint per address; the TTL is the shortest of the
+// records'. A host with only one of the two record types is fine.
+func (d *DNS) Resolve(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	var endpoints []Endpoint
+	ttl := noTTL
+	var errs []error
+
+	for _, typ := range []uint16{typeA, typeAAAA} {
+		ans, err := d.client.query(ctx, d.host, typ)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range ans.records {
+			if rr.typ != typ {
+				continue // CNAMEs on the way
+			}
+			endpoints = append(endpoints, Endpoint{URL: endpointURL(d.scheme, rr.addr.String(), d.port), Weight: 1})
+			ttl = minTTL(ttl, rr.ttl)
+		}
+	}
+	if len(endpoints) == 0 && len(errs) > 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	return endpoints, answerTTL(ttl), nil
+}
+
+// SRV finds a service's endpoints in SRV records, which carry the port and
+// a weight for each target. Only the most preferred (lowest) priority is
+// used.
+type SRV struct {
+	name   string
+	scheme string
+	client *dnsClient
+}
+
+// NewSRV resolves the SRV record name against server ("" = the system's
+// nameserver).
+func NewSRV(name, scheme, server string) *SRV {
+	return &SRV{name: name, scheme: schemeOrHTTP(scheme), client: newDNSClient(server)}
+}
+
+func (s *SRV) Resolve(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	ans, err := s.client.query(ctx, s.name, typeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// servers usually send the targets' addresses along
+	addrs := make(map[string][]string)
+	for _, rr := range ans.additional {
+		if rr.typ == typeA || rr.typ == typeAAAA {
+			addrs[rr.name] = append(addrs[rr.name], rr.addr.String())
+		}
+	}
+
+	var endpoints []Endpoint
+	ttl := noTTL
+	best := -1
+	for _, rr := range ans.records {
+		if rr.typ != typeSRV || rr.target == "." {
+			continue // "." means the service is decidedly not available
+		}
+		if best >= 0 && int(rr.priority) > best {
+			continue
+		}
+		if int(rr.priority) < best || best < 0 {
+			best = int(rr.priority)
+			endpoints = endpoints[:0]
+			ttl = noTTL
+		}
+
+		hosts := addrs[rr.target]
+		if len(hosts) == 0 {
+			hosts = []string{strings.TrimSuffix(rr.target, ".")}
+		}
+		for _, host := range hosts {
+			endpoints = append(endpoints, Endpoint{URL: endpointURL(s.scheme, host, int(rr.port)), Weight: int(rr.weight)})
+		}
+		ttl = minTTL(ttl, rr.ttl)
+	}
+	return endpoints, answerTTL(ttl), nil
+}
+
+func endpointURL(scheme, host string, port int) string {
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func schemeOrHTTP(scheme string) string {
+	if scheme == "" {
+		return "http"
+	}
+	return scheme
+}
+
+// noTTL marks a TTL not taken from any record yet; 0 is a real TTL.
+const noTTL time.Duration = -1
+
+func minTTL(a, b time.Duration) time.Duration {
+	if a == noTTL || b < a {
+		return b
+	}
+	return a
+}
+
+// answerTTL turns the shortest record TTL into the one Resolve reports: a
+// record that mustn't be cached (TTL 0) asks for the soonest refresh, while
+// no records at all leave it to the watcher.
+func answerTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl == noTTL:
+		return 0
+	case ttl == 0:
+		return RefreshNow
+	}
+	return ttl
+}
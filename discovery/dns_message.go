@@ -0,0 +1,330 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS record types and the wire format bits the resolver needs (RFC 1035,
+// RFC 3596 for AAAA, RFC 2782 for SRV).
+const (
+	typeA    uint16 = 1
+	typeAAAA uint16 = 28
+	typeSRV  uint16 = 33
+	classIN  uint16 = 1
+
+	flagRD    = 1 << 8 // recursion desired
+	flagTC    = 1 << 9 // truncated, ask again over TCP
+	rcodeMask = 0xf
+
+	rcodeNXDomain = 3
+
+	maxUDPSize = 4096
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+// record is one resource record of an answer. Only the fields of the
+// record's type are set.
+type record struct {
+	name string
+	typ  uint16
+	ttl  time.Duration
+
+	addr netip.Addr // A / AAAA
+
+	priority, weight, port uint16 // SRV
+	target                 string
+}
+
+// answer holds the answer and additional sections of a response.
+type answer struct {
+	records    []record
+	additional []record
+}
+
+// dnsClient sends queries to one nameserver, over UDP and again over TCP if
+// the answer was truncated.
+type dnsClient struct {
+	server  string
+	timeout time.Duration
+}
+
+func newDNSClient(server string) *dnsClient {
+	if server == "" {
+		server = systemNameserver()
+	}
+	return &dnsClient{server: server, timeout: 2 * time.Second}
+}
+
+// systemNameserver is the first nameserver of /etc/resolv.conf.
+func systemNameserver() string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// query asks for name's records of type typ.
+func (c *dnsClient) query(ctx context.Context, name string, typ uint16) (*answer, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	id := uint16(rand.N(1 << 16))
+	msg, err := buildQuery(id, name, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	// anyone can send the socket a datagram, so only a response with the
+	// query's id and question counts as the answer
+	matches := func(resp []byte) bool {
+		return len(resp) >= 12 && binary.BigEndian.Uint16(resp) == id && sameQuestion(resp, name, typ)
+	}
+
+	resp, err := c.exchange(ctx, "udp", msg, matches)
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(resp[2:])&flagTC != 0 {
+		if resp, err = c.exchange(ctx, "tcp", msg, matches); err != nil {
+			return nil, err
+		}
+	}
+	return parseResponse(resp, id)
+}
+
+// exchange sends msg and returns the first response matches accepts. Over
+// UDP others are skipped until the context's deadline; over TCP, where the
+// connection is the query's own, any other response is an error.
+func (c *dnsClient) exchange(ctx context.Context, network string, msg []byte, matches func([]byte) bool) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if matches(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	// over TCP every message is prefixed with its length
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := conn.Write(append(framed, msg...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if !matches(buf) {
+		return nil, errors.New("dns: response does not match the query")
+	}
+	return buf, nil
+}
+
+// sameQuestion reports whether resp answers the single question of name's
+// records of type typ. Names compare case-insensitively.
+func sameQuestion(resp []byte, name string, typ uint16) bool {
+	if binary.BigEndian.Uint16(resp[4:]) != 1 {
+		return false
+	}
+	qname, off, err := readName(resp, 12)
+	if err != nil || off+4 > len(resp) {
+		return false
+	}
+	return strings.EqualFold(qname, strings.TrimSuffix(name, ".")+".") &&
+		binary.BigEndian.Uint16(resp[off:]) == typ &&
+		binary.BigEndian.Uint16(resp[off+2:]) == classIN
+}
+
+func buildQuery(id uint16, name string, typ uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], flagRD)
+	binary.BigEndian.PutUint16(msg[4:], 1) // one question
+
+	msg, err := appendName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, classIN)
+	return msg, nil
+}
+
+func appendName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return append(msg, 0), nil
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid dns name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0), nil
+}
+
+func parseResponse(msg []byte, id uint16) (*answer, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("dns: short response")
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, errors.New("dns: response id mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	switch rcode := flags & rcodeMask; rcode {
+	case 0:
+	case rcodeNXDomain:
+		return nil, errNoSuchHost
+	default:
+		return nil, fmt.Errorf("dns: server answered with rcode %d", rcode)
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4 // type and class
+	}
+
+	ans := &answer{}
+	for i := 0; i < ancount+nscount+arcount; i++ {
+		rr, next, err := readRecord(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		switch {
+		case i < ancount:
+			ans.records = append(ans.records, rr)
+		case i >= ancount+nscount:
+			ans.additional = append(ans.additional, rr)
+		}
+	}
+	return ans, nil
+}
+
+func readRecord(msg []byte, off int) (record, int, error) {
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return record{}, 0, err
+	}
+	if off+10 > len(msg) {
+		return record{}, 0, errors.New("dns: truncated record")
+	}
+	rr := record{
+		name: name,
+		typ:  binary.BigEndian.Uint16(msg[off:]),
+		ttl:  time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second,
+	}
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+length > len(msg) {
+		return record{}, 0, errors.New("dns: truncated record data")
+	}
+	data := msg[off : off+length]
+
+	switch rr.typ {
+	case typeA, typeAAAA:
+		addr, ok := netip.AddrFromSlice(data)
+		if !ok {
+			return record{}, 0, errors.New("dns: bad address record")
+		}
+		rr.addr = addr.Unmap()
+	case typeSRV:
+		if length < 7 {
+			return record{}, 0, errors.New("dns: bad srv record")
+		}
+		rr.priority = binary.BigEndian.Uint16(data[0:])
+		rr.weight = binary.BigEndian.Uint16(data[2:])
+		rr.port = binary.BigEndian.Uint16(data[4:])
+		// the target may be compressed against the rest of the message
+		if rr.target, _, err = readName(msg, off+6); err != nil {
+			return record{}, 0, err
+		}
+	}
+	return rr, off + length, nil
+}
+
+// readName decodes the possibly compressed name at off and returns it along
+// with the offset just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("dns: truncated name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("dns: truncated name")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("dns: compression loop")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("dns: truncated name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxListBytes bounds the endpoint list read from a file or HTTP endpoint.
+const maxListBytes = 1 << 20
+
+// File reads a service's endpoints from a local JSON file, a list of
+// {"url", "weight"} objects. The watcher polls it, and it is only parsed
+// again once it has been modified.
+type File struct {
+	path string
+
+	modTime   time.Time
+	size      int64
+	endpoints []Endpoint
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Resolve is only called by the watch loop, so the cached list needs no lock.
+func (f *File) Resolve(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if f.endpoints != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return append([]Endpoint(nil), f.endpoints...), 0, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	endpoints, err := decodeEndpoints(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.modTime, f.size, f.endpoints = info.ModTime(), info.Size(), endpoints
+	return append([]Endpoint(nil), endpoints...), 0, nil
+}
+
+// HTTP fetches a service's endpoints from a URL answering with the same
+// JSON list as File. A max-age in the response's Cache-Control is used as
+// its TTL.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTP(url string) *HTTP {
+	return &HTTP{url: url, client: &http.Client{}}
+}
+
+func (h *HTTP) Resolve(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s answered %d", h.url, resp.StatusCode)
+	}
+
+	endpoints, err := decodeEndpoints(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", h.url, err)
+	}
+	return endpoints, maxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+func decodeEndpoints(r io.Reader) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	if err := json.NewDecoder(io.LimitReader(r, maxListBytes)).Decode(&endpoints); err != nil {
+		return nil, err
+	}
+	for _, e := range endpoints {
+		if e.URL == "" {
+			return nil, fmt.Errorf("endpoint without url")
+		}
+	}
+	return endpoints, nil
+}
+
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// AdminHandler serves runtime upstream and breaker management. Endpoints
+// select a route with the user, method and path query parameters (the
+// route's configured path, e.g. /carts/:id). The upstream ones answer with
+// the route's members:
+//
+//	GET    /admin/upstreams                     list members
+//	POST   /admin/upstreams                     add (body: upstream config)
+//	DELETE /admin/upstreams?url=...             remove, in-flight requests finish
+//	POST   /admin/upstreams/drain?url=...       stop new requests, stay configured
+//	PUT    /admin/upstreams/weight?url=...&weight=N
+//
+// and manual control of the breaker guarding an upstream on the route,
+// answering with its status (scope, url, state, forced):
+//
+//	GET    /admin/breakers                      every breaker's state (no route needed)
+//	POST   /admin/breakers/force_open?url=...   reject every call until reset
+//	POST   /admin/breakers/force_close?url=...  let every call through until reset
+//	POST   /admin/breakers/reset?url=...        close and forget past calls
+//
+// The POST ones take user, method and path like the upstream endpoints, as
+// which breaker guards url depends on the route's breaker_scope.
+//
+// It changes routing for every client, so mount it on an internal listener.
+func (g *Gateway) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/upstreams", g.adminRoute(func(route *configuration.RouteConfig, r *http.Request) error {
+		return nil
+	}))
+
+	mux.HandleFunc("POST /admin/upstreams", g.adminRoute(func(route *configuration.RouteConfig, r *http.Request) error {
+		var upstream configuration.UpstreamConfig
+		if err := json.NewDecoder(r.Body).Decode(&upstream); err != nil {
+			return err
+		}
+		return route.AddUpstream(upstream)
+	}))
+
+	mux.HandleFunc("DELETE /admin/upstreams", g.adminRoute(func(route *configuration.RouteConfig, r *http.Request) error {
+		return route.RemoveUpstream(r.URL.Query().Get("url"))
+	}))
+
+	mux.HandleFunc("POST /admin/upstreams/drain", g.adminRoute(func(route *configuration.RouteConfig, r *http.Request) error {
+		return route.DrainUpstream(r.URL.Query().Get("url"))
+	}))
+
+	mux.HandleFunc("PUT /admin/upstreams/weight", g.adminRoute(func(route *configuration.RouteConfig, r *http.Request) error {
+		weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+		if err != nil {
+			return err
+		}
+		return route.SetUpstreamWeight(r.URL.Query().Get("url"), weight)
+	}))
+
+	mux.HandleFunc("GET /admin/breakers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.Breaker.List())
+	})
+
+	mux.HandleFunc("POST /admin/breakers/{op}", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		route, err := g.Store.Route(q.Get("user"), q.Get("method"), q.Get("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		cb := g.Breaker.Get(route, q.Get("url"))
+		if cb == nil {
+			http.Error(w, "no circuit breaker for "+q.Get("url"), http.StatusNotFound)
+			return
+		}
+
+		switch r.PathValue("op") {
+		case "force_open":
+			cb.ForceOpen()
+		case "force_close":
+			cb.ForceClose()
+		case "reset":
+			cb.Reset()
+		default:
+			http.Error(w, "unknown operation "+r.PathValue("op"), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		key := circuitbreaker.KeyFor(route, q.Get("url"))
+		json.NewEncoder(w).Encode(circuitbreaker.Status{Scope: key.Scope, Server: key.Server, State: cb.State(), Forced: cb.Forced()})
+	})
+
+	return mux
+}
+
+// adminRoute looks up the route named by the query, applies op to it and
+// writes the resulting membership.
+func (g *Gateway) adminRoute(op func(*configuration.RouteConfig, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		route, err := g.Store.Route(q.Get("user"), q.Get("method"), q.Get("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := op(route, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		members, err := route.Members()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	}
+}
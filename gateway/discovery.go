@@ -0,0 +1,56 @@
+package gateway
+
+import (
+	"FluxGate/configuration"
+	"FluxGate/discovery"
+	"log"
+)
+
+// watchServices starts a watcher for every service a route refers to and
+// keeps the membership of those routes in step with it.
+func (g *Gateway) watchServices() {
+	routes := make(map[string][]*configuration.RouteConfig)
+	for _, route := range g.Store.Routes() {
+		if route.Service != "" {
+			routes[route.Service] = append(routes[route.Service], route)
+		}
+	}
+
+	for name, routes := range routes {
+		cfg, ok := g.Store.Service(name)
+		if !ok {
+			log.Printf("discovery: routes refer to unknown service %s", name)
+			continue
+		}
+		provider, err := discovery.New(cfg)
+		if err != nil {
+			log.Printf("discovery: %v", err)
+			continue
+		}
+
+		w := discovery.NewWatcher(cfg, provider, func(endpoints []discovery.Endpoint) {
+			upstreams := make([]configuration.UpstreamConfig, 0, len(endpoints))
+			for _, e := range endpoints {
+				upstream := cfg.Upstream
+				upstream.URL, upstream.Weight = e.URL, e.Weight
+				upstreams = append(upstreams, upstream)
+			}
+			for _, route := range routes {
+				if err := route.SetUpstreams(upstreams); err != nil {
+					log.Printf("discovery: service %s on route %s %s: %v", name, route.Method, route.Path, err)
+				}
+			}
+		})
+		w.Start()
+		g.watchers = append(g.watchers, w)
+	}
+}
+
+// Close stops the gateway's background discovery and health checks.
+func (g *Gateway) Close() {
+	for _, w := range g.watchers {
+		w.Stop()
+	}
+	g.watchers = nil
+	g.Health.Stop()
+}
@@ -1,12 +1,23 @@
 package gateway
 
 import (
+	"FluxGate/circuitbreaker"
 	"FluxGate/configuration"
+	"FluxGate/loadbalancer"
+	"bufio"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGatewayCacheHit(t *testing.T) {
@@ -196,3 +207,1975 @@ func TestGatewayRetryExhaustsAndFails(t *testing.T) {
 		t.Fatalf("expected exactly 2 upstream attempts, got %d", hits)
 	}
 }
+
+func newTestGateway(t *testing.T, routes []map[string]interface{}) *Gateway {
+	t.Helper()
+
+	store := configuration.NewGatewayConfigStore()
+	data, _ := json.Marshal(routes)
+	if err := store.LoadConfig("demo", data); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return NewGateway(store)
+}
+
+func TestGatewayOversizedBodyStreamsWithoutRetry(t *testing.T) {
+	var calls atomic.Int32
+	var received atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+		http.Error(w, "fail", http.StatusInternalServerError)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/upload",
+			"method":         "PUT",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"retry": map[string]interface{}{
+				"enabled":          true,
+				"max_tries":        3,
+				"base_time_ms":     1,
+				"max_buffer_bytes": 16,
+			},
+		},
+	})
+
+	body := strings.Repeat("x", 4096)
+	req := httptest.NewRequest(http.MethodPut, "/upload", strings.NewReader(body))
+	req.Header.Set("X-User-ID", "demo")
+	rr := httptest.NewRecorder()
+	gw.Handler(rr, req)
+
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rr.Code)
+	}
+	if hits := calls.Load(); hits != 1 {
+		t.Fatalf("expected oversized body to be sent once, got %d attempts", hits)
+	}
+	if n := received.Load(); n != int64(len(body)) {
+		t.Fatalf("upstream received %d bytes, want %d", n, len(body))
+	}
+}
+
+func TestGatewayCacheSkipsOversizedResponse(t *testing.T) {
+	var upstreamHits atomic.Int32
+	payload := strings.Repeat("y", 2048)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.Write([]byte(payload))
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/big",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"cache": map[string]interface{}{
+				"enabled":        true,
+				"ttl_ms":         5000,
+				"max_entry":      10,
+				"max_body_bytes": 1024,
+			},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/big", nil)
+		req.Header.Set("X-User-ID", "demo")
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d expected 200 got %d", i+1, rr.Code)
+		}
+		if rr.Body.String() != payload {
+			t.Fatalf("request %d got %d body bytes, want %d", i+1, rr.Body.Len(), len(payload))
+		}
+	}
+
+	if hits := upstreamHits.Load(); hits != 2 {
+		t.Fatalf("expected oversized response to bypass the cache, got %d upstream hits", hits)
+	}
+}
+
+func TestGatewayProxiesUpgradedConnection(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/ws",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"upgrade":        map[string]interface{}{"idle_timeout_ms": 2000},
+			"retry":          map[string]interface{}{"enabled": true, "max_tries": 3},
+			"cache":          map[string]interface{}{"enabled": true, "ttl_ms": 5000, "max_entry": 10},
+		},
+	})
+	front := httptest.NewServer(http.HandlerFunc(gw.Handler))
+	t.Cleanup(front.Close)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial gateway: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: gateway\r\nX-User-ID: demo\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("expected echoed ping, got %q", got)
+	}
+	if n := loadbalancer.ActiveConns.Count(upstream.URL); n != 1 {
+		t.Fatalf("expected 1 active upgraded connection, got %d", n)
+	}
+}
+
+func TestGatewayUpgradeHonorsResponseHeaderTimeout(t *testing.T) {
+	// accepts the connection but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/ws",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{
+				{"url": "http://" + ln.Addr().String(), "weight": 1, "timeouts": map[string]interface{}{"response_header_ms": 100}},
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("X-User-ID", "demo")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	gw.Handler(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("response_header_ms not applied to the upgrade handshake, took %v", elapsed)
+	}
+}
+
+func TestGatewayFlushesEventStream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/events",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"retry":          map[string]interface{}{"enabled": true, "max_tries": 2},
+			"cache":          map[string]interface{}{"enabled": true, "ttl_ms": 5000, "max_entry": 10},
+		},
+	})
+	front := httptest.NewServer(http.HandlerFunc(gw.Handler))
+	t.Cleanup(front.Close)
+	t.Cleanup(func() { close(release) })
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/events", nil)
+	req.Header.Set("X-User-ID", "demo")
+
+	line := make(chan string, 1)
+	go func() {
+		resp, err := front.Client().Do(req)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+
+	select {
+	case got := <-line:
+		if got != "data: one\n" {
+			t.Fatalf("unexpected first event line %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("event was not flushed before the upstream finished")
+	}
+}
+
+func newH2CServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func grpcRoute(upstreamURL string, failureThreshold int) map[string]interface{} {
+	return map[string]interface{}{
+		"path":           "/pkg.Greeter/*",
+		"method":         "POST",
+		"load_balancing": "round_robin",
+		"upstreams": []map[string]interface{}{
+			{"url": upstreamURL, "weight": 1, "protocol": "h2c", "circuit_breaker": map[string]interface{}{
+				"enabled":            true,
+				"failure_threshold":  failureThreshold,
+				"window_seconds":     60,
+				"open_seconds":       60,
+				"half_open_requests": 1,
+				"success_threshold":  1,
+			}},
+		},
+	}
+}
+
+func TestGatewayProxiesGRPCOverH2C(t *testing.T) {
+	var gotProto, gotPath string
+	upstream := newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		gotProto, gotPath = r.Proto, r.URL.Path
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	gw := newTestGateway(t, []map[string]interface{}{grpcRoute(upstream.URL, 5)})
+
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("X-User-ID", "demo")
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "2S")
+	rr := httptest.NewRecorder()
+	gw.Handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if gotProto != "HTTP/2.0" {
+		t.Fatalf("expected upstream to be reached over HTTP/2, got %s", gotProto)
+	}
+	if gotPath != "/pkg.Greeter/SayHello" {
+		t.Fatalf("expected gRPC method path to be forwarded, got %q", gotPath)
+	}
+	if st := rr.Result().Trailer.Get("Grpc-Status"); st != "0" {
+		t.Fatalf("expected grpc-status trailer 0, got %q", st)
+	}
+}
+
+func TestGatewayGRPCUnavailableTripsBreaker(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// trailers-only error response
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	gw := newTestGateway(t, []map[string]interface{}{grpcRoute(upstream.URL, 2)})
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/pkg.Greeter/SayHello", nil)
+		req.Header.Set("X-User-ID", "demo")
+		req.Header.Set("Content-Type", "application/grpc")
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		codes = append(codes, rr.Code)
+	}
+
+	if codes[2] != http.StatusServiceUnavailable {
+		t.Fatalf("expected breaker to open after two UNAVAILABLE responses, got codes %v", codes)
+	}
+	if hits := calls.Load(); hits != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", hits)
+	}
+}
+
+func slowUpstream(t *testing.T, delay time.Duration, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("late"))
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGatewayPerTryTimeoutReturns504(t *testing.T) {
+	var calls atomic.Int32
+	upstream := slowUpstream(t, 500*time.Millisecond, &calls)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/slow",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{
+				// upstream override wins over the route's generous per-try timeout
+				{"url": upstream.URL, "weight": 1, "timeouts": map[string]interface{}{"per_try_ms": 50}},
+			},
+			"timeouts": map[string]interface{}{"per_try_ms": 5000},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	req.Header.Set("X-User-ID", "demo")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	gw.Handler(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("per-try timeout not applied, request took %v", elapsed)
+	}
+}
+
+func TestGatewayRetryRespectsTotalBudget(t *testing.T) {
+	var calls atomic.Int32
+	upstream := slowUpstream(t, 500*time.Millisecond, &calls)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/budget",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"retry":          map[string]interface{}{"enabled": true, "max_tries": 10, "base_time_ms": 1},
+			"timeouts":       map[string]interface{}{"per_try_ms": 60, "total_ms": 150},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/budget", nil)
+	req.Header.Set("X-User-ID", "demo")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	gw.Handler(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("total budget not applied, request took %v", elapsed)
+	}
+	if hits := calls.Load(); hits >= 10 {
+		t.Fatalf("expected the budget to cut retries short, got %d attempts", hits)
+	}
+}
+
+func TestGatewayRetryBackoffPastTotalBudgetReturns504(t *testing.T) {
+	var calls atomic.Int32
+	upstream := sequenceUpstream(t, &calls, 500, 500, 500)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/budget",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"retry":          map[string]interface{}{"enabled": true, "max_tries": 3, "base_time_ms": 1000, "backoff": "constant"},
+			"timeouts":       map[string]interface{}{"total_ms": 200},
+		},
+	})
+
+	start := time.Now()
+	rr := serveOnce(gw, http.MethodGet, "/budget")
+
+	if rr.Code != http.StatusGatewayTimeout || rr.Header().Get("X-Gateway-Error") != "timeout" {
+		t.Fatalf("expected 504 with X-Gateway-Error: timeout, got %d %q", rr.Code, rr.Header().Get("X-Gateway-Error"))
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("expected no wait for a backoff the budget can't cover, took %v", elapsed)
+	}
+	if hits := calls.Load(); hits != 1 {
+		t.Fatalf("expected a single attempt, got %d", hits)
+	}
+}
+
+// sequenceUpstream answers with the given statuses in order, then 200s.
+func sequenceUpstream(t *testing.T, calls *atomic.Int32, statuses ...int) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n <= len(statuses) {
+			http.Error(w, "scripted failure", statuses[n-1])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func serveOnce(gw *Gateway, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("X-User-ID", "demo")
+	rr := httptest.NewRecorder()
+	gw.Handler(rr, req)
+	return rr
+}
+
+func TestGatewayUpstreamRetryOverride(t *testing.T) {
+	var calls atomic.Int32
+	upstream := sequenceUpstream(t, &calls, 500, 500, 500, 500)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/legacy",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{
+				{"url": upstream.URL, "weight": 1, "retry_enabled": true, "retries": 2, "base_time_ms": 1},
+			},
+			"retry": map[string]interface{}{"enabled": false},
+		},
+	})
+
+	if rr := serveOnce(gw, http.MethodGet, "/legacy"); rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rr.Code)
+	}
+	if hits := calls.Load(); hits != 3 {
+		t.Fatalf("expected 1 try + 2 upstream-level retries, got %d calls", hits)
+	}
+}
+
+func TestGatewayRetrySkipsNonIdempotentByDefault(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		var calls atomic.Int32
+		upstream := sequenceUpstream(t, &calls, 500)
+
+		gw := newTestGateway(t, []map[string]interface{}{
+			{
+				"path":           "/orders",
+				"method":         "POST",
+				"load_balancing": "round_robin",
+				"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+				"retry": map[string]interface{}{
+					"enabled":              true,
+					"max_tries":            3,
+					"base_time_ms":         1,
+					"retry_non_idempotent": allow,
+				},
+			},
+		})
+
+		rr := serveOnce(gw, http.MethodPost, "/orders")
+		wantCode, wantCalls := http.StatusBadGateway, int32(1)
+		if allow {
+			wantCode, wantCalls = http.StatusOK, 2
+		}
+		if rr.Code != wantCode || calls.Load() != wantCalls {
+			t.Fatalf("retry_non_idempotent=%v: got %d after %d calls, want %d after %d",
+				allow, rr.Code, calls.Load(), wantCode, wantCalls)
+		}
+	}
+}
+
+func TestGatewayRetryableConditions(t *testing.T) {
+	route := func(url string) []map[string]interface{} {
+		return []map[string]interface{}{
+			{
+				"path":           "/cond",
+				"method":         "GET",
+				"load_balancing": "round_robin",
+				"upstreams":      []map[string]interface{}{{"url": url, "weight": 1}},
+				"retry": map[string]interface{}{
+					"enabled":          true,
+					"max_tries":        3,
+					"base_time_ms":     1,
+					"retry_on":         []string{"connect_error"},
+					"retryable_status": []int{429},
+				},
+			},
+		}
+	}
+
+	var calls429 atomic.Int32
+	gw := newTestGateway(t, route(sequenceUpstream(t, &calls429, 429).URL))
+	if rr := serveOnce(gw, http.MethodGet, "/cond"); rr.Code != http.StatusOK || calls429.Load() != 2 {
+		t.Fatalf("expected 429 to be retried: got %d after %d calls", rr.Code, calls429.Load())
+	}
+
+	var calls500 atomic.Int32
+	gw = newTestGateway(t, route(sequenceUpstream(t, &calls500, 500).URL))
+	// a non-retryable failure is passed through as-is
+	if rr := serveOnce(gw, http.MethodGet, "/cond"); rr.Code != http.StatusInternalServerError || calls500.Load() != 1 {
+		t.Fatalf("expected 500 not to be retried without \"5xx\": got %d after %d calls", rr.Code, calls500.Load())
+	}
+}
+
+func TestGatewayRetryBudgetDeniesRetries(t *testing.T) {
+	var calls atomic.Int32
+	upstream := sequenceUpstream(t, &calls, 500, 500, 500, 500, 500, 500)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/budgeted",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      []map[string]interface{}{{"url": upstream.URL, "weight": 1}},
+			"retry": map[string]interface{}{
+				"enabled":      true,
+				"max_tries":    3,
+				"base_time_ms": 1,
+				// a single retry per 2s window, nothing proportional
+				"budget": map[string]interface{}{
+					"enabled":             true,
+					"percent":             0,
+					"min_retries_per_sec": 0.5,
+					"window_seconds":      2,
+				},
+			},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/budgeted"); rr.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: expected 502, got %d", i+1, rr.Code)
+		}
+	}
+
+	// first request: try + 1 budgeted retry; second request: no budget left
+	if hits := calls.Load(); hits != 3 {
+		t.Fatalf("expected retries to be capped by the budget (3 calls), got %d", hits)
+	}
+}
+
+func TestGatewayRetriesDontEarnUpstreamBudget(t *testing.T) {
+	var calls atomic.Int32
+	upstream := sequenceUpstream(t, &calls, 500, 500, 500, 500)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/budgeted",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{
+				{
+					"url":    upstream.URL,
+					"weight": 1,
+					// one retry per request, nothing per second
+					"retry_budget": map[string]interface{}{"enabled": true, "percent": 100, "window_seconds": 10},
+				},
+			},
+			"retry": map[string]interface{}{"enabled": true, "max_tries": 4, "base_time_ms": 1},
+		},
+	})
+
+	if rr := serveOnce(gw, http.MethodGet, "/budgeted"); rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rr.Code)
+	}
+	if hits := calls.Load(); hits != 2 {
+		t.Fatalf("expected the request to earn a single retry (2 calls), got %d", hits)
+	}
+}
+
+func TestGatewayHedgesSlowUpstream(t *testing.T) {
+	var slowCalls, fastCalls atomic.Int32
+	slow := slowUpstream(t, 2*time.Second, &slowCalls)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastCalls.Add(1)
+		w.Write([]byte("fast"))
+	}))
+	t.Cleanup(fast.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/hedged",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			// round robin sends the first request to the slow upstream
+			"upstreams": []map[string]interface{}{
+				{"url": slow.URL, "weight": 1},
+				{"url": fast.URL, "weight": 1},
+			},
+			"retry": map[string]interface{}{
+				"enabled":   true,
+				"max_tries": 1,
+				"hedge":     map[string]interface{}{"enabled": true, "delay_ms": 30},
+			},
+		},
+	})
+
+	start := time.Now()
+	rr := serveOnce(gw, http.MethodGet, "/hedged")
+	elapsed := time.Since(start)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "fast" {
+		t.Fatalf("expected hedged response from the fast upstream, got %d %q", rr.Code, rr.Body.String())
+	}
+	if elapsed > time.Second {
+		t.Fatalf("hedge did not cut latency, took %v", elapsed)
+	}
+	if slowCalls.Load() != 1 || fastCalls.Load() != 1 {
+		t.Fatalf("expected one request per upstream, got slow=%d fast=%d", slowCalls.Load(), fastCalls.Load())
+	}
+}
+
+func TestGatewayHedgeSpendsRetryBudget(t *testing.T) {
+	var slowCalls, fastCalls atomic.Int32
+	slow := slowUpstream(t, 200*time.Millisecond, &slowCalls)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastCalls.Add(1)
+		w.Write([]byte("fast"))
+	}))
+	t.Cleanup(fast.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/hedged",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{
+				{"url": slow.URL, "weight": 1},
+				{"url": fast.URL, "weight": 1},
+			},
+			"retry": map[string]interface{}{
+				"enabled":   true,
+				"max_tries": 1,
+				"hedge":     map[string]interface{}{"enabled": true, "delay_ms": 30},
+				"budget":    map[string]interface{}{"enabled": true, "percent": 0},
+			},
+		},
+	})
+
+	rr := serveOnce(gw, http.MethodGet, "/hedged")
+	if rr.Code != http.StatusOK || rr.Body.String() != "late" {
+		t.Fatalf("expected the primary's response, got %d %q", rr.Code, rr.Body.String())
+	}
+	if slowCalls.Load() != 1 || fastCalls.Load() != 0 {
+		t.Fatalf("expected no hedge without budget, got slow=%d fast=%d", slowCalls.Load(), fastCalls.Load())
+	}
+}
+
+func TestGatewayHedgeStreamsWinner(t *testing.T) {
+	release := make(chan struct{})
+	loserCancelled := make(chan struct{}, 2)
+	var slowCalls, streamCalls atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowCalls.Add(1)
+		select {
+		case <-r.Context().Done():
+			loserCancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamCalls.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	t.Cleanup(stream.Close)
+
+	routes := func(streaming bool) []map[string]interface{} {
+		return []map[string]interface{}{{
+			"path":           "/hedged",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"streaming":      streaming,
+			// round robin sends the first request to the slow upstream
+			"upstreams": []map[string]interface{}{
+				{"url": slow.URL, "weight": 1},
+				{"url": stream.URL, "weight": 1},
+			},
+			"retry": map[string]interface{}{
+				"enabled":   true,
+				"max_tries": 1,
+				"hedge":     map[string]interface{}{"enabled": true, "delay_ms": 30},
+			},
+		}}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(newTestGateway(t, routes(false)).Handler))
+	t.Cleanup(srv.Close)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/hedged", nil)
+	req.Header.Set("X-User-ID", "demo")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the winner's first chunk arrives while its upstream is still writing
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("expected the first chunk before the upstream finished, got %q, %v", line, err)
+	}
+	select {
+	case <-loserCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the losing request was not cancelled")
+	}
+	close(release)
+	if slowCalls.Load() != 1 || streamCalls.Load() != 1 {
+		t.Fatalf("expected one request per upstream, got slow=%d stream=%d", slowCalls.Load(), streamCalls.Load())
+	}
+
+	// streaming routes are never hedged
+	slowCalls.Store(0)
+	streamCalls.Store(0)
+	gw := newTestGateway(t, routes(true))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest(http.MethodGet, "/hedged", nil).WithContext(ctx)
+	req.Header.Set("X-User-ID", "demo")
+	gw.Handler(httptest.NewRecorder(), req)
+	if slowCalls.Load() != 1 || streamCalls.Load() != 0 {
+		t.Fatalf("expected no hedge on a streaming route, got slow=%d stream=%d", slowCalls.Load(), streamCalls.Load())
+	}
+}
+
+func TestGatewayHonorsRetryAfter(t *testing.T) {
+	route := func(url string) []map[string]interface{} {
+		return []map[string]interface{}{
+			{
+				"path":           "/busy",
+				"method":         "GET",
+				"load_balancing": "round_robin",
+				"upstreams":      []map[string]interface{}{{"url": url, "weight": 1}},
+				"retry": map[string]interface{}{
+					"enabled":        true,
+					"max_tries":      3,
+					"base_time_ms":   1,
+					"backoff":        "decorrelated_jitter",
+					"max_backoff_ms": 1500,
+				},
+			},
+		}
+	}
+	busy := func(retryAfter string, calls *atomic.Int32) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Set("Retry-After", retryAfter)
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	var calls atomic.Int32
+	gw := newTestGateway(t, route(busy("1", &calls).URL))
+	start := time.Now()
+	rr := serveOnce(gw, http.MethodGet, "/busy")
+	if rr.Code != http.StatusOK || calls.Load() != 2 {
+		t.Fatalf("expected retry after the 503: got %d after %d calls", rr.Code, calls.Load())
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("retried after %v, before Retry-After elapsed", waited)
+	}
+
+	// asking for longer than max_backoff_ms hands the 503 back to the client
+	var longCalls atomic.Int32
+	gw = newTestGateway(t, route(busy("120", &longCalls).URL))
+	rr = serveOnce(gw, http.MethodGet, "/busy")
+	if rr.Code != http.StatusServiceUnavailable || longCalls.Load() != 1 {
+		t.Fatalf("expected 503 without retry: got %d after %d calls", rr.Code, longCalls.Load())
+	}
+	if got := rr.Header().Get("Retry-After"); got != "120" {
+		t.Fatalf("expected Retry-After to be passed on, got %q", got)
+	}
+
+	// giving up early, for lack of time or retry budget, hands back the 503 too
+	var shortCalls atomic.Int32
+	short := route(busy("1", &shortCalls).URL)
+	short[0]["timeouts"] = map[string]interface{}{"total_ms": 300}
+	rr = serveOnce(newTestGateway(t, short), http.MethodGet, "/busy")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" || shortCalls.Load() != 1 {
+		t.Fatalf("deadline too short to wait: got %d, Retry-After %q after %d calls",
+			rr.Code, rr.Header().Get("Retry-After"), shortCalls.Load())
+	}
+
+	var deniedCalls atomic.Int32
+	denied := route(busy("1", &deniedCalls).URL)
+	denied[0]["retry"].(map[string]interface{})["budget"] = map[string]interface{}{"enabled": true, "percent": 0}
+	rr = serveOnce(newTestGateway(t, denied), http.MethodGet, "/busy")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" || deniedCalls.Load() != 1 {
+		t.Fatalf("retry budget spent: got %d, Retry-After %q after %d calls",
+			rr.Code, rr.Header().Get("Retry-After"), deniedCalls.Load())
+	}
+}
+
+func TestGatewayDistinguishesDialErrorFromUpstream502(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	var calls atomic.Int32
+	genuine := sequenceUpstream(t, &calls, 502)
+
+	route := func(path string, urls ...string) map[string]interface{} {
+		upstreams := []map[string]interface{}{}
+		for _, u := range urls {
+			upstreams = append(upstreams, map[string]interface{}{"url": u, "weight": 1})
+		}
+		return map[string]interface{}{
+			"path":           path,
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      upstreams,
+			"retry": map[string]interface{}{
+				"enabled":      true,
+				"max_tries":    2,
+				"base_time_ms": 1,
+				"retry_on":     []string{"connect_error"},
+			},
+		}
+	}
+	gw := newTestGateway(t, []map[string]interface{}{
+		route("/dead", deadURL),
+		route("/genuine", genuine.URL),
+	})
+
+	rr := serveOnce(gw, http.MethodGet, "/dead")
+	if rr.Code != http.StatusBadGateway || rr.Header().Get("X-Gateway-Error") != "dial" {
+		t.Fatalf("expected 502 with X-Gateway-Error: dial, got %d %q", rr.Code, rr.Header().Get("X-Gateway-Error"))
+	}
+
+	// the upstream's own 502 isn't a connect error: passed through, not retried
+	rr = serveOnce(gw, http.MethodGet, "/genuine")
+	if rr.Code != http.StatusBadGateway || calls.Load() != 1 {
+		t.Fatalf("expected upstream 502 passed through after 1 call, got %d after %d", rr.Code, calls.Load())
+	}
+	if got := rr.Header().Get("X-Gateway-Error"); got != "" {
+		t.Fatalf("upstream 502 must not carry X-Gateway-Error, got %q", got)
+	}
+}
+
+func TestGatewayLeastConnAvoidsBusyUpstream(t *testing.T) {
+	release := make(chan struct{})
+	var busyCalls, idleCalls atomic.Int32
+
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		busyCalls.Add(1)
+		<-release
+		w.Write([]byte("busy"))
+	}))
+	t.Cleanup(busy.Close)
+	t.Cleanup(func() { close(release) })
+	idle := sequenceUpstream(t, &idleCalls)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/lc",
+			"method":         "GET",
+			"load_balancing": "least_conn",
+			"upstreams": []map[string]interface{}{
+				{"url": busy.URL, "weight": 1},
+				{"url": idle.URL, "weight": 1},
+			},
+		},
+	})
+
+	// the first request ties and goes to the first upstream, where it hangs
+	go serveOnce(gw, http.MethodGet, "/lc")
+	deadline := time.Now().Add(2 * time.Second)
+	for busyCalls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first request never reached the busy upstream")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// finished requests must be released, or the idle upstream would catch up
+	for i := 0; i < 3; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/lc"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, rr.Code)
+		}
+	}
+	if idleCalls.Load() != 3 || busyCalls.Load() != 1 {
+		t.Fatalf("expected 3 requests on the idle upstream, got idle=%d busy=%d", idleCalls.Load(), busyCalls.Load())
+	}
+}
+
+func TestGatewayWeightedRoundRobinIsRegistered(t *testing.T) {
+	var a, b atomic.Int32
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/wrr",
+			"method":         "GET",
+			"load_balancing": "weighted_round_robin",
+			"upstreams": []map[string]interface{}{
+				{"url": sequenceUpstream(t, &a).URL, "weight": 3},
+				{"url": sequenceUpstream(t, &b).URL, "weight": 1},
+			},
+		},
+	})
+
+	for i := 0; i < 8; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/wrr"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, rr.Code)
+		}
+	}
+	if a.Load() != 6 || b.Load() != 2 {
+		t.Fatalf("expected a 3:1 split, got %d:%d", a.Load(), b.Load())
+	}
+}
+
+// namedUpstreams starts n upstreams that answer with their own name.
+func namedUpstreams(t *testing.T, n int) []map[string]interface{} {
+	t.Helper()
+
+	upstreams := []map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("u%d", i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(srv.Close)
+		upstreams = append(upstreams, map[string]interface{}{"url": srv.URL, "weight": 1})
+	}
+	return upstreams
+}
+
+func TestGatewayConsistentHashKeepsKeyOnOneUpstream(t *testing.T) {
+	for _, lb := range []string{"ring_hash", "maglev"} {
+		gw := newTestGateway(t, []map[string]interface{}{
+			{
+				"path":           "/carts/:id",
+				"method":         "GET",
+				"load_balancing": lb,
+				"hash_key":       "param:id",
+				"upstreams":      namedUpstreams(t, 4),
+			},
+		})
+
+		homes := map[string]bool{}
+		for cart := 0; cart < 20; cart++ {
+			path := fmt.Sprintf("/carts/%d", cart)
+			first := serveOnce(gw, http.MethodGet, path).Body.String()
+			for i := 0; i < 3; i++ {
+				if got := serveOnce(gw, http.MethodGet, path).Body.String(); got != first {
+					t.Fatalf("%s: %s moved from %s to %s", lb, path, first, got)
+				}
+			}
+			homes[first] = true
+		}
+		if len(homes) < 2 {
+			t.Fatalf("%s: 20 carts all hashed to %v", lb, homes)
+		}
+	}
+}
+
+func TestGatewayStickySessionCookie(t *testing.T) {
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/app",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      namedUpstreams(t, 3),
+			"sticky":         map[string]interface{}{"enabled": true, "cookie_name": "lb"},
+		},
+	})
+
+	rr := serveOnce(gw, http.MethodGet, "/app")
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "lb" {
+		t.Fatalf("expected a sticky cookie, got %v", rr.Header().Values("Set-Cookie"))
+	}
+	home := rr.Body.String()
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/app", nil)
+		req.Header.Set("X-User-ID", "demo")
+		req.AddCookie(cookies[0])
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+
+		if rr.Body.String() != home {
+			t.Fatalf("request %d went to %s instead of %s", i, rr.Body.String(), home)
+		}
+		if rr.Header().Get("Set-Cookie") != "" {
+			t.Fatalf("cookie reissued although it already pins %s", home)
+		}
+	}
+}
+
+func TestGatewayCountsPinnedRequestsInFlight(t *testing.T) {
+	// each upstream reports how many requests the route pools count on it
+	var pools []*loadbalancer.Pool
+	var ready atomic.Bool
+	var seen atomic.Int32
+	upstreams := []map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ready.Load() {
+				inFlight := 0
+				for _, p := range pools {
+					for _, m := range p.Members() {
+						if m.Server == "http://"+r.Host {
+							inFlight += m.InFlight
+						}
+					}
+				}
+				seen.Store(int32(inFlight))
+			}
+		}))
+		t.Cleanup(srv.Close)
+		upstreams = append(upstreams, map[string]interface{}{"url": srv.URL, "weight": 1})
+	}
+
+	store := configuration.NewGatewayConfigStore()
+	data, _ := json.Marshal([]map[string]interface{}{
+		{"path": "/sticky", "method": "GET", "load_balancing": "least_conn", "upstreams": upstreams,
+			"sticky": map[string]interface{}{"enabled": true, "cookie_name": "lb"}},
+		{"path": "/hashed", "method": "GET", "load_balancing": "ring_hash", "hash_key": "header:X-Cart",
+			"upstreams": upstreams},
+	})
+	if err := store.LoadConfig("demo", data); err != nil {
+		t.Fatal(err)
+	}
+	gw := NewGateway(store)
+	for _, path := range []string{"/sticky", "/hashed"} {
+		route, _ := store.Route("demo", http.MethodGet, path)
+		pool, _ := loadbalancer.As[*loadbalancer.Pool](route.LoadBalancer)
+		pools = append(pools, pool)
+	}
+	ready.Store(true)
+
+	cookies := serveOnce(gw, http.MethodGet, "/sticky").Result().Cookies()
+	for i := 0; i < 4; i++ {
+		path := []string{"/sticky", "/hashed"}[i%2]
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User-ID", "demo")
+		req.AddCookie(cookies[0])
+		req.Header.Set("X-Cart", fmt.Sprint(i))
+		seen.Store(-1)
+		gw.Handler(httptest.NewRecorder(), req)
+		if got := seen.Load(); got != 1 {
+			t.Fatalf("request %d to %s: upstream counted %d in flight, want 1", i, path, got)
+		}
+	}
+
+	for _, p := range pools {
+		for _, m := range p.Members() {
+			if m.InFlight != 0 {
+				t.Fatalf("in-flight count left behind: %+v", p.Members())
+			}
+		}
+	}
+}
+
+func TestGatewayP2CEWMAShedsSlowUpstream(t *testing.T) {
+	var fastCalls, slowCalls atomic.Int32
+	fast := sequenceUpstream(t, &fastCalls)
+	slow := slowUpstream(t, 150*time.Millisecond, &slowCalls)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/ewma",
+			"method":         "GET",
+			"load_balancing": "p2c_ewma",
+			"upstreams": []map[string]interface{}{
+				{"url": fast.URL, "weight": 1},
+				{"url": slow.URL, "weight": 1},
+			},
+		},
+	})
+
+	for i := 0; i < 30; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/ewma"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, rr.Code)
+		}
+	}
+	// round robin would send 15; once measured the slow upstream is avoided
+	if slowCalls.Load() > 1 {
+		t.Fatalf("slow upstream still got %d of 30 requests", slowCalls.Load())
+	}
+}
+
+func TestGatewaySkipsUpstreamFailingHealthCheck(t *testing.T) {
+	var sickCalls, wellCalls atomic.Int32
+	upstream := func(healthStatus int, calls *atomic.Int32) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.WriteHeader(healthStatus)
+				return
+			}
+			calls.Add(1)
+			w.Write([]byte("ok"))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	sick := upstream(http.StatusServiceUnavailable, &sickCalls)
+	well := upstream(http.StatusOK, &wellCalls)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/hc",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{
+				{"url": sick.URL, "weight": 1},
+				{"url": well.URL, "weight": 1},
+			},
+			"health_check": map[string]interface{}{
+				"enabled":             true,
+				"path":                "/health",
+				"interval_ms":         10,
+				"unhealthy_threshold": 1,
+			},
+		},
+	})
+
+	t.Cleanup(gw.Close)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for gw.Health.Healthy(sick.URL) {
+		if time.Now().After(deadline) {
+			t.Fatal("sick upstream never marked unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 6; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/hc"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, rr.Code)
+		}
+	}
+	if sickCalls.Load() != 0 || wellCalls.Load() != 6 {
+		t.Fatalf("expected all traffic on the healthy upstream, got sick=%d well=%d", sickCalls.Load(), wellCalls.Load())
+	}
+}
+
+func TestGatewayOutlierDetectionEjectsFailingUpstream(t *testing.T) {
+	var badCalls atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badCalls.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	t.Cleanup(bad.Close)
+
+	upstreams := append(namedUpstreams(t, 2), map[string]interface{}{"url": bad.URL, "weight": 1})
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/od",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      upstreams,
+			"outlier_detection": map[string]interface{}{
+				"enabled":         true,
+				"consecutive_5xx": 2,
+			},
+		},
+	})
+
+	failures := 0
+	for i := 0; i < 30; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/od"); rr.Code != http.StatusOK {
+			failures++
+		}
+	}
+	if badCalls.Load() != 2 || failures != 2 {
+		t.Fatalf("expected the failing upstream ejected after 2 errors, got %d calls / %d failures", badCalls.Load(), failures)
+	}
+}
+
+func TestGatewayServesWhenEveryUpstreamIsEjected(t *testing.T) {
+	for _, lb := range []string{"round_robin", "ring_hash"} {
+		var calls [2]atomic.Int32
+		upstreams := []map[string]interface{}{}
+		for i := range calls {
+			srv := sequenceUpstream(t, &calls[i], http.StatusInternalServerError)
+			upstreams = append(upstreams, map[string]interface{}{"url": srv.URL, "weight": 1})
+		}
+		gw := newTestGateway(t, []map[string]interface{}{
+			{
+				"path":           "/all-out",
+				"method":         "GET",
+				"load_balancing": lb,
+				"hash_key":       "header:X-Cart",
+				"upstreams":      upstreams,
+				"outlier_detection": map[string]interface{}{
+					"enabled":              true,
+					"consecutive_5xx":      1,
+					"max_ejection_percent": 100,
+				},
+			},
+		})
+
+		// each upstream fails once and is ejected
+		for i := 0; i < 2; i++ {
+			serveOnce(gw, http.MethodGet, "/all-out")
+		}
+		if calls[0].Load() != 1 || calls[1].Load() != 1 {
+			t.Fatalf("%s: expected both upstreams tried once, got %d and %d", lb, calls[0].Load(), calls[1].Load())
+		}
+
+		if rr := serveOnce(gw, http.MethodGet, "/all-out"); rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected an ejected upstream to serve, got %d", lb, rr.Code)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/all-out", nil)
+		req.Header.Set("X-User-ID", "demo")
+		req.Header.Set("X-Cart", "42")
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected a keyed request to reach an ejected upstream, got %d", lb, rr.Code)
+		}
+	}
+}
+
+func adminDo(t *testing.T, gw *Gateway, method, query string, body string) []loadbalancer.Member {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "/admin/upstreams"+query, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	gw.AdminHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("%s %s: %d %s", method, query, rr.Code, rr.Body.String())
+	}
+	var members []loadbalancer.Member
+	if err := json.Unmarshal(rr.Body.Bytes(), &members); err != nil {
+		t.Fatalf("decode members: %v", err)
+	}
+	return members
+}
+
+// testBreaker is a circuit breaker config that stays closed through the
+// tests it's used in.
+var testBreaker = map[string]interface{}{"enabled": true, "failure_threshold": 5, "window_seconds": 10, "open_seconds": 10}
+
+func TestGatewayAdminChangesUpstreamsAtRuntime(t *testing.T) {
+	upstreams := namedUpstreams(t, 2)
+	first, second := upstreams[0]["url"].(string), upstreams[1]["url"].(string)
+	upstreams[0]["circuit_breaker"] = testBreaker
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/dyn",
+			"method":         "GET",
+			"load_balancing": "weighted_round_robin",
+			"upstreams":      upstreams[:1],
+		},
+	})
+	route := "?user=demo&method=GET&path=/dyn"
+	dyn, _ := gw.Store.Route("demo", http.MethodGet, "/dyn")
+
+	seen := func(n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			counts[serveOnce(gw, http.MethodGet, "/dyn").Body.String()]++
+		}
+		return counts
+	}
+
+	members := adminDo(t, gw, http.MethodPost, route, fmt.Sprintf(`{"url": %q, "weight": 1, "circuit_breaker": {"enabled": true}}`, second))
+	if len(members) != 2 || gw.Breaker.Get(dyn, second) == nil {
+		t.Fatalf("added upstream not tracked: %+v", members)
+	}
+	if counts := seen(4); counts["u0"] != 2 || counts["u1"] != 2 {
+		t.Fatalf("added upstream should share traffic, got %v", counts)
+	}
+
+	adminDo(t, gw, http.MethodPut, "/weight"+route+"&weight=3&url="+second, "")
+	if counts := seen(8); counts["u1"] != 6 {
+		t.Fatalf("expected 3:1 after reweight, got %v", counts)
+	}
+
+	adminDo(t, gw, http.MethodPost, "/drain"+route+"&url="+first, "")
+	if counts := seen(4); counts["u1"] != 4 {
+		t.Fatalf("drained upstream still receiving traffic: %v", counts)
+	}
+
+	adminDo(t, gw, http.MethodDelete, route+"&url="+first, "")
+	if gw.Breaker.Get(dyn, first) != nil {
+		t.Fatal("breaker of removed upstream kept")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/upstreams?user=demo&method=GET&path=/missing", nil)
+	rr := httptest.NewRecorder()
+	gw.AdminHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown route, got %d", rr.Code)
+	}
+}
+
+func TestGatewayRemovedUpstreamFinishesInFlightRequest(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("busy"))
+	}))
+	t.Cleanup(busy.Close)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/drainme",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams":      append([]map[string]interface{}{{"url": busy.URL, "weight": 1, "circuit_breaker": testBreaker}}, namedUpstreams(t, 1)...),
+		},
+	})
+	route := "?user=demo&method=GET&path=/drainme"
+	drainme, _ := gw.Store.Route("demo", http.MethodGet, "/drainme")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serveOnce(gw, http.MethodGet, "/drainme") }()
+	<-started
+
+	members := adminDo(t, gw, http.MethodDelete, route+"&url="+busy.URL, "")
+	if len(members) != 2 || !members[0].Removed || members[0].InFlight != 1 {
+		t.Fatalf("removed upstream should wait for its request: %+v", members)
+	}
+	if gw.Breaker.Get(drainme, busy.URL) == nil {
+		t.Fatal("breaker dropped while a request is in flight")
+	}
+	if body := serveOnce(gw, http.MethodGet, "/drainme").Body.String(); body != "u0" {
+		t.Fatalf("new request went to the removed upstream: %q", body)
+	}
+
+	close(release)
+	if rr := <-done; rr.Code != http.StatusOK || rr.Body.String() != "busy" {
+		t.Fatalf("in-flight request cut short: %d %q", rr.Code, rr.Body.String())
+	}
+	if members := adminDo(t, gw, http.MethodGet, route, ""); len(members) != 1 {
+		t.Fatalf("removed upstream not forgotten: %+v", members)
+	}
+	if gw.Breaker.Get(drainme, busy.URL) != nil {
+		t.Fatal("breaker of removed upstream kept after its last request")
+	}
+}
+
+func TestGatewayRouteFollowsDiscoveredService(t *testing.T) {
+	upstreams := namedUpstreams(t, 2)
+	path := filepath.Join(t.TempDir(), "payments.json")
+	writeService := func(upstreams ...map[string]interface{}) {
+		data, _ := json.Marshal(upstreams)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeService(upstreams[0])
+
+	store := configuration.NewGatewayConfigStore()
+	services, _ := json.Marshal([]map[string]interface{}{
+		{"name": "payments", "type": "file", "path": path, "refresh_ms": 10, "upstream": map[string]interface{}{"circuit_breaker": testBreaker}},
+	})
+	if err := store.LoadServices(services); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := json.Marshal([]map[string]interface{}{
+		{"path": "/pay", "method": "GET", "load_balancing": "round_robin", "service": "payments"},
+	})
+	if err := store.LoadConfig("demo", routes); err != nil {
+		t.Fatal(err)
+	}
+	gw := NewGateway(store)
+	t.Cleanup(gw.Close)
+
+	pay, _ := store.Route("demo", http.MethodGet, "/pay")
+	if gw.Breaker.Get(pay, upstreams[0]["url"].(string)) == nil {
+		t.Fatal("discovered upstream got no breaker")
+	}
+
+	// the first resolve happens before the gateway serves
+	if body := serveOnce(gw, http.MethodGet, "/pay").Body.String(); body != "u0" {
+		t.Fatalf("expected the discovered upstream, got %q", body)
+	}
+
+	writeService(upstreams[1])
+	deadline := time.Now().Add(2 * time.Second)
+	for serveOnce(gw, http.MethodGet, "/pay").Body.String() != "u1" {
+		if time.Now().After(deadline) {
+			t.Fatal("membership change not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if gw.Breaker.Get(pay, upstreams[0]["url"].(string)) != nil {
+		t.Fatal("breaker of the upstream that left the service kept")
+	}
+}
+
+func TestGatewayBreakerScopes(t *testing.T) {
+	var calls atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+
+	routes := func(scope string, threshold int) []map[string]interface{} {
+		var out []map[string]interface{}
+		for _, path := range []string{"/a", "/b"} {
+			out = append(out, map[string]interface{}{
+				"path":           path,
+				"method":         "GET",
+				"load_balancing": "round_robin",
+				"breaker_scope":  scope,
+				"upstreams": []map[string]interface{}{{"url": failing.URL, "weight": 1, "circuit_breaker": map[string]interface{}{
+					"enabled": true, "failure_threshold": threshold, "window_seconds": 60, "open_seconds": 60,
+				}}},
+			})
+		}
+		return out
+	}
+
+	tests := []struct {
+		scope     string
+		threshold int // of /b; /a always trips on its first failure
+		bBlocked  bool
+	}{
+		{scope: "upstream", threshold: 5, bBlocked: true}, // /a's config wins, /b shares it
+		{scope: "route", threshold: 5, bBlocked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			rs := routes(tt.scope, 1)
+			rs[1]["upstreams"].([]map[string]interface{})[0]["circuit_breaker"].(map[string]interface{})["failure_threshold"] = tt.threshold
+			gw := newTestGateway(t, rs)
+			calls.Store(0)
+
+			serveOnce(gw, http.MethodGet, "/a")
+			if rr := serveOnce(gw, http.MethodGet, "/a"); rr.Code != http.StatusServiceUnavailable {
+				t.Fatalf("/a breaker should be open, got %d", rr.Code)
+			}
+			wantCode, wantCalls := http.StatusInternalServerError, int32(2)
+			if tt.bBlocked {
+				wantCode, wantCalls = http.StatusServiceUnavailable, 1
+			}
+			if rr := serveOnce(gw, http.MethodGet, "/b"); rr.Code != wantCode || calls.Load() != wantCalls {
+				t.Fatalf("/b: got %d after %d upstream calls, want %d after %d", rr.Code, calls.Load(), wantCode, wantCalls)
+			}
+		})
+	}
+}
+
+func TestGatewayTenantBreakerScope(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+
+	store := configuration.NewGatewayConfigStore()
+	for _, tenant := range []string{"t1", "t2"} {
+		routes, _ := json.Marshal([]map[string]interface{}{{
+			"path": "/shared", "method": "GET", "load_balancing": "round_robin", "breaker_scope": "tenant",
+			"upstreams": []map[string]interface{}{{"url": failing.URL, "weight": 1, "circuit_breaker": map[string]interface{}{
+				"enabled": true, "failure_threshold": 1, "window_seconds": 60, "open_seconds": 60,
+			}}},
+		}})
+		if err := store.LoadConfig(tenant, routes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gw := NewGateway(store)
+
+	serve := func(tenant string) int {
+		req := httptest.NewRequest(http.MethodGet, "/shared", nil)
+		req.Header.Set("X-User-ID", tenant)
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		return rr.Code
+	}
+	serve("t1")
+	if code := serve("t1"); code != http.StatusServiceUnavailable {
+		t.Fatalf("t1's breaker should be open, got %d", code)
+	}
+	if code := serve("t2"); code != http.StatusInternalServerError {
+		t.Fatalf("t2 should still reach the upstream, got %d", code)
+	}
+}
+
+func TestGatewaySlowCallsOpenBreaker(t *testing.T) {
+	var calls atomic.Int32
+	upstream := slowUpstream(t, 50*time.Millisecond, &calls)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{
+			"path":           "/sluggish",
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{{"url": upstream.URL, "weight": 1, "circuit_breaker": map[string]interface{}{
+				"enabled":                true,
+				"minimum_calls":          2,
+				"slow_call_rate_percent": 50,
+				"slow_call_ms":           20,
+				"open_seconds":           60,
+			}}},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		if rr := serveOnce(gw, http.MethodGet, "/sluggish"); rr.Code != http.StatusOK {
+			t.Fatalf("slow calls still succeed, got %d", rr.Code)
+		}
+	}
+	if rr := serveOnce(gw, http.MethodGet, "/sluggish"); rr.Code != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Fatalf("expected the breaker open after 2 slow calls, got %d after %d calls", rr.Code, calls.Load())
+	}
+}
+
+func TestGatewayAdminControlsBreakers(t *testing.T) {
+	upstreams := namedUpstreams(t, 1)
+	upstreams[0]["circuit_breaker"] = testBreaker
+	url := upstreams[0]["url"].(string)
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		{"path": "/cb", "method": "GET", "load_balancing": "round_robin", "upstreams": upstreams, "breaker_scope": "route"},
+	})
+	breaker := func(op string) circuitbreaker.Status {
+		req := httptest.NewRequest(http.MethodPost, "/admin/breakers/"+op+"?user=demo&method=GET&path=/cb&url="+url, nil)
+		rr := httptest.NewRecorder()
+		gw.AdminHandler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", op, rr.Code, rr.Body.String())
+		}
+		var status circuitbreaker.Status
+		json.Unmarshal(rr.Body.Bytes(), &status)
+		return status
+	}
+
+	if s := breaker("force_open"); s.State != circuitbreaker.StateOpen || !s.Forced || !strings.HasPrefix(s.Scope, "route ") {
+		t.Fatalf("force_open: %+v", s)
+	}
+	if rr := serveOnce(gw, http.MethodGet, "/cb"); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a forced-open breaker to block, got %d", rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	gw.AdminHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/breakers", nil))
+	if !strings.Contains(rr.Body.String(), `"state":"open","forced":true`) {
+		t.Fatalf("breaker list: %s", rr.Body.String())
+	}
+
+	if s := breaker("reset"); s.State != circuitbreaker.StateClosed || s.Forced {
+		t.Fatalf("reset: %+v", s)
+	}
+	if rr := serveOnce(gw, http.MethodGet, "/cb"); rr.Code != http.StatusOK {
+		t.Fatalf("expected traffic after reset, got %d", rr.Code)
+	}
+}
+
+func TestGatewayFallbacks(t *testing.T) {
+	var down atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("fresh"))
+	}))
+	defer primary.Close()
+	revalidated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, must-revalidate")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("fresh"))
+	}))
+	defer revalidated.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secondary"))
+	}))
+	defer secondary.Close()
+
+	bodyFile := filepath.Join(t.TempDir(), "maintenance.html")
+	os.WriteFile(bodyFile, []byte("<h1>back soon</h1>"), 0o644)
+
+	breaker := map[string]interface{}{"enabled": true, "failure_threshold": 1, "open_seconds": 60}
+	route := func(path string, fallback map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"path":           path,
+			"method":         "GET",
+			"load_balancing": "round_robin",
+			"breaker_scope":  "route",
+			"upstreams":      []map[string]interface{}{{"url": primary.URL, "weight": 1, "circuit_breaker": breaker}},
+			"cache":          map[string]interface{}{"enabled": true, "ttl_ms": 50, "max_entry": 10},
+			"fallback":       fallback,
+		}
+	}
+	// retried on failure, with no breaker to take the upstream out
+	retried := func(path string, fallback map[string]interface{}) map[string]interface{} {
+		r := route(path, fallback)
+		r["upstreams"] = []map[string]interface{}{{"url": primary.URL, "weight": 1}}
+		r["retry"] = map[string]interface{}{"enabled": true, "max_tries": 2, "retryable_status": []int{500}}
+		return r
+	}
+	mustRevalidate := route("/must-revalidate", map[string]interface{}{"stale_if_error": true})
+	mustRevalidate["upstreams"] = []map[string]interface{}{{"url": revalidated.URL, "weight": 1, "circuit_breaker": breaker}}
+
+	gw := newTestGateway(t, []map[string]interface{}{
+		route("/stale", map[string]interface{}{"stale_if_error": true}),
+		mustRevalidate,
+		retried("/retried-stale", map[string]interface{}{"stale_if_error": true}),
+		retried("/retried-none", nil),
+		route("/secondary", map[string]interface{}{"upstreams": []map[string]interface{}{{"url": secondary.URL, "weight": 1}}}),
+		route("/static", map[string]interface{}{
+			"status":    503,
+			"headers":   map[string]string{"Content-Type": "text/html", "Retry-After": "30"},
+			"body_file": bodyFile,
+		}),
+		route("/none", nil),
+	})
+
+	for _, path := range []string{"/stale", "/must-revalidate", "/retried-stale", "/secondary", "/static", "/none"} {
+		serveOnce(gw, http.MethodGet, path) // cached, and soon expired
+	}
+	time.Sleep(60 * time.Millisecond)
+	down.Store(true)
+	for _, path := range []string{"/stale", "/must-revalidate", "/secondary", "/static", "/none"} {
+		if rr := serveOnce(gw, http.MethodGet, path); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("%s: expected the failure to reach the client while the breaker is closed, got %d", path, rr.Code)
+		}
+	}
+
+	tests := []struct {
+		path, kind string
+		status     int
+		body       string
+	}{
+		{"/stale", "stale", http.StatusOK, "fresh"},
+		{"/must-revalidate", "", http.StatusServiceUnavailable, "no healthy upstreams (all failing health checks or circuits open)\n"},
+		{"/retried-stale", "stale", http.StatusOK, "fresh"},
+		{"/retried-none", "", http.StatusBadGateway, "Bad Gateway\n"},
+		{"/secondary", "upstream", http.StatusOK, "secondary"},
+		{"/static", "static", http.StatusServiceUnavailable, "<h1>back soon</h1>"},
+		{"/none", "", http.StatusServiceUnavailable, "no healthy upstreams (all failing health checks or circuits open)\n"},
+	}
+	for _, tt := range tests {
+		rr := serveOnce(gw, http.MethodGet, tt.path)
+		if rr.Code != tt.status || rr.Body.String() != tt.body || rr.Header().Get("X-Gateway-Fallback") != tt.kind {
+			t.Errorf("%s: got %d %q (fallback %q)", tt.path, rr.Code, rr.Body.String(), rr.Header().Get("X-Gateway-Fallback"))
+		}
+	}
+	if rr := serveOnce(gw, http.MethodGet, "/static"); rr.Header().Get("Retry-After") != "30" {
+		t.Errorf("static fallback headers not sent: %v", rr.Header())
+	}
+
+	// a fallback must not be cached in place of the upstream's response
+	secondaryRoute, _ := gw.Store.MatchPath("demo", "/secondary", http.MethodGet)
+	if entry, _ := secondaryRoute.CacheInstance.GetStale("GET:/secondary", 0); string(entry.Body) != "fresh" {
+		t.Fatalf("expected the cache to still hold the upstream's response, got %q", entry.Body)
+	}
+}
+
+// cachingUpstream answers each path with the response headers listed for it
+// in headers, echoing the request's Accept-Language and counting calls per
+// path.
+func cachingUpstream(t *testing.T, headers map[string]map[string]string, calls map[string]*atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path].Add(1)
+		for k, v := range headers[r.URL.Path] {
+			w.Header().Set(k, v)
+		}
+		w.Write([]byte("lang=" + r.Header.Get("Accept-Language")))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGatewayCacheFollowsHTTPSemantics(t *testing.T) {
+	headers := map[string]map[string]string{
+		"/no-store": {"Cache-Control": "no-store"},
+		"/private":  {"Cache-Control": "private, max-age=60"},
+		"/max-age":  {"Cache-Control": "max-age=60", "Age": "10"},
+		"/expired":  {"Cache-Control": "max-age=5", "Age": "10"},
+		"/vary":     {"Cache-Control": "max-age=60", "Vary": "Accept-Language"},
+		"/vary-all": {"Cache-Control": "max-age=60", "Vary": "*"},
+		"/cookie":   {"Set-Cookie": "session=abc"},
+		"/auth":     {"Cache-Control": "max-age=60"},
+		"/public":   {"Cache-Control": "public, max-age=60"},
+		"/no-cache": {"Cache-Control": "max-age=60"},
+	}
+	calls := map[string]*atomic.Int32{}
+	var routes []map[string]interface{}
+	for path := range headers {
+		calls[path] = new(atomic.Int32)
+		routes = append(routes, map[string]interface{}{"path": path, "method": "GET", "load_balancing": "round_robin"})
+	}
+	upstream := cachingUpstream(t, headers, calls)
+	for _, route := range routes {
+		route["upstreams"] = []map[string]interface{}{{"url": upstream.URL + route["path"].(string), "weight": 1}}
+		route["cache"] = map[string]interface{}{"enabled": true, "ttl_ms": 60000, "max_entry": 10}
+	}
+	gw := newTestGateway(t, routes)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User-ID", "demo")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		path  string
+		calls int32
+	}{
+		{"/no-store", 2},
+		{"/private", 2},
+		{"/max-age", 1},
+		{"/expired", 2},
+		{"/vary-all", 2},
+		{"/cookie", 2},
+	}
+	for _, tt := range tests {
+		get(tt.path)
+		get(tt.path)
+		if got := calls[tt.path].Load(); got != tt.calls {
+			t.Errorf("%s: %d upstream calls, want %d", tt.path, got, tt.calls)
+		}
+	}
+
+	// a hit reports its age, counting the age the upstream gave it
+	if age := get("/max-age").Header().Get("Age"); age != "10" {
+		t.Errorf("Age %q, want 10", age)
+	}
+
+	// each Accept-Language gets its own response
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		if body := get("/vary", "Accept-Language", lang).Body.String(); body != "lang="+lang {
+			t.Errorf("Accept-Language %s: got %q", lang, body)
+		}
+	}
+	if got := calls["/vary"].Load(); got != 2 {
+		t.Errorf("/vary: %d upstream calls, want one per language", got)
+	}
+
+	// authenticated responses are shared only if the upstream says so
+	get("/auth", "Authorization", "Bearer a")
+	get("/auth", "Authorization", "Bearer b")
+	get("/public", "Authorization", "Bearer a")
+	get("/public", "Authorization", "Bearer b")
+	if calls["/auth"].Load() != 2 || calls["/public"].Load() != 1 {
+		t.Errorf("authorized: /auth %d calls, /public %d calls", calls["/auth"].Load(), calls["/public"].Load())
+	}
+
+	// clients can insist on a fresh response, which then refreshes the cache
+	get("/no-cache")
+	get("/no-cache", "Cache-Control", "no-cache")
+	get("/no-cache")
+	if got := calls["/no-cache"].Load(); got != 2 {
+		t.Errorf("/no-cache: %d upstream calls, want 2", got)
+	}
+	// or one younger than they ask for
+	get("/max-age", "Cache-Control", "max-age=5")
+	if got := calls["/max-age"].Load(); got != 2 {
+		t.Errorf("/max-age: %d upstream calls, want a second one for a response older than max-age", got)
+	}
+}
+
+func TestGatewayCacheRevalidates(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	var version atomic.Value
+	version.Store("v1")
+	var full, notModified atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + version.Load().(string) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		switch r.URL.Path {
+		case "/always":
+			w.Header().Set("Cache-Control", "no-cache")
+		case "/expiring":
+			w.Header().Set("Cache-Control", "max-age=60")
+			if r.Header.Get("If-None-Match") == "" {
+				w.Header().Set("Age", "60") // stale on arrival
+			}
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Write([]byte(version.Load().(string)))
+	}))
+	defer upstream.Close()
+
+	var routes []map[string]interface{}
+	for _, path := range []string{"/always", "/expiring", "/fresh"} {
+		routes = append(routes, map[string]interface{}{
+			"path": path, "method": "GET", "load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{{"url": upstream.URL + path, "weight": 1}},
+			"cache":     map[string]interface{}{"enabled": true, "ttl_ms": 60000, "max_entry": 10},
+		})
+	}
+	gw := newTestGateway(t, routes)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User-ID", "demo")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		return rr
+	}
+	expect := func(rr *httptest.ResponseRecorder, status int, body string, fullCalls, notModifiedCalls int32) {
+		t.Helper()
+		if rr.Code != status || rr.Body.String() != body || full.Load() != fullCalls || notModified.Load() != notModifiedCalls {
+			t.Fatalf("got %d %q after %d full / %d not-modified upstream calls, want %d %q after %d / %d",
+				rr.Code, rr.Body.String(), full.Load(), notModified.Load(), status, body, fullCalls, notModifiedCalls)
+		}
+	}
+
+	// a fresh entry answers conditional requests itself
+	expect(get("/fresh"), http.StatusOK, "v1", 1, 0)
+	expect(get("/fresh", "If-None-Match", `W/"v0", "v1"`), http.StatusNotModified, "", 1, 0)
+	expect(get("/fresh", "If-Modified-Since", lastModified), http.StatusNotModified, "", 1, 0)
+	expect(get("/fresh", "If-None-Match", `"v0"`, "If-Modified-Since", lastModified), http.StatusOK, "v1", 1, 0)
+
+	// no-cache responses are revalidated on every use, and a 304 from the
+	// upstream serves the stored body
+	expect(get("/always"), http.StatusOK, "v1", 2, 0)
+	expect(get("/always"), http.StatusOK, "v1", 2, 1)
+	expect(get("/always", "If-None-Match", `"v1"`), http.StatusNotModified, "", 2, 2)
+	version.Store("v2")
+	expect(get("/always"), http.StatusOK, "v2", 3, 2)
+	expect(get("/always"), http.StatusOK, "v2", 3, 3)
+
+	// a 304 gives an expired entry a new lifetime
+	expect(get("/expiring"), http.StatusOK, "v2", 4, 3)
+	rr := get("/expiring")
+	expect(rr, http.StatusOK, "v2", 4, 4)
+	if rr.Header().Get("ETag") != `"v2"` || rr.Header().Get("Age") != "0" {
+		t.Fatalf("revalidated response headers %v", rr.Header())
+	}
+	expect(get("/expiring"), http.StatusOK, "v2", 4, 4)
+}
+
+func TestGatewayTrustsConfiguredProxies(t *testing.T) {
+	var forwarded atomic.Value
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.Header.Get("X-Forwarded-For"))
+	}))
+	defer echo.Close()
+
+	store := configuration.NewGatewayConfigStore()
+	if err := store.LoadSettings([]byte(`{"trusted_proxies": ["192.0.2.0/24"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal([]map[string]interface{}{
+		{"path": "/echo", "method": "GET", "load_balancing": "round_robin",
+			"upstreams": []map[string]interface{}{{"url": echo.URL, "weight": 1}}},
+		{"path": "/home", "method": "GET", "load_balancing": "ring_hash", "hash_key": "ip",
+			"upstreams": namedUpstreams(t, 4)},
+	})
+	if err := store.LoadConfig("demo", data); err != nil {
+		t.Fatal(err)
+	}
+	gw := NewGateway(store)
+	// a second gateway's settings don't leak into the first
+	NewGateway(configuration.NewGatewayConfigStore())
+
+	send := func(path, peer, client string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = peer + ":4000"
+		req.Header.Set("X-User-ID", "demo")
+		req.Header.Set("X-Forwarded-For", client)
+		rr := httptest.NewRecorder()
+		gw.Handler(rr, req)
+		return rr.Body.String()
+	}
+
+	send("/echo", "192.0.2.10", "203.0.113.7")
+	if got := forwarded.Load(); got != "203.0.113.7, 192.0.2.10" {
+		t.Fatalf("trusted proxy: upstream saw X-Forwarded-For %q", got)
+	}
+	send("/echo", "198.51.100.1", "203.0.113.7")
+	if got := forwarded.Load(); got != "198.51.100.1" {
+		t.Fatalf("untrusted peer: upstream saw X-Forwarded-For %q", got)
+	}
+
+	// clients behind the trusted proxy hash by their own address
+	trusted, untrusted := map[string]bool{}, map[string]bool{}
+	for i := 0; i < 20; i++ {
+		client := fmt.Sprintf("203.0.113.%d", i+1)
+		trusted[send("/home", "192.0.2.10", client)] = true
+		untrusted[send("/home", "198.51.100.1", client)] = true
+	}
+	if len(trusted) < 2 || len(untrusted) != 1 {
+		t.Fatalf("expected clients spread only behind the trusted proxy, got %v and %v", trusted, untrusted)
+	}
+}
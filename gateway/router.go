@@ -3,41 +3,103 @@ package gateway
 import (
 	"FluxGate/circuitbreaker"
 	"FluxGate/configuration"
+	"FluxGate/discovery"
+	"FluxGate/healthcheck"
+	"FluxGate/loadbalancer"
 	metrics "FluxGate/matrics"
 	"FluxGate/middleware"
 	"FluxGate/proxy"
+	"FluxGate/utils"
 	"context"
+	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
 type Gateway struct {
 	Store   *configuration.GatewayConfigStore
-	Breaker map[string]*circuitbreaker.CircuitBreaker
+	Breaker *circuitbreaker.Set
+	Health  *healthcheck.Monitor
+	// proxies whose forwarding headers are honoured, from the settings
+	TrustedProxies utils.TrustedProxies
+
+	watchers []*discovery.Watcher
 }
 
 func NewGateway(store *configuration.GatewayConfigStore) *Gateway {
-	Breaker := make(map[string]*circuitbreaker.CircuitBreaker)
-
-	// for each user and their routes build per-upstream circuit breakers
-	for _, routes := range store.Users {
-		for _, route := range routes {
-			servers := route.LoadBalancer.Servers()
-			for i, server := range servers {
-				if _, exists := Breaker[server]; !exists {
-					// find corresponding upstream config
-					var cfg configuration.CircuitBreakerConfig
-					if i < len(route.Upstreams) {
-						cfg = route.Upstreams[i].CircuitBreaker
-					}
-					// create circuit breaker using config
-					Breaker[server] = circuitbreaker.New(cfg)
+	g := &Gateway{Store: store, Breaker: circuitbreaker.NewSet(), Health: healthcheck.NewMonitor()}
+	trusted, err := utils.ParseTrustedProxies(store.Settings.TrustedProxies)
+	if err != nil {
+		log.Printf("ignoring settings: %v", err)
+	}
+	g.TrustedProxies = trusted
+	g.Breaker.OnStateChange(func(key circuitbreaker.Key, from, to circuitbreaker.State) {
+		log.Printf("circuit breaker %s: %s -> %s", key, from, to)
+		metrics.RecordBreakerTransition(to.String())
+	})
+	g.syncUpstreams()
+
+	// keep breakers and health checks in step with runtime membership changes
+	for _, route := range store.Routes() {
+		if pool, ok := loadbalancer.As[*loadbalancer.Pool](route.LoadBalancer); ok {
+			pool.OnChange(g.syncUpstreams)
+		}
+	}
+	g.watchServices()
+	return g
+}
+
+// syncUpstreams gives every configured upstream with an enabled breaker its
+// breaker, scoped as its route says, plus its active health check, and drops
+// those of upstreams that are gone. Removed upstreams still finishing
+// requests keep their breaker until they're done. A breaker shared by
+// several routes is built from the config of the first of them in
+// tenant/method/path order, ahead of the routes' fallback pools.
+func (g *Gateway) syncUpstreams() {
+	breakers := make(map[circuitbreaker.Key]configuration.CircuitBreakerConfig)
+	checks := make(map[string]configuration.HealthCheckConfig)
+
+	routes := g.Store.Routes()
+	slices.SortFunc(routes, func(a, b *configuration.RouteConfig) int { return strings.Compare(a.ID(), b.ID()) })
+	// fallback pools get breakers and health checks like their routes
+	for _, route := range routes {
+		if route.FallbackRoute != nil {
+			routes = append(routes, route.FallbackRoute)
+		}
+	}
+
+	for _, route := range routes {
+		for _, upstream := range route.UpstreamList() {
+			key := circuitbreaker.KeyFor(route, upstream.URL)
+			if _, exists := breakers[key]; !exists && upstream.CircuitBreaker.Enabled {
+				breakers[key] = upstream.CircuitBreaker
+			}
+			if cfg := route.HealthCheckFor(upstream); cfg.Enabled {
+				if _, exists := checks[upstream.URL]; !exists {
+					checks[upstream.URL] = cfg
 				}
 			}
 		}
+
+		members, err := route.Members()
+		if err != nil {
+			continue
+		}
+		for _, m := range members {
+			key := circuitbreaker.KeyFor(route, m.Server)
+			if _, exists := breakers[key]; exists || !m.Removed {
+				continue
+			}
+			if cfg, ok := g.Breaker.Config(key); ok {
+				breakers[key] = cfg
+			}
+		}
 	}
 
-	return &Gateway{Store: store, Breaker: Breaker}
+	g.Breaker.Sync(breakers)
+	g.Health.Sync(checks)
 }
 
 func (g *Gateway) Handler(w http.ResponseWriter, r *http.Request) {
@@ -55,8 +117,16 @@ func (g *Gateway) Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// put route into context
-	r = r.WithContext(context.WithValue(r.Context(), configuration.RouteCtxKey, route))
+	// put route and trusted proxies into context
+	ctx := context.WithValue(r.Context(), configuration.RouteCtxKey, route)
+	r = r.WithContext(context.WithValue(ctx, configuration.TrustedProxiesCtxKey, g.TrustedProxies))
+
+	// upgraded connections are long-lived and can't be replayed or cached,
+	// so they skip the middleware chain and latency metrics
+	if proxy.IsUpgradeRequest(r) {
+		g.serveUpgrade(w, r, route)
+		return
+	}
 
 	// build middleware chain
 	// Cache -> RateLimiter -> RetryHandler -> ProxyHandler
@@ -70,10 +140,21 @@ func (g *Gateway) Handler(w http.ResponseWriter, r *http.Request) {
 	metrics.RecordLatency(latencyMs)
 }
 
+func (g *Gateway) serveUpgrade(w http.ResponseWriter, r *http.Request, route *configuration.RouteConfig) {
+	upstream, gen, err := middleware.PickUpstream(r, route, g.Breaker, g.Health)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx := context.WithValue(r.Context(), configuration.UpstreamCtxKey, upstream)
+	r = r.WithContext(context.WithValue(ctx, configuration.BreakerGenerationCtxKey, gen))
+	proxy.UpgradeHandler(g.Breaker).ServeHTTP(w, r)
+}
+
 func (g *Gateway) wrapWithMiddlewares(final http.Handler) http.Handler {
 	h := final // final is ProxyHandler
 
-	h = middleware.RetryHandler(g.Breaker)(h)
+	h = middleware.RetryHandler(g.Breaker, g.Health)(h)
 	//h = middleware.RateLimiter(h)
 	h = middleware.CacheMiddleware(g.Store)(h)
 
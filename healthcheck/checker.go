@@ -0,0 +1,205 @@
+package healthcheck
+
+import (
+	"FluxGate/configuration"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultInterval           = 5 * time.Second
+	defaultTimeout            = 1 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+
+	// the body check only looks at the start of the response
+	maxBodyBytes = 64 * 1024
+)
+
+// Checker probes one upstream on an interval and flips its health after
+// enough consecutive passes or failures.
+type Checker struct {
+	target string
+	cfg    configuration.HealthCheckConfig
+
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	client  *http.Client
+	healthy atomic.Bool
+
+	// only touched by the probe loop
+	passes   int
+	failures int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a checker for target, healthy until proven otherwise. Call
+// Start to begin probing.
+func New(target string, cfg configuration.HealthCheckConfig) *Checker {
+	c := &Checker{
+		target:             target,
+		cfg:                cfg,
+		interval:           time.Duration(cfg.IntervalMs) * time.Millisecond,
+		timeout:            time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		healthyThreshold:   cfg.HealthyThreshold,
+		unhealthyThreshold: cfg.UnhealthyThreshold,
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	if c.interval <= 0 {
+		c.interval = defaultInterval
+	}
+	if c.timeout <= 0 {
+		c.timeout = defaultTimeout
+	}
+	if c.healthyThreshold <= 0 {
+		c.healthyThreshold = defaultHealthyThreshold
+	}
+	if c.unhealthyThreshold <= 0 {
+		c.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	c.client = &http.Client{
+		Transport: probeTransport(cfg.Protocol),
+		Timeout:   c.timeout,
+		// a redirect is an answer, don't probe somewhere else
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	c.healthy.Store(true)
+	return c
+}
+
+// probeTransport speaks the upstream's protocol (see
+// configuration.UpstreamConfig.Protocol), so an h2c-only upstream can be
+// probed.
+func probeTransport(protocol string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	switch protocol {
+	case "h2":
+		t.ForceAttemptHTTP2 = true
+	case "h2c":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return t
+}
+
+// Start runs the first probe straight away, then one every interval, until Stop.
+func (c *Checker) Start() {
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			c.record(c.probe())
+			select {
+			case <-ticker.C:
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends probing and waits for an in-flight probe to finish.
+func (c *Checker) Stop() {
+	close(c.stop)
+	<-c.done
+	c.client.CloseIdleConnections()
+}
+
+func (c *Checker) Healthy() bool {
+	return c.healthy.Load()
+}
+
+func (c *Checker) record(err error) {
+	if err == nil {
+		c.failures = 0
+		c.passes++
+		if !c.Healthy() && c.passes >= c.healthyThreshold {
+			c.healthy.Store(true)
+		}
+		return
+	}
+
+	c.passes = 0
+	c.failures++
+	if c.Healthy() && c.failures >= c.unhealthyThreshold {
+		c.healthy.Store(false)
+	}
+}
+
+func (c *Checker) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	u, err := url.Parse(c.target)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.Type == "tcp" {
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	u.Path = c.cfg.Path
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "FluxGate-HealthCheck")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if len(c.cfg.ExpectedStatus) > 0 {
+		if !slices.Contains(c.cfg.ExpectedStatus, resp.StatusCode) {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if c.cfg.ExpectedBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), c.cfg.ExpectedBody) {
+			return fmt.Errorf("body does not contain %q", c.cfg.ExpectedBody)
+		}
+	}
+	return nil
+}
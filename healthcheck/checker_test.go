@@ -0,0 +1,139 @@
+package healthcheck
+
+import (
+	"FluxGate/configuration"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCheckerProbesH2CUpstream(t *testing.T) {
+	var proto atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+	}))
+	// cleartext HTTP/2 only, as some gRPC services are
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	c := New(srv.URL, configuration.HealthCheckConfig{
+		Enabled:            true,
+		IntervalMs:         10,
+		UnhealthyThreshold: 1,
+		Protocol:           "h2c",
+	})
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "a probe", func() bool { return proto.Load() != nil })
+	time.Sleep(50 * time.Millisecond)
+	if !c.Healthy() || proto.Load() != "HTTP/2.0" {
+		t.Fatalf("h2c upstream: healthy %v, probed over %v", c.Healthy(), proto.Load())
+	}
+}
+
+func TestCheckerEjectsAndRecovers(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("status: ok"))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, configuration.HealthCheckConfig{
+		Enabled:            true,
+		Path:               "/healthz",
+		ExpectedBody:       "ok",
+		IntervalMs:         10,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	})
+	c.Start()
+	defer c.Stop()
+
+	if !c.Healthy() {
+		t.Fatal("checker should start healthy")
+	}
+
+	failing.Store(true)
+	waitFor(t, "ejection", func() bool { return !c.Healthy() })
+
+	failing.Store(false)
+	waitFor(t, "recovery", c.Healthy)
+}
+
+func TestCheckerMatchesStatusAndBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if err := New(srv.URL, configuration.HealthCheckConfig{}).probe(); err != nil {
+		t.Fatalf("204 should pass the default 2xx check: %v", err)
+	}
+	if err := New(srv.URL, configuration.HealthCheckConfig{ExpectedStatus: []int{200}}).probe(); err == nil {
+		t.Fatal("204 should fail expected_status [200]")
+	}
+	if err := New(srv.URL, configuration.HealthCheckConfig{ExpectedBody: "ok"}).probe(); err == nil {
+		t.Fatal("empty body should fail expected_body")
+	}
+}
+
+func TestCheckerTCPMode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "http://" + ln.Addr().String()
+
+	c := New(addr, configuration.HealthCheckConfig{Type: "tcp"})
+	if err := c.probe(); err != nil {
+		t.Fatalf("listening port should pass: %v", err)
+	}
+	ln.Close()
+	if err := c.probe(); err == nil {
+		t.Fatal("closed port should fail")
+	}
+}
+
+func TestMonitorSync(t *testing.T) {
+	m := NewMonitor()
+	defer m.Stop()
+
+	cfg := configuration.HealthCheckConfig{Enabled: true, Type: "tcp", IntervalMs: 10, UnhealthyThreshold: 1}
+	m.Sync(map[string]configuration.HealthCheckConfig{"http://127.0.0.1:1": cfg})
+	waitFor(t, "ejection", func() bool { return !m.Healthy("http://127.0.0.1:1") })
+
+	if !m.Healthy("http://unchecked") {
+		t.Fatal("upstreams without a check must count as healthy")
+	}
+
+	// dropping the check forgets the verdict
+	m.Sync(nil)
+	if !m.Healthy("http://127.0.0.1:1") {
+		t.Fatal("removed check still reports unhealthy")
+	}
+}
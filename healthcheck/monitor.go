@@ -0,0 +1,64 @@
+package healthcheck
+
+import (
+	"FluxGate/configuration"
+	"reflect"
+	"sync"
+)
+
+// Monitor owns the checkers of every actively checked upstream, keyed by URL.
+type Monitor struct {
+	mu       sync.RWMutex
+	checkers map[string]*Checker
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{checkers: make(map[string]*Checker)}
+}
+
+// Sync makes the running checks match targets: new upstreams start being
+// probed, removed ones stop, and ones whose config changed start over.
+// Unchanged checks keep their state.
+func (m *Monitor) Sync(targets map[string]configuration.HealthCheckConfig) {
+	var stale []*Checker
+
+	m.mu.Lock()
+	for target, c := range m.checkers {
+		if cfg, ok := targets[target]; !ok || !reflect.DeepEqual(cfg, c.cfg) {
+			stale = append(stale, c)
+			delete(m.checkers, target)
+		}
+	}
+	for target, cfg := range targets {
+		if _, ok := m.checkers[target]; ok {
+			continue
+		}
+		c := New(target, cfg)
+		c.Start()
+		m.checkers[target] = c
+	}
+	m.mu.Unlock()
+
+	// outside the lock, Stop waits for a probe that may be in flight
+	for _, c := range stale {
+		c.Stop()
+	}
+}
+
+// Healthy reports whether target passed its last checks. Upstreams without
+// an active check, or checked by no monitor (m is nil), are always healthy.
+func (m *Monitor) Healthy(target string) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.RLock()
+	c, ok := m.checkers[target]
+	m.mu.RUnlock()
+
+	return !ok || c.Healthy()
+}
+
+// Stop ends every check.
+func (m *Monitor) Stop() {
+	m.Sync(nil)
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import "sync"
+
+// ConnTracker counts what each server currently has open: requests in
+// flight for a balancer, or upgraded connections for ActiveConns.
+type ConnTracker struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// ActiveConns counts the upgraded (WebSocket etc.) connections open to each
+// upstream URL, across every route. least_conn and least_request add them to
+// a server's load, as they keep it busy long after their request ended.
+var ActiveConns = NewConnTracker()
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{active: make(map[string]int)}
+}
+
+func (t *ConnTracker) Acquire(server string) {
+	t.mu.Lock()
+	t.active[server]++
+	t.mu.Unlock()
+}
+
+func (t *ConnTracker) Release(server string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active[server]--
+	if t.active[server] <= 0 {
+		delete(t.active, server)
+	}
+}
+
+func (t *ConnTracker) Count(server string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.active[server]
+}
+
+// load is what a connection-aware balancer weighs server by: its requests in
+// flight on t plus its open upgraded connections.
+func load(t *ConnTracker, server string) int {
+	return t.Count(server) + ActiveConns.Count(server)
+}
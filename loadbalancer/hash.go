@@ -0,0 +1,38 @@
+package loadbalancer
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// KeyedBalancer is implemented by consistent-hash balancers, which map a
+// request key to the same server for as long as that server is in the pool.
+type KeyedBalancer interface {
+	LoadBalancer
+
+	// Lookup returns up to n distinct servers for key in order of
+	// preference: the key's home first, then where it goes if the home is
+	// unavailable.
+	Lookup(key string, n int) []string
+}
+
+// hashKey is 64-bit FNV-1a with a splitmix64 finalizer; FNV alone spreads
+// near-identical inputs ("host#1", "host#2"...) poorly around a ring.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ServerID is a short, stable identifier for a server that can be handed
+// to clients (e.g. in a sticky-session cookie) without exposing its URL.
+func ServerID(server string) string {
+	return strconv.FormatUint(hashKey(server), 36)
+}
@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keyedBalancers(servers []string) map[string]KeyedBalancer {
+	return map[string]KeyedBalancer{
+		"ring_hash": NewRingHash(servers, nil),
+		"maglev":    NewMaglev(servers, nil),
+	}
+}
+
+func TestKeyedBalancersAreStableAndSpread(t *testing.T) {
+	servers := []string{"s1", "s2", "s3", "s4", "s5"}
+
+	for name, kb := range keyedBalancers(servers) {
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			home := kb.Lookup(key, 1)[0]
+			if again := kb.Lookup(key, 1)[0]; again != home {
+				t.Fatalf("%s: %s moved from %s to %s", name, key, home, again)
+			}
+			counts[home]++
+		}
+		for _, s := range servers {
+			if counts[s] < 1000 || counts[s] > 3000 {
+				t.Fatalf("%s: uneven spread %v", name, counts)
+			}
+		}
+	}
+}
+
+func TestKeyedBalancersRemapMinimally(t *testing.T) {
+	before := keyedBalancers([]string{"s1", "s2", "s3", "s4", "s5"})
+	after := keyedBalancers([]string{"s1", "s2", "s3", "s4"})
+
+	for name := range before {
+		stayed, total := 0, 0
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			home := before[name].Lookup(key, 1)[0]
+			if home == "s5" {
+				continue
+			}
+			total++
+			if after[name].Lookup(key, 1)[0] == home {
+				stayed++
+			}
+		}
+		// a ring moves none of them, Maglev only a few
+		if float64(stayed) < 0.9*float64(total) {
+			t.Fatalf("%s: only %d of %d keys kept their server", name, stayed, total)
+		}
+	}
+}
+
+func TestKeyedLookupReturnsDistinctFallbacks(t *testing.T) {
+	servers := []string{"s1", "s2", "s3"}
+	for name, kb := range keyedBalancers(servers) {
+		got := kb.Lookup("cart-42", 5)
+		if len(got) != 3 {
+			t.Fatalf("%s: expected every server once, got %v", name, got)
+		}
+		seen := map[string]bool{}
+		for _, s := range got {
+			if seen[s] {
+				t.Fatalf("%s: duplicate %s in %v", name, s, got)
+			}
+			seen[s] = true
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// LeastConn sends each request to the server with the fewest requests in
+// flight and upgraded connections open relative to its weight. Ties go round
+// robin so an idle pool is still spread evenly.
+type LeastConn struct {
+	servers  []string
+	weights  []int
+	inflight *ConnTracker
+	next     int
+	mu       sync.Mutex
+}
+
+func init() {
+	RegistrLoadBalancer("least_conn", func(servers []string, weights []int) LoadBalancer {
+		return NewLeastConn(servers, weights)
+	})
+}
+
+func NewLeastConn(servers []string, weights []int) *LeastConn {
+	return &LeastConn{
+		servers:  servers,
+		weights:  normalizeWeights(servers, weights),
+		inflight: NewConnTracker(),
+	}
+}
+
+func (lc *LeastConn) NextServer() (string, error) {
+	if len(lc.servers) == 0 {
+		return "", fmt.Errorf("no servers available")
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	best := -1
+	for n := 0; n < len(lc.servers); n++ {
+		i := (lc.next + n) % len(lc.servers)
+		if best < 0 || lc.less(i, best) {
+			best = i
+		}
+	}
+	lc.next = (best + 1) % len(lc.servers)
+
+	server := lc.servers[best]
+	lc.inflight.Acquire(server)
+	return server, nil
+}
+
+// less compares load/weight of servers i and j without dividing.
+func (lc *LeastConn) less(i, j int) bool {
+	return load(lc.inflight, lc.servers[i])*lc.weights[j] < load(lc.inflight, lc.servers[j])*lc.weights[i]
+}
+
+func (lc *LeastConn) Servers() []string {
+	return lc.servers
+}
+
+func (lc *LeastConn) Acquire(server string) {
+	lc.inflight.Acquire(server)
+}
+
+func (lc *LeastConn) Done(server string) {
+	lc.inflight.Release(server)
+}
+
+// normalizeWeights returns one weight per server, defaulting missing or
+// non-positive weights to 1.
+func normalizeWeights(servers []string, weights []int) []int {
+	out := make([]int, len(servers))
+	for i := range servers {
+		out[i] = 1
+		if i < len(weights) && weights[i] > 0 {
+			out[i] = weights[i]
+		}
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package loadbalancer
+
+import "testing"
+
+func TestLeastConnPrefersFewestInFlight(t *testing.T) {
+	lc := NewLeastConn([]string{"s1", "s2", "s3"}, nil)
+
+	first, _ := lc.NextServer()
+	second, _ := lc.NextServer()
+	third, _ := lc.NextServer()
+	if first == second || second == third || first == third {
+		t.Fatalf("expected an idle pool to be spread, got %s %s %s", first, second, third)
+	}
+
+	lc.Done(second)
+	if s, _ := lc.NextServer(); s != second {
+		t.Fatalf("expected the released server %s, got %s", second, s)
+	}
+}
+
+func TestLeastConnHonoursWeights(t *testing.T) {
+	lc := NewLeastConn([]string{"big", "small"}, []int{3, 1})
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		s, _ := lc.NextServer()
+		counts[s]++
+	}
+	if counts["big"] != 6 || counts["small"] != 2 {
+		t.Fatalf("expected in-flight split 6:2, got %v", counts)
+	}
+}
+
+func TestLeastRequestPicksLessLoaded(t *testing.T) {
+	lr := NewLeastRequest([]string{"s1", "s2"}, nil)
+
+	// s1 has outstanding requests, so every pick of two must land on s2
+	lr.outstanding.Acquire("s1")
+	lr.outstanding.Acquire("s1")
+	for i := 0; i < 20; i++ {
+		s, _ := lr.NextServer()
+		if s != "s2" {
+			t.Fatalf("pick %d: got %s", i, s)
+		}
+		lr.Done(s)
+	}
+}
+
+func TestConnectionAwareBalancersCountUpgradedConnections(t *testing.T) {
+	ActiveConns.Acquire("ws-busy")
+	defer ActiveConns.Release("ws-busy")
+
+	lc := NewLeastConn([]string{"ws-busy", "ws-idle"}, nil)
+	lr := NewLeastRequest([]string{"ws-busy", "ws-idle"}, nil)
+	for i := 0; i < 10; i++ {
+		if s, _ := lc.NextServer(); s != "ws-idle" {
+			t.Fatalf("least_conn pick %d: got %s", i, s)
+		}
+		lc.Done("ws-idle")
+		if s, _ := lr.NextServer(); s != "ws-idle" {
+			t.Fatalf("least_request pick %d: got %s", i, s)
+		}
+		lr.Done("ws-idle")
+	}
+}
@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// LeastRequest picks two servers at random and sends the request to the one
+// with fewer outstanding requests and upgraded connections relative to its
+// weight ("power of two choices"). It avoids the herding a full scan causes
+// when many gateways see the same idle server, at O(1) per pick.
+type LeastRequest struct {
+	servers     []string
+	weights     []int
+	outstanding *ConnTracker
+}
+
+func init() {
+	RegistrLoadBalancer("least_request", func(servers []string, weights []int) LoadBalancer {
+		return NewLeastRequest(servers, weights)
+	})
+}
+
+func NewLeastRequest(servers []string, weights []int) *LeastRequest {
+	return &LeastRequest{
+		servers:     servers,
+		weights:     normalizeWeights(servers, weights),
+		outstanding: NewConnTracker(),
+	}
+}
+
+func (lr *LeastRequest) NextServer() (string, error) {
+	n := len(lr.servers)
+	if n == 0 {
+		return "", fmt.Errorf("no servers available")
+	}
+
+	pick := rand.Intn(n)
+	if n > 1 {
+		other := rand.Intn(n - 1)
+		if other >= pick {
+			other++
+		}
+		a, b := lr.servers[pick], lr.servers[other]
+		if load(lr.outstanding, b)*lr.weights[pick] < load(lr.outstanding, a)*lr.weights[other] {
+			pick = other
+		}
+	}
+
+	server := lr.servers[pick]
+	lr.outstanding.Acquire(server)
+	return server, nil
+}
+
+func (lr *LeastRequest) Servers() []string {
+	return lr.servers
+}
+
+func (lr *LeastRequest) Acquire(server string) {
+	lr.outstanding.Acquire(server)
+}
+
+func (lr *LeastRequest) Done(server string) {
+	lr.outstanding.Release(server)
+}
@@ -3,4 +3,67 @@ package loadbalancer
 type LoadBalancer interface {
 	NextServer() (string, error)
 	Servers() []string
+
+	// Done is called once for every server NextServer returned or Acquire
+	// counted, when the request sent there finishes or the server is passed
+	// over.
+	Done(server string)
+}
+
+// Acquirer is implemented by balancers that track requests in flight, so a
+// server picked without NextServer (a sticky session, a hash key lookup) is
+// counted until its Done like one they handed out.
+type Acquirer interface {
+	Acquire(server string)
+}
+
+// Acquire counts server as handed out by lb, if lb keeps count.
+func Acquire(lb LoadBalancer, server string) {
+	if a, ok := lb.(Acquirer); ok {
+		a.Acquire(server)
+	}
+}
+
+// Inheritor is implemented by balancers with per-server state worth keeping
+// when a Pool rebuilds them (e.g. latency averages): Inherit copies what prev
+// knew about the servers both balance over. Requests in flight are not
+// inherited; the Pool counts them again.
+type Inheritor interface {
+	Inherit(prev LoadBalancer)
+}
+
+// Wrapper is implemented by balancers that decorate another one (e.g. to hide
+// ejected servers).
+type Wrapper interface {
+	Unwrap() LoadBalancer
+}
+
+// AllServers lists the servers of the balancer at the bottom of lb's wrapper
+// chain, including any a wrapper hides from lb.Servers() (e.g. ejected ones).
+func AllServers(lb LoadBalancer) []string {
+	for {
+		w, ok := lb.(Wrapper)
+		if !ok {
+			return lb.Servers()
+		}
+		lb = w.Unwrap()
+	}
+}
+
+// As finds the first balancer in lb's wrapper chain that implements T, the
+// way errors.As walks wrapped errors. Use it to reach optional interfaces
+// such as KeyedBalancer or LatencyObserver.
+func As[T any](lb LoadBalancer) (T, bool) {
+	for lb != nil {
+		if t, ok := lb.(T); ok {
+			return t, true
+		}
+		w, ok := lb.(Wrapper)
+		if !ok {
+			break
+		}
+		lb = w.Unwrap()
+	}
+	var zero T
+	return zero, false
 }
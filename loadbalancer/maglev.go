@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// prime, so every skip value walks the whole table
+const maglevTableSize = 65537
+
+// Maglev is Google's consistent hashing scheme (NSDI '16): each server fills
+// a fixed-size lookup table following its own permutation, which gives an
+// even spread and O(1) lookups, at the cost of slightly more remapping than
+// a ring when the pool changes.
+type Maglev struct {
+	servers []string
+	table   []int32 // slot -> index into servers
+	indx    uint64
+}
+
+func init() {
+	RegistrLoadBalancer("maglev", func(servers []string, weights []int) LoadBalancer {
+		return NewMaglev(servers, weights)
+	})
+}
+
+func NewMaglev(servers []string, weights []int) *Maglev {
+	m := &Maglev{servers: servers}
+	if len(servers) == 0 {
+		return m
+	}
+	weights = normalizeWeights(servers, weights)
+
+	offset := make([]uint64, len(servers))
+	skip := make([]uint64, len(servers))
+	next := make([]uint64, len(servers))
+	for i, server := range servers {
+		offset[i] = hashKey(server) % maglevTableSize
+		skip[i] = hashKey(server+"#skip")%(maglevTableSize-1) + 1
+	}
+
+	m.table = make([]int32, maglevTableSize)
+	for i := range m.table {
+		m.table[i] = -1
+	}
+
+	// servers take turns claiming their next free preferred slot; a server
+	// of weight w claims w slots per turn
+	filled := 0
+	for filled < maglevTableSize {
+		for i := range servers {
+			for w := 0; w < weights[i] && filled < maglevTableSize; w++ {
+				for {
+					slot := (offset[i] + next[i]*skip[i]) % maglevTableSize
+					next[i]++
+					if m.table[slot] < 0 {
+						m.table[slot] = int32(i)
+						filled++
+						break
+					}
+				}
+			}
+		}
+	}
+	return m
+}
+
+// NextServer is used for requests without a key and goes round robin.
+func (m *Maglev) NextServer() (string, error) {
+	if len(m.servers) == 0 {
+		return "", fmt.Errorf("no servers available")
+	}
+	i := atomic.AddUint64(&m.indx, 1)
+	return m.servers[(i-1)%uint64(len(m.servers))], nil
+}
+
+// Lookup returns the key's slot owner, then the owners of the following
+// slots as fallbacks.
+func (m *Maglev) Lookup(key string, n int) []string {
+	if len(m.table) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(m.servers))
+
+	start := hashKey(key) % maglevTableSize
+	out := make([]string, 0, n)
+	seen := make([]bool, len(m.servers))
+	for i := uint64(0); i < maglevTableSize && len(out) < n; i++ {
+		s := m.table[(start+i)%maglevTableSize]
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, m.servers[s])
+		}
+	}
+	return out
+}
+
+func (m *Maglev) Servers() []string {
+	return m.servers
+}
+
+func (m *Maglev) Done(server string) {}
@@ -0,0 +1,175 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LatencyObserver is implemented by balancers that want the latency of
+// every finished request.
+type LatencyObserver interface {
+	Observe(server string, rtt time.Duration)
+}
+
+const (
+	// how quickly old latencies are forgotten
+	ewmaDecay = 10 * time.Second
+	// assumed latency of a server no response has come back from yet
+	ewmaInitialCost = 30 * time.Millisecond
+)
+
+// P2CEWMA picks two servers at random and sends the request to the one with
+// the lower peak-EWMA latency times its in-flight requests (+1). The EWMA
+// jumps straight up to any slower sample and decays back down over time, so a
+// server that turns slow sheds load at once and is tried again once it idles.
+type P2CEWMA struct {
+	servers []string
+	stats   []ewmaStat
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+type ewmaStat struct {
+	cost     float64 // ns
+	stamp    time.Time
+	inflight int
+	observed bool // cost is still ewmaInitialCost until the first sample
+}
+
+func init() {
+	RegistrLoadBalancer("p2c_ewma", func(servers []string, weights []int) LoadBalancer {
+		return NewP2CEWMA(servers)
+	})
+}
+
+func NewP2CEWMA(servers []string) *P2CEWMA {
+	lb := &P2CEWMA{
+		servers: servers,
+		stats:   make([]ewmaStat, len(servers)),
+		now:     time.Now,
+	}
+	start := lb.now()
+	for i := range lb.stats {
+		lb.stats[i] = ewmaStat{cost: float64(ewmaInitialCost), stamp: start}
+	}
+	return lb
+}
+
+func (lb *P2CEWMA) NextServer() (string, error) {
+	n := len(lb.servers)
+	if n == 0 {
+		return "", fmt.Errorf("no servers available")
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	pick := rand.Intn(n)
+	if n > 1 {
+		other := rand.Intn(n - 1)
+		if other >= pick {
+			other++
+		}
+		now := lb.now()
+		if lb.load(other, now) < lb.load(pick, now) {
+			pick = other
+		}
+	}
+
+	lb.stats[pick].inflight++
+	return lb.servers[pick], nil
+}
+
+// load is the server's decayed cost scaled by the requests already waiting on it.
+func (lb *P2CEWMA) load(i int, now time.Time) float64 {
+	s := &lb.stats[i]
+	// decay towards zero while idle, so a once-slow server gets probed again
+	cost := s.cost * decayWeight(now.Sub(s.stamp))
+	return cost * float64(s.inflight+1)
+}
+
+func (lb *P2CEWMA) Observe(server string, rtt time.Duration) {
+	i := lb.index(server)
+	if i < 0 {
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	s := &lb.stats[i]
+	now := lb.now()
+	sample := float64(rtt)
+	if !s.observed || sample > s.cost {
+		s.cost = sample
+		s.observed = true
+	} else {
+		w := decayWeight(now.Sub(s.stamp))
+		s.cost = s.cost*w + sample*(1-w)
+	}
+	s.stamp = now
+}
+
+// Inherit carries over the latency prev measured for the servers both
+// balance over, so a membership change doesn't make them look new.
+func (lb *P2CEWMA) Inherit(prev LoadBalancer) {
+	old, ok := prev.(*P2CEWMA)
+	if !ok {
+		return
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for i, server := range lb.servers {
+		if j := old.index(server); j >= 0 {
+			lb.stats[i] = old.stats[j]
+			lb.stats[i].inflight = 0
+		}
+	}
+}
+
+func (lb *P2CEWMA) Servers() []string {
+	return lb.servers
+}
+
+func (lb *P2CEWMA) Acquire(server string) {
+	i := lb.index(server)
+	if i < 0 {
+		return
+	}
+	lb.mu.Lock()
+	lb.stats[i].inflight++
+	lb.mu.Unlock()
+}
+
+func (lb *P2CEWMA) Done(server string) {
+	i := lb.index(server)
+	if i < 0 {
+		return
+	}
+	lb.mu.Lock()
+	if lb.stats[i].inflight > 0 {
+		lb.stats[i].inflight--
+	}
+	lb.mu.Unlock()
+}
+
+func (lb *P2CEWMA) index(server string) int {
+	for i, s := range lb.servers {
+		if s == server {
+			return i
+		}
+	}
+	return -1
+}
+
+// decayWeight is the share of the old average kept after elapsed.
+func decayWeight(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 1
+	}
+	return math.Exp(-float64(elapsed) / float64(ewmaDecay))
+}
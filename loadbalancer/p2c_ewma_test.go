@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestP2CEWMAAvoidsSlowServer(t *testing.T) {
+	lb := NewP2CEWMA([]string{"fast", "slow"})
+	lb.Observe("fast", 5*time.Millisecond)
+	lb.Observe("slow", 800*time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		s, _ := lb.NextServer()
+		if s != "fast" {
+			t.Fatalf("pick %d went to %s", i, s)
+		}
+		lb.Done(s)
+	}
+}
+
+func TestP2CEWMAWeighsInFlightRequests(t *testing.T) {
+	lb := NewP2CEWMA([]string{"a", "b"})
+	lb.Observe("a", 10*time.Millisecond)
+	lb.Observe("b", 20*time.Millisecond)
+
+	// a is cheaper per request, but with 2 already waiting on it b wins
+	lb.NextServer()
+	lb.NextServer()
+	if s, _ := lb.NextServer(); s != "b" {
+		t.Fatalf("expected b once a is loaded, got %s", s)
+	}
+}
+
+func TestP2CEWMACostDecaysWhileIdle(t *testing.T) {
+	now := time.Now()
+	lb := NewP2CEWMA([]string{"fast", "slow"})
+	lb.now = func() time.Time { return now }
+
+	lb.Observe("slow", 800*time.Millisecond)
+	lb.Observe("fast", 5*time.Millisecond)
+
+	// a slower sample takes effect at once
+	lb.Observe("fast", 900*time.Millisecond)
+	if s, _ := lb.NextServer(); s != "slow" {
+		t.Fatalf("expected peak sample to push traffic to slow, got %s", s)
+	}
+	lb.Done("slow")
+
+	// a minute later, with no new samples, both have decayed towards zero
+	now = now.Add(time.Minute)
+	if l := lb.load(0, now); l > float64(5*time.Millisecond) {
+		t.Fatalf("cost did not decay: %v", time.Duration(l))
+	}
+}
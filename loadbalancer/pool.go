@@ -0,0 +1,286 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Member describes one upstream of a Pool.
+type Member struct {
+	Server   string `json:"url"`
+	Weight   int    `json:"weight"`
+	Draining bool   `json:"draining"` // gets no new requests but stays a member
+	Removed  bool   `json:"removed"`  // gone, waiting for its in-flight requests
+	InFlight int    `json:"in_flight"`
+}
+
+// Pool makes a balancer's membership changeable at runtime. Every change
+// rebuilds the wrapped balancer, with the registered constructor, from the
+// members still taking requests; consistent-hash balancers therefore only
+// move the keys of the servers that changed, and an Inheritor keeps what it
+// learned about the servers that stayed. Requests already sent to a
+// server finish normally, and a removed server is forgotten once its last
+// one does.
+type Pool struct {
+	kind string
+
+	mu       sync.RWMutex
+	members  []*Member
+	inner    LoadBalancer
+	inflight *ConnTracker
+	onChange []func()
+	batches  int  // Batch calls running
+	pending  bool // a change happened during them
+}
+
+// NewPool returns a pool of the registered balancer kind, or nil if the kind
+// is unknown.
+func NewPool(kind string, servers []string, weights []int) *Pool {
+	f, ok := Registry[kind]
+	if !ok {
+		return nil
+	}
+
+	p := &Pool{kind: kind, inflight: NewConnTracker()}
+	for i, server := range servers {
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		p.members = append(p.members, &Member{Server: server, Weight: weight})
+	}
+	p.inner = f(servers, weights)
+	return p
+}
+
+// OnChange registers fn to run after every membership change, including a
+// removed server's last request finishing, or once after a Batch of them.
+// It runs without the pool locked.
+func (p *Pool) OnChange(fn func()) {
+	p.mu.Lock()
+	p.onChange = append(p.onChange, fn)
+	p.mu.Unlock()
+}
+
+// Batch runs edit, which may change the membership and whatever mirrors it,
+// and holds the OnChange callbacks back until it returns, so they run once
+// and see every change edit made.
+func (p *Pool) Batch(edit func() error) error {
+	p.mu.Lock()
+	p.batches++
+	p.mu.Unlock()
+
+	err := edit()
+
+	p.mu.Lock()
+	p.batches--
+	fire := p.batches == 0 && p.pending
+	if fire {
+		p.pending = false
+	}
+	p.mu.Unlock()
+
+	if fire {
+		p.changed()
+	}
+	return err
+}
+
+func (p *Pool) NextServer() (string, error) {
+	p.mu.RLock()
+	inner := p.inner
+	p.mu.RUnlock()
+
+	server, err := inner.NextServer()
+	if err != nil {
+		return "", err
+	}
+	p.inflight.Acquire(server)
+	return server, nil
+}
+
+func (p *Pool) Acquire(server string) {
+	p.mu.RLock()
+	inner := p.inner
+	p.mu.RUnlock()
+
+	Acquire(inner, server)
+	p.inflight.Acquire(server)
+}
+
+func (p *Pool) Servers() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.inner.Servers()
+}
+
+func (p *Pool) Done(server string) {
+	p.mu.RLock()
+	inner := p.inner
+	m := p.member(server)
+	removed := m != nil && m.Removed
+	p.mu.RUnlock()
+
+	inner.Done(server)
+	p.inflight.Release(server)
+	if !removed {
+		return
+	}
+
+	// a removed server leaves once it has nothing in flight
+	p.mu.Lock()
+	forgotten := false
+	if m := p.member(server); m != nil && m.Removed && p.inflight.Count(server) == 0 {
+		p.drop(server)
+		forgotten = true
+	}
+	p.mu.Unlock()
+
+	if forgotten {
+		p.changed()
+	}
+}
+
+func (p *Pool) Unwrap() LoadBalancer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.inner
+}
+
+// Members lists every member, including draining ones and removed ones
+// still finishing requests.
+func (p *Pool) Members() []Member {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	out := make([]Member, len(p.members))
+	for i, m := range p.members {
+		out[i] = *m
+		out[i].InFlight = p.inflight.Count(m.Server)
+	}
+	return out
+}
+
+// Add makes server a member taking requests. A draining or removed server
+// is brought back with the new weight.
+func (p *Pool) Add(server string, weight int) error {
+	return p.update(func() error {
+		if m := p.member(server); m != nil {
+			if !m.Draining && !m.Removed {
+				return fmt.Errorf("%s is already a member", server)
+			}
+			*m = Member{Server: server, Weight: weight}
+			return nil
+		}
+		p.members = append(p.members, &Member{Server: server, Weight: weight})
+		return nil
+	})
+}
+
+// Remove stops sending requests to server and forgets it once its in-flight
+// requests are done.
+func (p *Pool) Remove(server string) error {
+	return p.update(func() error {
+		m := p.member(server)
+		if m == nil || m.Removed {
+			return fmt.Errorf("%s is not a member", server)
+		}
+		if p.inflight.Count(server) == 0 {
+			p.drop(server)
+			return nil
+		}
+		m.Removed = true
+		return nil
+	})
+}
+
+// Drain stops sending new requests to server but keeps it a member, so it
+// can be re-added or removed once idle.
+func (p *Pool) Drain(server string) error {
+	return p.update(func() error {
+		m := p.member(server)
+		if m == nil || m.Removed {
+			return fmt.Errorf("%s is not a member", server)
+		}
+		m.Draining = true
+		return nil
+	})
+}
+
+func (p *Pool) SetWeight(server string, weight int) error {
+	return p.update(func() error {
+		m := p.member(server)
+		if m == nil || m.Removed {
+			return fmt.Errorf("%s is not a member", server)
+		}
+		m.Weight = weight
+		return nil
+	})
+}
+
+// update applies change and rebuilds the inner balancer from the members
+// taking requests, handing it the old one's state if it is an Inheritor and
+// telling it what they already have in flight.
+func (p *Pool) update(change func() error) error {
+	p.mu.Lock()
+	if err := change(); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+
+	var servers []string
+	var weights []int
+	for _, m := range p.members {
+		if !m.Draining && !m.Removed {
+			servers = append(servers, m.Server)
+			weights = append(weights, m.Weight)
+		}
+	}
+	prev := p.inner
+	p.inner = Registry[p.kind](servers, weights)
+	if h, ok := p.inner.(Inheritor); ok {
+		h.Inherit(prev)
+	}
+	for _, server := range servers {
+		for n := p.inflight.Count(server); n > 0; n-- {
+			Acquire(p.inner, server)
+		}
+	}
+	p.mu.Unlock()
+
+	p.changed()
+	return nil
+}
+
+func (p *Pool) member(server string) *Member {
+	for _, m := range p.members {
+		if m.Server == server {
+			return m
+		}
+	}
+	return nil
+}
+
+func (p *Pool) drop(server string) {
+	for i, m := range p.members {
+		if m.Server == server {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Pool) changed() {
+	p.mu.Lock()
+	if p.batches > 0 {
+		p.pending = true
+		p.mu.Unlock()
+		return
+	}
+	fns := append([]func(){}, p.onChange...)
+	p.mu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
@@ -0,0 +1,178 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPoolMembershipChanges(t *testing.T) {
+	p := NewPool("round_robin", []string{"a", "b"}, []int{1, 1})
+	changes := 0
+	p.OnChange(func() { changes++ })
+
+	if err := p.Add("c", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("c", 1); err == nil {
+		t.Fatal("adding an existing member should fail")
+	}
+	if got := fmt.Sprint(p.Servers()); got != "[a b c]" {
+		t.Fatalf("after add: %s", got)
+	}
+
+	if err := p.Drain("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(p.Servers()); got != "[b c]" {
+		t.Fatalf("after drain: %s", got)
+	}
+	if len(p.Members()) != 3 {
+		t.Fatal("a draining server is still a member")
+	}
+
+	// re-adding brings a drained server back
+	if err := p.Add("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 3 {
+		t.Fatalf("expected 3 change callbacks, got %d", changes)
+	}
+}
+
+func TestPoolRemoveWaitsForInFlight(t *testing.T) {
+	p := NewPool("round_robin", []string{"a", "b"}, nil)
+
+	s, _ := p.NextServer() // "a", now in flight
+	if err := p.Remove(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(p.Servers()); got != "[b]" {
+		t.Fatalf("removed server still taking requests: %s", got)
+	}
+
+	members := p.Members()
+	if len(members) != 2 || !members[0].Removed || members[0].InFlight != 1 {
+		t.Fatalf("removed server should linger while busy: %+v", members)
+	}
+
+	forgotten := false
+	p.OnChange(func() { forgotten = true })
+	p.Done(s)
+	if !forgotten || len(p.Members()) != 1 {
+		t.Fatalf("removed server not forgotten after its last request: %+v", p.Members())
+	}
+}
+
+func TestPoolReweightRebuildsBalancer(t *testing.T) {
+	p := NewPool("weighted_round_robin", []string{"a", "b"}, []int{1, 1})
+	if err := p.SetWeight("a", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		s, _ := p.NextServer()
+		counts[s]++
+		p.Done(s)
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Fatalf("expected 3:1 after reweight, got %v", counts)
+	}
+}
+
+func TestAsReachesThroughPool(t *testing.T) {
+	p := NewPool("ring_hash", []string{"a", "b"}, nil)
+	if _, ok := As[KeyedBalancer](p); !ok {
+		t.Fatal("keyed balancer hidden by the pool")
+	}
+	if _, ok := As[KeyedBalancer](NewPool("round_robin", []string{"a"}, nil)); ok {
+		t.Fatal("round robin is not keyed")
+	}
+}
+
+func TestPoolAcquireCountsLikeNextServer(t *testing.T) {
+	p := NewPool("least_conn", []string{"a", "b"}, nil)
+
+	// a server pinned without NextServer still weighs on least_conn
+	p.Acquire("a")
+	if s, _ := p.NextServer(); s != "b" {
+		t.Fatalf("expected the idle server, got %s", s)
+	}
+	for _, m := range p.Members() {
+		if m.InFlight != 1 {
+			t.Fatalf("expected one request in flight on each: %+v", p.Members())
+		}
+	}
+
+	p.Done("a")
+	p.Done("b")
+	lc := p.Unwrap().(*LeastConn)
+	for _, m := range p.Members() {
+		if m.InFlight != 0 || lc.inflight.Count(m.Server) != 0 {
+			t.Fatalf("count left behind for %s", m.Server)
+		}
+	}
+}
+
+func TestPoolBatchRunsCallbacksOnce(t *testing.T) {
+	p := NewPool("round_robin", []string{"a"}, nil)
+	changes := 0
+	p.OnChange(func() { changes++ })
+
+	err := p.Batch(func() error {
+		if err := p.Add("b", 1); err != nil {
+			return err
+		}
+		if err := p.Add("c", 1); err != nil {
+			return err
+		}
+		if changes != 0 {
+			t.Fatal("callbacks ran before the batch ended")
+		}
+		return nil
+	})
+	if err != nil || changes != 1 {
+		t.Fatalf("expected one callback after the batch, got %d (%v)", changes, err)
+	}
+}
+
+func TestPoolRebuildKeepsInFlightCounts(t *testing.T) {
+	p := NewPool("least_conn", []string{"a", "b"}, nil)
+	busy, _ := p.NextServer()
+
+	if err := p.Add("c", 1); err != nil {
+		t.Fatal(err)
+	}
+	// the rebuilt balancer still knows busy has a request
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		s, _ := p.NextServer()
+		seen[s] = true
+	}
+	if seen[busy] {
+		t.Fatalf("%s got a request although it was the only busy server", busy)
+	}
+}
+
+func TestPoolRebuildKeepsLatency(t *testing.T) {
+	p := NewPool("p2c_ewma", []string{"fast", "slow"}, nil)
+	obs, _ := As[LatencyObserver](p)
+	obs.Observe("fast", 5*time.Millisecond)
+	obs.Observe("slow", 800*time.Millisecond)
+
+	if err := p.Add("other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetWeight("fast", 2); err != nil {
+		t.Fatal(err)
+	}
+	// the rebuilt balancer still knows slow is slow
+	for i := 0; i < 100; i++ {
+		s, _ := p.NextServer()
+		if s == "slow" {
+			t.Fatalf("pick %d went to the slow server after a rebuild", i)
+		}
+		p.Done(s)
+	}
+}
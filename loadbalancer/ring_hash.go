@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// virtual nodes placed on the ring per unit of weight
+const ringReplicasPerWeight = 100
+
+// RingHash places every server on a hash ring many times over and maps a key
+// to the first server clockwise from the key's hash. Adding or removing a
+// server only moves the keys on the arcs it owns.
+type RingHash struct {
+	servers []string
+	ring    []ringEntry // sorted by hash
+	indx    uint64
+}
+
+type ringEntry struct {
+	hash   uint64
+	server int
+}
+
+func init() {
+	RegistrLoadBalancer("ring_hash", func(servers []string, weights []int) LoadBalancer {
+		return NewRingHash(servers, weights)
+	})
+}
+
+func NewRingHash(servers []string, weights []int) *RingHash {
+	weights = normalizeWeights(servers, weights)
+
+	rh := &RingHash{servers: servers}
+	for i, server := range servers {
+		for r := 0; r < weights[i]*ringReplicasPerWeight; r++ {
+			rh.ring = append(rh.ring, ringEntry{hash: hashKey(server + "#" + strconv.Itoa(r)), server: i})
+		}
+	}
+	sort.Slice(rh.ring, func(i, j int) bool { return rh.ring[i].hash < rh.ring[j].hash })
+	return rh
+}
+
+// NextServer is used for requests without a key and goes round robin.
+func (rh *RingHash) NextServer() (string, error) {
+	if len(rh.servers) == 0 {
+		return "", fmt.Errorf("no servers available")
+	}
+	i := atomic.AddUint64(&rh.indx, 1)
+	return rh.servers[(i-1)%uint64(len(rh.servers))], nil
+}
+
+func (rh *RingHash) Lookup(key string, n int) []string {
+	if len(rh.ring) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(rh.servers))
+
+	h := hashKey(key)
+	start := sort.Search(len(rh.ring), func(i int) bool { return rh.ring[i].hash >= h })
+
+	out := make([]string, 0, n)
+	seen := make([]bool, len(rh.servers))
+	for i := 0; i < len(rh.ring) && len(out) < n; i++ {
+		e := rh.ring[(start+i)%len(rh.ring)]
+		if !seen[e.server] {
+			seen[e.server] = true
+			out = append(out, rh.servers[e.server])
+		}
+	}
+	return out
+}
+
+func (rh *RingHash) Servers() []string {
+	return rh.servers
+}
+
+func (rh *RingHash) Done(server string) {}
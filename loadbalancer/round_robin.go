@@ -32,3 +32,5 @@ func (rr *RoundRobin) NextServer() (string, error) {
 func (rr *RoundRobin) Servers() []string {
 	return rr.servers
 }
+
+func (rr *RoundRobin) Done(server string) {}
@@ -13,6 +13,12 @@ type WeightedRoundRobin struct {
 	mu            sync.Mutex
 }
 
+func init() {
+	RegistrLoadBalancer("weighted_round_robin", func(servers []string, weights []int) LoadBalancer {
+		return NewWeightedRoundRobin(servers, weights)
+	})
+}
+
 func NewWeightedRoundRobin(servers []string, weights []int) *WeightedRoundRobin {
 	return &WeightedRoundRobin{
 		servers:       servers,
@@ -52,3 +58,5 @@ func (wrr *WeightedRoundRobin) NextServer() (string, error) {
 func (wrr *WeightedRoundRobin) Servers() []string {
 	return wrr.servers
 }
+
+func (wrr *WeightedRoundRobin) Done(server string) {}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"math"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,27 +22,39 @@ func StartFlusher(path string) {
 	}()
 }
 
+// lastP95 holds the p95 of the most recent flushed second, in ms.
+var lastP95 atomic.Int64
+
+// LastP95 returns the p95 latency (ms) of the last flushed second with
+// traffic, or 0 if the flusher hasn't produced one yet.
+func LastP95() int64 {
+	return lastP95.Load()
+}
+
 func flush() *FlushedMetrics {
 	mu.Lock()
 	old := current
 	current = newSecondMetrics(time.Now().Unix())
 	mu.Unlock()
 
-	if old.TotalRequests == 0 {
+	if old.empty() {
 		return nil
 	}
 
-	// p95 calculation
-	target := int64(math.Ceil(0.95 * float64(old.TotalRequests)))
-	var cum int64
+	// p95 calculation, for ticks where requests finished; retries, hedges
+	// and the like are counted when they happen, often in between
 	var p95 int64
-
-	for i, c := range old.LatencyCounts {
-		cum += c
-		if cum >= target {
-			p95 = LatencyBuckets[i]
-			break
+	if old.TotalRequests > 0 {
+		target := int64(math.Ceil(0.95 * float64(old.TotalRequests)))
+		var cum int64
+		for i, c := range old.LatencyCounts {
+			cum += c
+			if cum >= target {
+				p95 = LatencyBuckets[i]
+				break
+			}
 		}
+		lastP95.Store(p95)
 	}
 
 	hitRatio := 0.0
@@ -55,5 +68,12 @@ func flush() *FlushedMetrics {
 		P95LatencyMs:  p95,
 		CacheHitRatio: hitRatio,
 		TotalRequests: old.TotalRequests,
+		Retries:       old.Retries,
+		RetriesDenied: old.RetriesDenied,
+		Hedges:        old.Hedges,
+
+		UpstreamErrors:     old.UpstreamErrors,
+		BreakerTransitions: old.BreakerTransitions,
+		Fallbacks:          old.Fallbacks,
 	}
 }
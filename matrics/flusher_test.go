@@ -0,0 +1,37 @@
+package metrics
+
+import "testing"
+
+func TestFlushKeepsRetriesWithoutFinishedRequests(t *testing.T) {
+	flush()
+
+	RecordRetry()
+	RecordRetryDenied()
+	RecordHedge()
+	m := flush()
+	if m == nil {
+		t.Fatal("tick with only retries was dropped")
+	}
+	if m.Retries != 1 || m.RetriesDenied != 1 || m.Hedges != 1 || m.TotalRequests != 0 || m.P95LatencyMs != 0 {
+		t.Fatalf("unexpected flush %+v", m)
+	}
+
+	if m := flush(); m != nil {
+		t.Fatalf("empty tick flushed %+v", m)
+	}
+}
+
+func TestFlushKeepsBreakerTransitions(t *testing.T) {
+	flush()
+
+	RecordBreakerTransition("half_open")
+	RecordUpstreamError("timeout")
+	RecordFallback("static")
+	m := flush()
+	if m == nil {
+		t.Fatal("tick with only a breaker transition was dropped")
+	}
+	if m.BreakerTransitions["half_open"] != 1 || m.UpstreamErrors["timeout"] != 1 || m.Fallbacks["static"] != 1 {
+		t.Fatalf("unexpected flush %+v", m)
+	}
+}
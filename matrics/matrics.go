@@ -14,7 +14,14 @@ type SecondMetrics struct {
 	TotalRequests int64
 	CacheHits     int64
 	CacheMisses   int64
+	Retries       int64
+	RetriesDenied int64
+	Hedges        int64
 	LatencyCounts []int64
+
+	UpstreamErrors     map[string]int64 // by proxy error kind
+	BreakerTransitions map[string]int64 // by state entered
+	Fallbacks          map[string]int64 // by fallback kind served
 }
 
 func newSecondMetrics(sec int64) *SecondMetrics {
@@ -24,11 +31,25 @@ func newSecondMetrics(sec int64) *SecondMetrics {
 	}
 }
 
+// empty reports whether nothing at all was recorded in m.
+func (m *SecondMetrics) empty() bool {
+	return m.TotalRequests == 0 && m.CacheHits == 0 && m.CacheMisses == 0 &&
+		m.Retries == 0 && m.RetriesDenied == 0 && m.Hedges == 0 &&
+		len(m.UpstreamErrors) == 0 && len(m.BreakerTransitions) == 0 && len(m.Fallbacks) == 0
+}
+
 type FlushedMetrics struct {
 	Second        int64   `json:"second"`
 	P95LatencyMs  int64   `json:"p95_latency_ms"`
 	CacheHitRatio float64 `json:"cache_hit_ratio"`
 	TotalRequests int64   `json:"total_requests"`
+	Retries       int64   `json:"retries"`
+	RetriesDenied int64   `json:"retries_denied_by_budget"`
+	Hedges        int64   `json:"hedges"`
+
+	UpstreamErrors     map[string]int64 `json:"upstream_errors,omitempty"`
+	BreakerTransitions map[string]int64 `json:"breaker_transitions,omitempty"`
+	Fallbacks          map[string]int64 `json:"fallbacks,omitempty"`
 }
 
 var (
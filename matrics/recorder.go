@@ -28,3 +28,53 @@ func RecordCacheMiss() {
 	current.CacheMisses++
 	mu.Unlock()
 }
+
+func RecordRetry() {
+	mu.Lock()
+	current.Retries++
+	mu.Unlock()
+}
+
+func RecordRetryDenied() {
+	mu.Lock()
+	current.RetriesDenied++
+	mu.Unlock()
+}
+
+func RecordHedge() {
+	mu.Lock()
+	current.Hedges++
+	mu.Unlock()
+}
+
+// RecordUpstreamError counts an exchange that failed before the upstream
+// answered, by kind (dial, timeout, tls, reset...).
+func RecordUpstreamError(kind string) {
+	mu.Lock()
+	if current.UpstreamErrors == nil {
+		current.UpstreamErrors = map[string]int64{}
+	}
+	current.UpstreamErrors[kind]++
+	mu.Unlock()
+}
+
+// RecordBreakerTransition counts a circuit breaker entering state.
+func RecordBreakerTransition(state string) {
+	mu.Lock()
+	if current.BreakerTransitions == nil {
+		current.BreakerTransitions = map[string]int64{}
+	}
+	current.BreakerTransitions[state]++
+	mu.Unlock()
+}
+
+// RecordFallback counts a request answered by a route's fallback, by kind
+// (stale, upstream, static).
+func RecordFallback(kind string) {
+	mu.Lock()
+	if current.Fallbacks == nil {
+		current.Fallbacks = map[string]int64{}
+	}
+	current.Fallbacks[kind]++
+	mu.Unlock()
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	"FluxGate/healthcheck"
+	"FluxGate/loadbalancer"
+	"FluxGate/utils"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// PickUpstream chooses the upstream for an attempt of r: the server named by
+// the route's sticky-session cookie if it is still usable, then the hash key's
+// preferred servers on a consistent-hash balancer, otherwise whatever the
+// balancer hands out next. Servers in exclude, failing their health check or
+// with an open breaker are skipped throughout. Either way the server is
+// counted in flight, so the caller must call the route's LoadBalancer.Done
+// on it once its request ends, and its breaker let the attempt through in
+// the returned generation.
+func PickUpstream(
+	r *http.Request,
+	route *configuration.RouteConfig,
+	breakers *circuitbreaker.Set,
+	health *healthcheck.Monitor,
+	exclude ...string,
+) (string, circuitbreaker.Generation, error) {
+	lb := route.LoadBalancer
+	if lb == nil {
+		return "", 0, fmt.Errorf("no load balancer for route %s", route.Path)
+	}
+
+	var gen circuitbreaker.Generation
+	usable := func(server string) bool {
+		if slices.Contains(exclude, server) || !health.Healthy(server) {
+			return false
+		}
+		cb := breakers.Get(route, server)
+		if cb == nil {
+			return true
+		}
+		var ok bool
+		gen, ok = cb.Allow()
+		return ok
+	}
+
+	if route.Sticky.Enabled {
+		if c, err := r.Cookie(route.Sticky.Cookie()); err == nil {
+			for _, server := range lb.Servers() {
+				if loadbalancer.ServerID(server) == c.Value && usable(server) {
+					loadbalancer.Acquire(lb, server)
+					return server, gen, nil
+				}
+			}
+		}
+	}
+
+	if kb, ok := loadbalancer.As[loadbalancer.KeyedBalancer](lb); ok {
+		if key := balanceKey(r, route); key != "" {
+			// lb.Servers() leaves out upstreams ejected by outlier detection;
+			// once all of them are, an ejected one beats failing the request
+			inPool := lb.Servers()
+			if len(inPool) == 0 {
+				inPool = kb.Servers()
+			}
+			for _, server := range kb.Lookup(key, len(kb.Servers())) {
+				if slices.Contains(inPool, server) && usable(server) {
+					loadbalancer.Acquire(lb, server)
+					return server, gen, nil
+				}
+			}
+			return "", 0, fmt.Errorf("no healthy upstreams (all failing health checks or circuits open)")
+		}
+	}
+
+	return utils.PickHealthyServer(route, breakers, health, exclude...)
+}
+
+// releaseUpstream hands back an upstream PickUpstream chose for an attempt
+// that was never sent.
+func releaseUpstream(route *configuration.RouteConfig, breakers *circuitbreaker.Set, upstream string, gen circuitbreaker.Generation) {
+	route.LoadBalancer.Done(upstream)
+	if cb := breakers.Get(route, upstream); cb != nil {
+		cb.Cancel(gen)
+	}
+}
+
+// balanceKey extracts the route's hash_key attribute from r, or "" if the
+// route has none or the request doesn't carry it.
+func balanceKey(r *http.Request, route *configuration.RouteConfig) string {
+	kind, name, _ := strings.Cut(route.HashKey, ":")
+
+	switch kind {
+	case "header":
+		return r.Header.Get(name)
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+	case "query":
+		return r.URL.Query().Get(name)
+	case "param":
+		return route.PathParam(r.URL.Path, name)
+	case "ip":
+		return realClientIP(r)
+	case "identity":
+		return identifyUser(r, route)
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// backoff strategies
+const (
+	backoffExponential        = "exponential"
+	backoffDecorrelatedJitter = "decorrelated_jitter"
+	backoffConstant           = "constant"
+)
+
+const maxExponentialJitter = 25 * time.Millisecond
+
+// backoff computes the wait before each retry of one client request.
+type backoff struct {
+	strategy string
+	max      time.Duration
+	prev     time.Duration // last decorrelated jitter delay
+}
+
+func newBackoff(strategy string, max time.Duration) *backoff {
+	return &backoff{strategy: strategy, max: max}
+}
+
+// next returns the delay before retry number attempt+1, given the base delay
+// of the upstream that just failed.
+func (b *backoff) next(attempt int, base time.Duration) time.Duration {
+	var d time.Duration
+
+	switch b.strategy {
+	case backoffConstant:
+		d = base
+
+	case backoffDecorrelatedJitter:
+		// sleep = rand(base, prev*3), see the AWS "Exponential Backoff And Jitter" post
+		prev := b.prev
+		if prev < base {
+			prev = base
+		}
+		upper := prev * 3
+		d = base
+		if upper > base {
+			d += time.Duration(rand.Int63n(int64(upper - base)))
+		}
+
+	default:
+		jitter := time.Duration(rand.Int63n(int64(maxExponentialJitter)))
+		d = base*(1<<attempt) + jitter
+	}
+
+	if b.max > 0 && d > b.max {
+		d = b.max
+	}
+	b.prev = d
+	return d
+}
+
+// retryAfter parses the Retry-After header of a 503 or 429 response, given
+// either as delta-seconds or an HTTP-date.
+func retryAfter(status int, h http.Header) (time.Duration, bool) {
+	if status != http.StatusServiceUnavailable && status != http.StatusTooManyRequests {
+		return 0, false
+	}
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// sleepCtx waits for d unless ctx ends first, and reports whether it slept
+// the full duration.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDecorrelatedJitterStaysInBounds(t *testing.T) {
+	base := 10 * time.Millisecond
+	max := 200 * time.Millisecond
+	b := newBackoff(backoffDecorrelatedJitter, max)
+
+	prev := base
+	for attempt := 0; attempt < 50; attempt++ {
+		d := b.next(attempt, base)
+		if d < base || d > max {
+			t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, d, base, max)
+		}
+		if d > prev*3 {
+			t.Fatalf("attempt %d: delay %v more than 3x previous %v", attempt, d, prev)
+		}
+		prev = d
+	}
+}
+
+func TestExponentialBackoffIsCapped(t *testing.T) {
+	b := newBackoff("", 50*time.Millisecond)
+	if d := b.next(10, 10*time.Millisecond); d != 50*time.Millisecond {
+		t.Fatalf("expected cap of 50ms, got %v", d)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	h := http.Header{}
+	h.Set("Retry-After", "3")
+	if d, ok := retryAfter(http.StatusServiceUnavailable, h); !ok || d != 3*time.Second {
+		t.Fatalf("delta-seconds: got %v, %v", d, ok)
+	}
+	if _, ok := retryAfter(http.StatusInternalServerError, h); ok {
+		t.Fatal("Retry-After should only be honoured on 503 / 429")
+	}
+
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d, ok := retryAfter(http.StatusTooManyRequests, h); !ok || d < 59*time.Minute {
+		t.Fatalf("HTTP-date: got %v, %v", d, ok)
+	}
+
+	h.Set("Retry-After", "soon")
+	if _, ok := retryAfter(http.StatusServiceUnavailable, h); ok {
+		t.Fatal("garbage Retry-After should be ignored")
+	}
+}
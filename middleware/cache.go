@@ -6,9 +6,20 @@ import (
 	"FluxGate/storage"
 	"bytes"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const defaultMaxCacheableBytes int64 = 1 << 20
+
+// CacheMiddleware serves GET and HEAD requests from the route's cache as a
+// shared cache would (RFC 9111): responses are stored for as long as their
+// Cache-Control or Expires allows, keyed on the headers they Vary on, and
+// requests can bypass stored responses with Cache-Control: no-cache. Stored
+// responses answer If-None-Match / If-Modified-Since with 304, and once
+// stale are revalidated with the upstream rather than fetched again.
 func CacheMiddleware(store *configuration.GatewayConfigStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 
@@ -17,68 +28,260 @@ func CacheMiddleware(store *configuration.GatewayConfigStore) func(http.Handler)
 			route := r.Context().Value(configuration.RouteCtxKey).(*configuration.RouteConfig)
 
 			cache := route.CacheInstance
-			if cache == nil {
+			if cache == nil || route.Streaming || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			key := r.Method + ":" + r.URL.Path
-			if r.URL.RawQuery != "" {
-				key += "?" + r.URL.RawQuery
-			}
+			reqCC := parseCacheControl(r.Header)
 
 			// cache hit
-			if entry, ok := cache.Get(key); ok {
-				metrics.RecordCacheHit()
-				for hk, vals := range entry.Header {
-					for _, v := range vals {
-						w.Header().Add(hk, v)
-					}
+			if servableFromCache(reqCC, r) {
+				if entry, ok := lookup(cache, r, false, 0); ok && fitsMaxAge(reqCC, entry) {
+					metrics.RecordCacheHit()
+					writeCached(w, r, entry)
+					return
 				}
-				w.WriteHeader(http.StatusOK)
-				w.Write(entry.Body)
-				return
 			}
 
 			metrics.RecordCacheMiss()
 
-			// capture response
+			limit := route.Cache.MaxBodyBytes
+			if limit <= 0 {
+				limit = defaultMaxCacheableBytes
+			}
+
+			// a stored response the upstream can vouch for is revalidated
+			// rather than downloaded again
+			if !reqCC.has("no-store") {
+				if stale, ok := lookup(cache, r, true, 0); ok && hasValidator(stale.Header) {
+					rec := &responseRecorder{ResponseWriter: w, limit: limit, revalidating: true}
+					start := time.Now()
+					next.ServeHTTP(rec, conditionalRequest(r, stale.Header))
+
+					if rec.status != http.StatusNotModified {
+						storeResponse(cache, r, route, rec, start)
+						return
+					}
+					if etag := rec.header.Get("ETag"); etag == "" || etag == stale.Header.Get("ETag") {
+						entry := refresh(stale, rec.header, start)
+						if lifetime, vary, ok := freshness(r, entry.Header, route); ok {
+							entry.Header.Del("Set-Cookie")
+							entry.ExpiryTime = entry.Stored.Add(lifetime)
+							save(cache, r, entry, vary)
+						}
+						writeCached(w, r, entry)
+						return
+					}
+					// the 304 validates some other response than the stored one
+				}
+			}
+
+			// stream the response to the client, keeping a copy while it fits
 			rec := &responseRecorder{
 				ResponseWriter: w,
-				header:         http.Header{},
+				limit:          limit,
 			}
 
+			start := time.Now()
 			next.ServeHTTP(rec, r)
-
-			// cache only 200 OK
-			if rec.status == http.StatusOK {
-				ttlDur := time.Duration(route.Cache.TTL) * time.Millisecond
-				cache.Set(key, storage.CacheEntry{
-					Body:       rec.body.Bytes(),
-					Header:     rec.header.Clone(),
-					ExpiryTime: time.Now().Add(ttlDur),
-				})
-			}
+			storeResponse(cache, r, route, rec, start)
 		})
 	}
 }
 
+// storeResponse stores the response rec recorded for r, if it may be.
+func storeResponse(cache *storage.LRUCache, r *http.Request, route *configuration.RouteConfig, rec *responseRecorder, start time.Time) {
+	// cache only 200 OK, and not fallbacks standing in for the upstream
+	if rec.status != http.StatusOK || rec.overflow || rec.header.Get(FallbackHeader) != "" || parseCacheControl(r.Header).has("no-store") {
+		return
+	}
+	lifetime, vary, ok := freshness(r, rec.header, route)
+	if !ok {
+		return
+	}
+
+	// the sticky cookie belongs to the client that got the response,
+	// not to later hits (it would pin everyone to the first upstream)
+	rec.header.Del("Set-Cookie")
+	stored := start.Add(-initialAge(rec.header))
+	rec.header.Del("Age")
+	entry := storage.CacheEntry{
+		Body:       rec.body.Bytes(),
+		Header:     rec.header,
+		ExpiryTime: stored.Add(lifetime),
+		Stored:     stored,
+	}
+	// a response stale on arrival is still worth keeping to revalidate
+	if entry.ExpiryTime.After(time.Now()) || hasValidator(entry.Header) {
+		save(cache, r, entry, vary)
+	}
+}
+
+// conditionalRequest returns a copy of r asking the upstream whether the
+// stored response with header h is still current, in place of any
+// conditions the client sent.
+func conditionalRequest(r *http.Request, h http.Header) *http.Request {
+	r = r.Clone(r.Context())
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	if etag := h.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := h.Get("Last-Modified"); lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return r
+}
+
+// refresh updates a stored response with the header of the 304 that
+// revalidated it at start (RFC 9111 4.3.4).
+func refresh(entry storage.CacheEntry, notModified http.Header, start time.Time) storage.CacheEntry {
+	entry.Header = entry.Header.Clone()
+	for k, v := range notModified {
+		if k != "Content-Length" {
+			entry.Header[k] = v
+		}
+	}
+	entry.Stored = start.Add(-initialAge(entry.Header))
+	entry.Header.Del("Age")
+	return entry
+}
+
+func cacheKey(r *http.Request) string {
+	key := r.Method + ":" + r.URL.Path
+	if r.URL.RawQuery != "" {
+		key += "?" + r.URL.RawQuery
+	}
+	return key
+}
+
+// variantKey extends key with r's values of the headers in vary.
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// lookup finds the stored response for r, following the entry under its
+// plain key to the variant matching r's headers if the response varies.
+// With stale set, responses that expired up to maxStale ago (0 = any) are
+// returned too.
+func lookup(cache *storage.LRUCache, r *http.Request, stale bool, maxStale time.Duration) (storage.CacheEntry, bool) {
+	get := cache.Get
+	if stale {
+		get = func(key string) (storage.CacheEntry, bool) { return cache.GetStale(key, maxStale) }
+	}
+
+	key := cacheKey(r)
+	entry, ok := get(key)
+	if ok && len(entry.Vary) > 0 {
+		return get(variantKey(key, entry.Vary, r))
+	}
+	return entry, ok
+}
+
+// save stores entry as the response to r. A response that varies goes under
+// its variant key, with the plain key recording what it varies on for as
+// long as any variant is fresh.
+func save(cache *storage.LRUCache, r *http.Request, entry storage.CacheEntry, vary []string) {
+	key := cacheKey(r)
+	if len(vary) == 0 {
+		cache.Set(key, entry)
+		return
+	}
+
+	marker := storage.CacheEntry{Vary: vary, ExpiryTime: entry.ExpiryTime}
+	if prev, ok := cache.GetStale(key, 0); ok && slices.Equal(prev.Vary, vary) && prev.ExpiryTime.After(marker.ExpiryTime) {
+		marker.ExpiryTime = prev.ExpiryTime
+	}
+	cache.Set(key, marker)
+	cache.Set(variantKey(key, vary, r), entry)
+}
+
+// fitsMaxAge reports whether entry is no older than the request's max-age.
+func fitsMaxAge(cc cacheControl, entry storage.CacheEntry) bool {
+	maxAge, ok := cc.seconds("max-age")
+	return !ok || time.Since(entry.Stored) <= maxAge
+}
+
+// writeCached answers with a stored response and its current Age, or with
+// 304 Not Modified if the request's conditions say the client has it.
+func writeCached(w http.ResponseWriter, r *http.Request, entry storage.CacheEntry) {
+	for hk, vals := range entry.Header {
+		w.Header()[hk] = slices.Clone(vals)
+	}
+	w.Header().Set("Age", strconv.FormatInt(int64(time.Since(entry.Stored)/time.Second), 10))
+	if notModified(r, entry.Header) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.Body)
+}
+
+// responseRecorder tees the response to the client and an in-memory buffer.
+// Once the body grows past limit the copy is dropped and only streaming continues.
+// While revalidating, a 304 is only recorded: it answers the gateway's
+// conditions, not the client's.
 type responseRecorder struct {
 	http.ResponseWriter
-	status int
-	body   bytes.Buffer
-	header http.Header
+	status       int
+	header       http.Header
+	body         bytes.Buffer
+	limit        int64
+	overflow     bool
+	revalidating bool
+	held         bool // the response is a 304 kept from the client
 }
 
-func (r *responseRecorder) Header() http.Header {
-	return r.header
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = code
+	r.header = r.ResponseWriter.Header().Clone()
+	if r.revalidating && code == http.StatusNotModified {
+		r.held = true
+		return
+	}
+	if ct := r.header.Get("Content-Type"); strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "application/grpc") {
+		// streams are unbounded and gRPC status lives in trailers, never cache them
+		r.overflow = true
+	}
+	r.ResponseWriter.WriteHeader(code)
 }
 
 func (r *responseRecorder) Write(b []byte) (int, error) {
-	r.body.Write(b)
-	return len(b), nil
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.held {
+		return len(b), nil
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(b)) > r.limit {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
 }
 
-func (r *responseRecorder) WriteHeader(code int) {
-	r.status = code
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.held {
+		return
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
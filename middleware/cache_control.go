@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"FluxGate/configuration"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of Cache-Control headers, lower-cased,
+// with their argument if they have one.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		// a malformed lifetime means stale (RFC 9111 4.2.1)
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// servableFromCache reports whether the request lets a stored response
+// answer it without going to the upstream.
+func servableFromCache(cc cacheControl, r *http.Request) bool {
+	if cc.has("no-store") || cc.has("no-cache") {
+		return false
+	}
+	if len(cc) == 0 && r.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	return true
+}
+
+// freshness works out how long the response to r with header h may be
+// served from a shared cache, and the Vary headers it must be keyed on.
+// ok is false if it must not be stored at all: the upstream said no-store
+// or private, it varies on everything, it sets cookies other than the
+// gateway's sticky one, it answers an authenticated request without saying
+// it may be shared, or it is stale already and can't be revalidated.
+// Responses that don't give a lifetime get the route's ttl_ms; no-cache
+// ones get none, so every use revalidates them.
+func freshness(r *http.Request, h http.Header, route *configuration.RouteConfig) (lifetime time.Duration, vary []string, ok bool) {
+	cc := parseCacheControl(h)
+	if cc.has("no-store") || cc.has("private") {
+		return 0, nil, false
+	}
+	if foreignCookies(h, route) {
+		return 0, nil, false
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return 0, nil, false
+	}
+
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return 0, nil, false
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(vary)
+	vary = slices.Compact(vary)
+
+	if cc.has("no-cache") {
+		// may be stored, but only used once revalidated
+		lifetime = 0
+	} else if d, ok := cc.seconds("s-maxage"); ok {
+		lifetime = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		lifetime = d
+	} else if expires := h.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, nil, false
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = at.Sub(date)
+	} else {
+		lifetime = time.Duration(route.Cache.TTL) * time.Millisecond
+	}
+	return lifetime, vary, lifetime > 0 || hasValidator(h)
+}
+
+// mayServeStale reports whether the stored response with header h may be
+// served once stale without revalidating it. Shared caches must not when
+// the upstream said no-cache, must-revalidate, proxy-revalidate or
+// s-maxage (RFC 9111 4.2.4).
+func mayServeStale(h http.Header) bool {
+	cc := parseCacheControl(h)
+	return !cc.has("no-cache") && !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("s-maxage")
+}
+
+// hasValidator reports whether a response with header h can be revalidated
+// with a conditional request.
+func hasValidator(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// notModified reports whether r's conditions say the client already has the
+// response with header h: If-None-Match lists its entity tag (compared
+// weakly), or, without If-None-Match, it was last modified no later than
+// If-Modified-Since.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// foreignCookies reports whether h sets any cookie other than the route's
+// sticky-session one, which belongs to whichever client got the response.
+func foreignCookies(h http.Header, route *configuration.RouteConfig) bool {
+	for _, line := range h.Values("Set-Cookie") {
+		name, _, _ := strings.Cut(line, "=")
+		if !route.Sticky.Enabled || strings.TrimSpace(name) != route.Sticky.Cookie() {
+			return true
+		}
+	}
+	return false
+}
+
+// initialAge is how old the upstream says its response already was.
+func initialAge(h http.Header) time.Duration {
+	n, err := strconv.ParseInt(h.Get("Age"), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
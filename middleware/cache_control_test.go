@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"FluxGate/configuration"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Now().UTC()
+	route := &configuration.RouteConfig{Cache: configuration.CacheConfig{TTL: 30000}}
+	sticky := &configuration.RouteConfig{Sticky: configuration.StickyConfig{Enabled: true}}
+
+	tests := []struct {
+		name     string
+		route    *configuration.RouteConfig
+		header   http.Header
+		auth     bool
+		lifetime time.Duration
+		vary     []string
+		ok       bool
+	}{
+		{"route ttl by default", route, http.Header{}, false, 30 * time.Second, nil, true},
+		{"max-age", route, http.Header{"Cache-Control": {"public, max-age=60"}}, false, time.Minute, nil, true},
+		{"s-maxage wins for a shared cache", route, http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, false, 10 * time.Second, nil, true},
+		{"expires", route, http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(2 * time.Minute).Format(http.TimeFormat)},
+		}, false, 2 * time.Minute, nil, true},
+		{"bad expires", route, http.Header{"Expires": {"0"}}, false, 0, nil, false},
+		{"malformed max-age is stale", route, http.Header{"Cache-Control": {"max-age=soon"}}, false, 0, nil, false},
+		{"no-store", route, http.Header{"Cache-Control": {"no-store"}}, false, 0, nil, false},
+		{"private", route, http.Header{"Cache-Control": {"Private"}}, false, 0, nil, false},
+		{"vary", route, http.Header{"Vary": {"accept-encoding, Accept-Language", "Accept-Encoding"}}, false, 30 * time.Second, []string{"Accept-Encoding", "Accept-Language"}, true},
+		{"vary star", route, http.Header{"Vary": {"*"}}, false, 0, nil, false},
+		{"set-cookie", route, http.Header{"Set-Cookie": {"session=1"}}, false, 0, nil, false},
+		{"sticky cookie only", sticky, http.Header{"Set-Cookie": {"fg_sticky=abc; Path=/"}, "Cache-Control": {"max-age=5"}}, false, 5 * time.Second, nil, true},
+		{"authorized", route, http.Header{"Cache-Control": {"max-age=60"}}, true, 0, nil, false},
+		{"authorized and public", route, http.Header{"Cache-Control": {"public, max-age=60"}}, true, time.Minute, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.auth {
+				r.Header.Set("Authorization", "Bearer x")
+			}
+			lifetime, vary, ok := freshness(r, tt.header, tt.route)
+			if ok != tt.ok || (ok && (lifetime != tt.lifetime || fmt.Sprint(vary) != fmt.Sprint(tt.vary))) {
+				t.Fatalf("got %v %v %v, want %v %v %v", lifetime, vary, ok, tt.lifetime, tt.vary, tt.ok)
+			}
+		})
+	}
+}
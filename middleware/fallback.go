@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	"FluxGate/healthcheck"
+	metrics "FluxGate/matrics"
+	"context"
+	"net/http"
+	"time"
+)
+
+// FallbackHeader tells the client a fallback answered instead of the
+// route's upstreams, and which: "stale", "upstream" or "static".
+const FallbackHeader = "X-Gateway-Fallback"
+
+// serveFallback answers r with the route's fallback once none of its
+// upstreams can take it, or every attempt at them failed, trying a stale
+// cached response, the secondary pool and the static response in that order.
+// It reports false if the route has no fallback that applies, leaving w
+// untouched.
+func serveFallback(w http.ResponseWriter, r *http.Request, route *configuration.RouteConfig, breakers *circuitbreaker.Set, health *healthcheck.Monitor, next http.Handler) bool {
+	fb := route.Fallback
+
+	if fb.StaleIfError && route.CacheInstance != nil && !route.Streaming {
+		maxStale := time.Duration(fb.MaxStaleMs) * time.Millisecond
+		if entry, ok := lookup(route.CacheInstance, r, true, maxStale); ok && mayServeStale(entry.Header) {
+			metrics.RecordFallback("stale")
+			w.Header().Set(FallbackHeader, "stale")
+			writeCached(w, r, entry)
+			return true
+		}
+	}
+
+	if secondary := route.FallbackRoute; secondary != nil {
+		if upstream, gen, err := PickUpstream(r, secondary, breakers, health); err == nil {
+			metrics.RecordFallback("upstream")
+			ctx := context.WithValue(r.Context(), configuration.RouteCtxKey, secondary)
+			ctx = withUpstream(ctx, upstream, gen)
+			w.Header().Set(FallbackHeader, "upstream")
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return true
+		}
+	}
+
+	if fb.Status > 0 {
+		metrics.RecordFallback("static")
+		for hk, v := range fb.Headers {
+			w.Header().Set(hk, v)
+		}
+		w.Header().Set(FallbackHeader, "static")
+		w.WriteHeader(fb.Status)
+		w.Write(route.FallbackBody)
+		return true
+	}
+	return false
+}
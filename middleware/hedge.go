@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	metrics "FluxGate/matrics"
+	"FluxGate/proxy"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultHedgeDelay = 100 * time.Millisecond
+
+// hedgeAttempt is the response writer of one of the racing requests. Once
+// its status is known it asks serveHedged whether it won: the winner's body
+// goes straight to the client, any other body is kept in case every attempt
+// fails and the last failure has to be replayed.
+type hedgeAttempt struct {
+	client  http.ResponseWriter
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	err     *proxy.ProxyError
+	ready   chan<- *hedgeAttempt
+	verdict chan bool
+	settled <-chan struct{} // closed once serveHedged has returned
+	cancel  context.CancelFunc
+	won     bool
+}
+
+func (a *hedgeAttempt) Header() http.Header {
+	if a.won {
+		return a.client.Header()
+	}
+	return a.header
+}
+
+func (a *hedgeAttempt) WriteHeader(code int) {
+	if a.status != 0 {
+		return
+	}
+	a.status = code
+	a.ready <- a
+	select {
+	case a.won = <-a.verdict:
+	case <-a.settled:
+		// the other attempt won and has finished
+	}
+}
+
+func (a *hedgeAttempt) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.won {
+		return a.client.Write(p)
+	}
+	return a.body.Write(p)
+}
+
+func (a *hedgeAttempt) Flush() {
+	if !a.won {
+		return
+	}
+	if f, ok := a.client.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *hedgeAttempt) ReportProxyError(err *proxy.ProxyError) {
+	if a.status == 0 {
+		a.err = err
+	}
+}
+
+// commit sends a's status and headers to the client.
+func (a *hedgeAttempt) commit() {
+	if rep, ok := a.client.(proxy.ErrorReporter); ok && a.err != nil {
+		rep.ReportProxyError(a.err)
+	}
+	for k, vals := range a.header {
+		for _, v := range vals {
+			a.client.Header().Add(k, v)
+		}
+	}
+	a.client.WriteHeader(a.status)
+}
+
+// hedgeDelay is how long serveHedged waits before sending the duplicate. The
+// p95 use_p95 asks for is gateway-wide, over every route and cache hits alike.
+func hedgeDelay(cfg configuration.HedgeConfig) time.Duration {
+	if cfg.UseP95 {
+		if p95 := metrics.LastP95(); p95 > 0 {
+			return time.Duration(p95) * time.Millisecond
+		}
+	}
+	if cfg.DelayMs > 0 {
+		return time.Duration(cfg.DelayMs) * time.Millisecond
+	}
+	return defaultHedgeDelay
+}
+
+// hedgeable reports whether r may be answered by whichever of two duplicate
+// requests replies first. Streams are long-lived and often not idempotent
+// past their first message, so they are never duplicated.
+func hedgeable(r *http.Request, route *configuration.RouteConfig) bool {
+	if route.Streaming || proxy.IsGRPCRequest(r) {
+		return false
+	}
+	return !strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveHedged sends r to the upstream already picked into its context and,
+// if its response headers haven't come back after delay, a duplicate to a
+// second upstream from pickSecond, which may refuse one, e.g. when the retry
+// budgets are spent. The first response that isn't retryable
+// wins: it is streamed to w and the other request is cancelled. If every
+// attempt is retryable the last one to finish is written to w.
+func serveHedged(
+	w http.ResponseWriter,
+	next http.Handler,
+	r *http.Request,
+	body []byte,
+	delay time.Duration,
+	pickSecond func() (string, circuitbreaker.Generation, error),
+	retryable func(status int, err *proxy.ProxyError) bool,
+) {
+	// buffered so attempts never block on a coordinator that has returned
+	ready := make(chan *hedgeAttempt, 2)
+	done := make(chan *hedgeAttempt, 2)
+	settled := make(chan struct{})
+	var attempts []*hedgeAttempt
+	defer func() {
+		close(settled)
+		for _, a := range attempts {
+			a.cancel()
+		}
+	}()
+
+	launch := func(ctx context.Context) {
+		ctx, cancel := context.WithCancel(ctx)
+
+		req := r.WithContext(ctx)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		a := &hedgeAttempt{
+			client:  w,
+			header:  http.Header{},
+			ready:   ready,
+			verdict: make(chan bool, 1),
+			settled: settled,
+			cancel:  cancel,
+		}
+		attempts = append(attempts, a)
+		go func() {
+			next.ServeHTTP(a, req)
+			if a.status == 0 {
+				a.WriteHeader(http.StatusOK)
+			}
+			done <- a
+		}()
+	}
+
+	launch(r.Context())
+	inFlight := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var winner, last *hedgeAttempt
+	for inFlight > 0 {
+		select {
+		case a := <-ready:
+			if winner != nil || retryable(a.status, a.err) {
+				a.verdict <- false
+				continue
+			}
+			winner = a
+			a.commit()
+			a.verdict <- true
+			for _, other := range attempts {
+				if other != a {
+					other.cancel()
+				}
+			}
+
+		case a := <-done:
+			inFlight--
+			if a == winner {
+				return
+			}
+			if winner == nil {
+				last = a
+			}
+
+		case <-timer.C:
+			if winner != nil {
+				continue
+			}
+			second, gen, err := pickSecond()
+			if err != nil {
+				// nowhere else to send it, or no budget to, keep waiting on the primary
+				continue
+			}
+			metrics.RecordHedge()
+			launch(withUpstream(r.Context(), second, gen))
+			inFlight++
+		}
+	}
+
+	last.commit()
+	w.Write(last.body.Bytes())
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"FluxGate/configuration"
 	"FluxGate/ratelimit"
+	"FluxGate/utils"
 	"net/http"
 	"strings"
 )
@@ -115,10 +116,5 @@ func identifyUser(r *http.Request, route *configuration.RouteConfig) string {
 }
 
 func realClientIP(r *http.Request) string {
-
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		return strings.Split(xff, ",")[0]
-	}
-	return r.RemoteAddr
+	return utils.ClientIP(r, utils.TrustedProxiesOf(r))
 }
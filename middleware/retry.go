@@ -3,27 +3,40 @@ package middleware
 import (
 	"FluxGate/circuitbreaker"
 	"FluxGate/configuration"
-	"FluxGate/utils"
+	"FluxGate/healthcheck"
+	metrics "FluxGate/matrics"
+	"FluxGate/proxy"
+	"FluxGate/retrybudget"
 	"bytes"
 	"context"
+	"errors"
 	"io"
-	"math/rand"
 	"net/http"
 	"time"
 )
 
+const defaultRetryBufferBytes int64 = 1 << 20
+
+var errHedgeDenied = errors.New("retry budget denies the hedge")
+
 type responseCapture struct {
 	status int
-	body   *bytes.Buffer
 	header http.Header
+	err    *proxy.ProxyError // set if the gateway generated the response
 }
 
+// responseWriter holds back the status and headers of an attempt until it
+// knows whether the attempt is final. Responses holdBack rejects are committed
+// to the client and their body streamed through; held back bodies are
+// discarded so the request can be retried.
 type responseWriter struct {
 	http.ResponseWriter
-	capture *responseCapture
+	capture   *responseCapture
+	holdBack  func(status int) bool
+	committed bool
 }
 
-func RetryHandler(breakers map[string]*circuitbreaker.CircuitBreaker) func(http.Handler) http.Handler {
+func RetryHandler(breakers *circuitbreaker.Set, health *healthcheck.Monitor) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			routeVal := r.Context().Value(configuration.RouteCtxKey)
@@ -33,92 +46,318 @@ func RetryHandler(breakers map[string]*circuitbreaker.CircuitBreaker) func(http.
 			}
 			route := routeVal.(*configuration.RouteConfig)
 
+			// total budget shared by every attempt and the backoff between them
+			if total := route.Timeouts.TotalMs; total > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), time.Duration(total)*time.Millisecond)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+
 			retryConfig := route.Retry
-			if !retryConfig.Enabled || retryConfig.MaxTries <= 0 {
-				upstream, err := utils.PickHealthyServer(route.LoadBalancer, breakers)
+			if !retriesPossible(route) && !retryConfig.Hedge.Enabled {
+				upstream, gen, err := PickUpstream(r, route, breakers, health)
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					if !serveFallback(w, r, route, breakers, health, next) {
+						http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					}
 					return
 				}
-				r = r.WithContext(context.WithValue(r.Context(), configuration.UpstreamCtxKey, upstream))
-				next.ServeHTTP(w, r)
+				next.ServeHTTP(w, r.WithContext(withUpstream(r.Context(), upstream, gen)))
 				return
 			}
 
-			bodyBytes, err := io.ReadAll(r.Body)
+			limit := retryConfig.MaxBufferBytes
+			if limit <= 0 {
+				limit = defaultRetryBufferBytes
+			}
+			bodyBytes, replayable, err := bufferBody(r, limit)
 			if err != nil {
 				http.Error(w, "Bad Request", http.StatusBadRequest)
 				return
 			}
-			r.Body.Close()
 
-			maxTries := retryConfig.MaxTries
-			baseDelay := time.Duration(retryConfig.BaseTimeMs) * time.Millisecond
+			// body too large to hold in memory, or replaying it isn't safe:
+			// one try only
+			singleTry := !replayable || (!isIdempotent(r) && !retryConfig.RetryNonIdempotent)
+			// hedging duplicates the request, so it needs the same guarantees
+			hedging := retryConfig.Hedge.Enabled && replayable && isIdempotent(r) && hedgeable(r, route)
+			lastStatus := 0
+			var lastHeader http.Header
+			var lastErr *proxy.ProxyError
+			outOfTime := false // the total budget can't cover the next backoff
+
+			maxBackoff := time.Duration(retryConfig.MaxBackoffMs) * time.Millisecond
+			wait := newBackoff(retryConfig.Backoff, maxBackoff)
 
-			for attempt := 0; attempt < maxTries; attempt++ {
-				upstream, err := utils.PickHealthyServer(route.LoadBalancer, breakers)
+			if route.RetryBudget != nil {
+				route.RetryBudget.Deposit()
+			}
+
+			for attempt := 0; ; attempt++ {
+				if r.Context().Err() != nil {
+					break
+				}
+
+				if replayable {
+					r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+					r.ContentLength = int64(len(bodyBytes))
+				}
+
+				upstream, gen, err := PickUpstream(r, route, breakers, health)
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					if !serveFallback(w, r, route, breakers, health, next) {
+						http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					}
 					return
 				}
 
-				r = r.WithContext(context.WithValue(r.Context(), configuration.UpstreamCtxKey, upstream))
-				r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				policy := policyFor(route, upstream)
+				last := singleTry || attempt >= policy.maxTries-1
+
+				upstreamBudget := route.RetryBudgetFor(upstream)
+				if upstreamBudget != nil && attempt == 0 {
+					// like the route's, earned by the client request, not its retries
+					upstreamBudget.Deposit()
+				}
+
+				r = r.WithContext(withUpstream(r.Context(), upstream, gen))
 
 				capture := &responseCapture{
 					status: 0,
-					body:   &bytes.Buffer{},
 					header: http.Header{},
 				}
-
 				rw := &responseWriter{
 					ResponseWriter: w,
 					capture:        capture,
+					holdBack: func(status int) bool {
+						if last {
+							// nothing left to try; only failures are replaced by a 502
+							return status >= 500
+						}
+						return isRetryable(retryConfig, status, capture.err)
+					},
 				}
 
-				// retry attempt logged removed
-				next.ServeHTTP(rw, r)
+				if hedging {
+					primary := upstream
+					serveHedged(rw, next, r, bodyBytes, hedgeDelay(retryConfig.Hedge),
+						func() (string, circuitbreaker.Generation, error) {
+							second, gen, err := PickUpstream(r, route, breakers, health, primary)
+							if err != nil {
+								return "", 0, err
+							}
+							// a hedge adds load like a retry does, so it spends the same budgets
+							if !withdrawRetry(route.RetryBudget, route.RetryBudgetFor(second)) {
+								metrics.RecordRetryDenied()
+								releaseUpstream(route, breakers, second, gen)
+								return "", 0, errHedgeDenied
+							}
+							return second, gen, nil
+						},
+						func(status int, err *proxy.ProxyError) bool { return isRetryable(retryConfig, status, err) },
+					)
+				} else {
+					next.ServeHTTP(rw, r)
+				}
+
+				if rw.capture.status == 0 {
+					rw.WriteHeader(http.StatusOK)
+				}
 
-				status := capture.status
-				if status == 0 {
-					status = http.StatusOK
+				if rw.committed {
+					return
 				}
+				lastStatus = rw.capture.status
+				lastHeader = rw.capture.header
+				lastErr = rw.capture.err
 
-				utils.UpdateCircuitBreaker(breakers[upstream], status)
+				if last {
+					break
+				}
 
-				if status < 500 {
-					for k := range w.Header() {
-						w.Header().Del(k)
+				delay := wait.next(attempt, policy.baseDelay)
+				if ra, ok := retryAfter(rw.capture.status, rw.capture.header); ok {
+					if maxBackoff > 0 && ra > maxBackoff {
+						// the upstream wants more patience than the route allows, let the client decide
+						replayRetryLater(w, rw.capture.status, rw.capture.header)
+						return
 					}
-					for k, vals := range capture.header {
-						for _, v := range vals {
-							w.Header().Add(k, v)
-						}
+					if ra > delay {
+						delay = ra
 					}
-					w.WriteHeader(status)
-					w.Write(capture.body.Bytes())
-					return
+				}
+				if deadline, ok := r.Context().Deadline(); ok && time.Until(deadline) < delay {
+					// no budget left for another attempt
+					outOfTime = true
+					break
 				}
 
-				if attempt < maxTries-1 {
-					jitter := time.Duration(rand.Int63n(int64(25 * time.Millisecond)))
-					time.Sleep(baseDelay*(1<<attempt) + jitter)
+				if !withdrawRetry(route.RetryBudget, upstreamBudget) {
+					metrics.RecordRetryDenied()
+					break
+				}
+				metrics.RecordRetry()
+
+				if !sleepCtx(r.Context(), delay) {
+					if errors.Is(r.Context().Err(), context.Canceled) {
+						// client went away, nobody to answer
+						return
+					}
+					break
 				}
 			}
 
+			if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+				gatewayTimeout(w)
+				return
+			}
+			if lastErr == nil && (lastStatus == http.StatusTooManyRequests || lastStatus == http.StatusServiceUnavailable) {
+				// out of tries, time or budget: the upstream's own "come back
+				// later" tells the client more than a 502 or 504 would
+				replayRetryLater(w, lastStatus, lastHeader)
+				return
+			}
+			if outOfTime {
+				gatewayTimeout(w)
+				return
+			}
+			// the route's fallback stands in for the upstreams that failed;
+			// a body that wasn't buffered is gone and can't be sent again
+			if replayable {
+				r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				r.ContentLength = int64(len(bodyBytes))
+				if serveFallback(w, r, route, breakers, health, next) {
+					return
+				}
+			}
+			if lastErr != nil {
+				w.Header().Set(proxy.ErrorHeader, string(lastErr.Kind))
+			}
+			if lastStatus == http.StatusGatewayTimeout {
+				http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+				return
+			}
 			http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		})
 	}
 }
 
+// withUpstream puts the attempt's upstream, and the generation its breaker
+// let it through in, into ctx for the proxy handler.
+func withUpstream(ctx context.Context, upstream string, gen circuitbreaker.Generation) context.Context {
+	ctx = context.WithValue(ctx, configuration.UpstreamCtxKey, upstream)
+	return context.WithValue(ctx, configuration.BreakerGenerationCtxKey, gen)
+}
+
+// gatewayTimeout answers for a request whose total_ms ran out.
+func gatewayTimeout(w http.ResponseWriter) {
+	w.Header().Set(proxy.ErrorHeader, string(proxy.ErrorTimeout))
+	http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+}
+
+// replayRetryLater answers with a held back 429 or 503, keeping its
+// Retry-After. The body was dropped with the attempt.
+func replayRetryLater(w http.ResponseWriter, status int, h http.Header) {
+	if ra := h.Get("Retry-After"); ra != "" {
+		w.Header().Set("Retry-After", ra)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// withdrawRetry takes a retry token from the upstream's and the route's
+// budgets (either may be nil), or from neither. The upstream is checked first
+// since it is the one a storm would hurt.
+func withdrawRetry(route, upstream *retrybudget.Budget) bool {
+	if upstream != nil && !upstream.CanWithdraw() {
+		return false
+	}
+	if route != nil && !route.Withdraw() {
+		return false
+	}
+	return upstream == nil || upstream.Withdraw()
+}
+
+// bufferBody reads the request body into memory so it can be replayed on
+// retries. If the body is larger than limit it is left streamable on r and
+// replayable is false.
+func bufferBody(r *http.Request, limit int64) (body []byte, replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		// put back what was read in front of the unread remainder
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	return buf, true, nil
+}
+
 func (rw *responseWriter) Header() http.Header {
+	if rw.committed {
+		return rw.ResponseWriter.Header()
+	}
 	return rw.capture.header
 }
 
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.capture.status != 0 {
+		return
+	}
+	rw.capture.status = code
+	if rw.holdBack(code) {
+		return
+	}
+
+	dst := rw.ResponseWriter.Header()
+	for k := range dst {
+		dst.Del(k)
+	}
+	for k, vals := range rw.capture.header {
+		for _, v := range vals {
+			dst.Add(k, v)
+		}
+	}
+	rw.ResponseWriter.WriteHeader(code)
+	rw.committed = true
+}
+
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	return rw.capture.body.Write(b)
+	if rw.capture.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.committed {
+		// failed attempt, body is dropped
+		return len(b), nil
+	}
+	return rw.ResponseWriter.Write(b)
 }
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.capture.status = code
+// ReportProxyError records why the gateway answered for the upstream, so
+// holdBack can tell a dial failure from an upstream's own 502.
+func (rw *responseWriter) ReportProxyError(err *proxy.ProxyError) {
+	if rw.capture.status == 0 {
+		rw.capture.err = err
+	}
+}
+
+func (rw *responseWriter) Flush() {
+	if !rw.committed {
+		return
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
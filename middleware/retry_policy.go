@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"FluxGate/configuration"
+	"FluxGate/proxy"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// retry_on conditions
+const (
+	retryOn5xx          = "5xx"           // any 5xx response, from the upstream or the gateway
+	retryOnConnectError = "connect_error" // upstream unreachable or TLS handshake failed
+	retryOnTimeout      = "timeout"       // per-try, connect or response header deadline hit
+	retryOnReset        = "reset"         // connection dropped before a response arrived
+)
+
+var defaultRetryOn = []string{retryOn5xx, retryOnConnectError, retryOnTimeout, retryOnReset}
+
+// retryPolicy is the effective retry behaviour after an attempt on one
+// upstream: the route's settings, overridden by the upstream's own.
+type retryPolicy struct {
+	maxTries  int
+	baseDelay time.Duration
+}
+
+func policyFor(route *configuration.RouteConfig, upstream string) retryPolicy {
+	p := retryPolicy{
+		maxTries:  route.Retry.MaxTries,
+		baseDelay: time.Duration(route.Retry.BaseTimeMs) * time.Millisecond,
+	}
+	if !route.Retry.Enabled {
+		p.maxTries = 1
+	}
+
+	if cfg, ok := route.UpstreamFor(upstream); ok && cfg.RetryEnabled {
+		// "retries" counts retries on top of the first try
+		p.maxTries = cfg.Retries + 1
+		if cfg.BaseTimeMs > 0 {
+			p.baseDelay = time.Duration(cfg.BaseTimeMs) * time.Millisecond
+		}
+	}
+
+	if p.maxTries < 1 {
+		p.maxTries = 1
+	}
+	return p
+}
+
+// retriesPossible reports whether any attempt on the route could be retried.
+func retriesPossible(route *configuration.RouteConfig) bool {
+	if route.Retry.Enabled && route.Retry.MaxTries > 1 {
+		return true
+	}
+	for _, upstream := range route.UpstreamList() {
+		if upstream.RetryEnabled && upstream.Retries > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryable applies the route's retry_on / retryable_status settings to a
+// finished attempt. perr is set when the gateway, not the upstream, produced
+// the status.
+func isRetryable(cfg configuration.RetryConfig, status int, perr *proxy.ProxyError) bool {
+	retryOn := cfg.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+
+	if perr != nil {
+		switch perr.Kind {
+		case proxy.ErrorDial, proxy.ErrorTLS:
+			if slices.Contains(retryOn, retryOnConnectError) {
+				return true
+			}
+		case proxy.ErrorTimeout:
+			if slices.Contains(retryOn, retryOnTimeout) {
+				return true
+			}
+		case proxy.ErrorReset:
+			if slices.Contains(retryOn, retryOnReset) {
+				return true
+			}
+		}
+	}
+
+	switch {
+	case slices.Contains(cfg.RetryableStatus, status):
+		return true
+	case status >= 500 && slices.Contains(retryOn, retryOn5xx):
+		return true
+	}
+	return false
+}
+
+// isIdempotent reports whether replaying r is safe (RFC 9110 section 9.2.2).
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
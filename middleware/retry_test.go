@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"FluxGate/retrybudget"
+	"testing"
+	"time"
+)
+
+func TestWithdrawRetryTakesBothTokensOrNone(t *testing.T) {
+	route := retrybudget.New(0, 0, time.Second) // denies every retry
+	upstream := retrybudget.New(0, 1, time.Second)
+
+	if withdrawRetry(route, upstream) {
+		t.Fatal("route budget should deny the retry")
+	}
+	// the upstream's only token is still there
+	if !upstream.Withdraw() {
+		t.Fatal("upstream token was spent on a denied retry")
+	}
+
+	upstream = retrybudget.New(0, 1, time.Second)
+	if !withdrawRetry(nil, upstream) || withdrawRetry(nil, upstream) {
+		t.Fatal("expected exactly one retry from the upstream budget")
+	}
+}
@@ -0,0 +1,60 @@
+package outlier
+
+import "FluxGate/loadbalancer"
+
+// Balancer hides the servers its detector has ejected from the wrapped
+// balancer: they are left out of Servers() and skipped by NextServer, unless
+// every server is ejected.
+type Balancer struct {
+	loadbalancer.LoadBalancer
+	detector *Detector
+}
+
+func Wrap(lb loadbalancer.LoadBalancer, detector *Detector) *Balancer {
+	return &Balancer{LoadBalancer: lb, detector: detector}
+}
+
+func (b *Balancer) NextServer() (string, error) {
+	// randomised balancers may keep drawing ejected servers, so give them a
+	// few rounds before falling back to the first server still in the pool
+	for i := 0; i < 2*len(b.LoadBalancer.Servers()); i++ {
+		server, err := b.LoadBalancer.NextServer()
+		if err != nil {
+			return "", err
+		}
+		if !b.detector.Ejected(server) {
+			return server, nil
+		}
+		b.LoadBalancer.Done(server)
+	}
+
+	if servers := b.Servers(); len(servers) > 0 {
+		loadbalancer.Acquire(b.LoadBalancer, servers[0])
+		return servers[0], nil
+	}
+	// everything is ejected: an ejected server beats failing every request
+	return b.LoadBalancer.NextServer()
+}
+
+func (b *Balancer) Acquire(server string) {
+	loadbalancer.Acquire(b.LoadBalancer, server)
+}
+
+func (b *Balancer) Servers() []string {
+	all := b.LoadBalancer.Servers()
+	out := make([]string, 0, len(all))
+	for _, s := range all {
+		if !b.detector.Ejected(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (b *Balancer) Unwrap() loadbalancer.LoadBalancer {
+	return b.LoadBalancer
+}
+
+func (b *Balancer) Detector() *Detector {
+	return b.detector
+}
@@ -0,0 +1,272 @@
+package outlier
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConsecutive5xx     = 5
+	defaultInterval           = 10 * time.Second
+	defaultBaseEjection       = 30 * time.Second
+	defaultMaxEjection        = 300 * time.Second
+	defaultMaxEjectionPercent = 10
+	defaultSuccessRateFactor  = 1.9
+	defaultMinHosts           = 5
+	defaultMinRequests        = 100
+)
+
+// Options tunes a Detector; zero values pick the defaults above.
+type Options struct {
+	Consecutive5xx     int
+	Interval           time.Duration // how often success rate and latency are compared
+	BaseEjection       time.Duration // doubled on every repeat ejection...
+	MaxEjection        time.Duration // ...up to this
+	MaxEjectionPercent int           // at least one server can always be ejected
+
+	SuccessRateFactor float64 // eject below mean - factor * stdev
+	LatencyFactor     float64 // eject above factor * median mean latency, 0 = off
+	MinHosts          int     // servers with enough requests needed to compare them
+	MinRequests       int64   // requests in the interval for a server to be compared
+}
+
+// Detector tracks how each server of a pool behaves and ejects the ones that
+// stand out: too many 5xx in a row, or a success rate / latency far from the
+// rest of the pool over the last interval.
+type Detector struct {
+	opts    Options
+	servers []string
+	hosts   map[string]*hostStats
+	now     func() time.Time
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+type hostStats struct {
+	consecutive int
+
+	// current interval
+	requests   int64
+	failures   int64
+	latencySum time.Duration
+
+	ejectedUntil time.Time
+	ejections    int // drives the ejection time; decays while well behaved
+	ejectedNow   bool
+}
+
+func New(servers []string, opts Options) *Detector {
+	if opts.Consecutive5xx <= 0 {
+		opts.Consecutive5xx = defaultConsecutive5xx
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.BaseEjection <= 0 {
+		opts.BaseEjection = defaultBaseEjection
+	}
+	if opts.MaxEjection <= 0 {
+		opts.MaxEjection = defaultMaxEjection
+	}
+	if opts.MaxEjectionPercent <= 0 {
+		opts.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	if opts.SuccessRateFactor <= 0 {
+		opts.SuccessRateFactor = defaultSuccessRateFactor
+	}
+	if opts.MinHosts <= 0 {
+		opts.MinHosts = defaultMinHosts
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = defaultMinRequests
+	}
+
+	d := &Detector{
+		opts:    opts,
+		servers: servers,
+		hosts:   make(map[string]*hostStats, len(servers)),
+		now:     time.Now,
+	}
+	for _, s := range servers {
+		d.hosts[s] = &hostStats{}
+	}
+	d.lastSweep = d.now()
+	return d
+}
+
+// Record accounts for a finished request to server.
+func (d *Detector) Record(server string, failed bool, rtt time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.hosts[server]
+	if !ok {
+		return
+	}
+	now := d.now()
+	d.maybeSweep(now)
+
+	h.requests++
+	h.latencySum += rtt
+	if !failed {
+		h.consecutive = 0
+		return
+	}
+	h.failures++
+	h.consecutive++
+	if h.consecutive >= d.opts.Consecutive5xx {
+		h.consecutive = 0
+		d.eject(h, now)
+	}
+}
+
+// Ejected reports whether server is currently out of the pool.
+func (d *Detector) Ejected(server string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.hosts[server]
+	if !ok {
+		return false
+	}
+	now := d.now()
+	d.maybeSweep(now)
+	return now.Before(h.ejectedUntil)
+}
+
+func (d *Detector) eject(h *hostStats, now time.Time) {
+	if now.Before(h.ejectedUntil) {
+		return
+	}
+
+	limit := len(d.servers) * d.opts.MaxEjectionPercent / 100
+	if limit < 1 && len(d.servers) > 1 {
+		limit = 1
+	}
+	ejected := 0
+	for _, other := range d.hosts {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if ejected >= limit {
+		return
+	}
+
+	// base, 2x base, 4x base... up to the max
+	dur := d.opts.BaseEjection << min(h.ejections, 30)
+	if dur <= 0 || dur > d.opts.MaxEjection {
+		dur = d.opts.MaxEjection
+	}
+	h.ejectedUntil = now.Add(dur)
+	h.ejections++
+	h.ejectedNow = true
+}
+
+// maybeSweep runs the interval analysis once the interval has passed.
+func (d *Detector) maybeSweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.opts.Interval {
+		return
+	}
+	d.lastSweep = now
+
+	d.sweepSuccessRate(now)
+	if d.opts.LatencyFactor > 0 {
+		d.sweepLatency(now)
+	}
+
+	for _, h := range d.hosts {
+		// a quiet interval earns back part of the ejection penalty
+		if !h.ejectedNow && !now.Before(h.ejectedUntil) && h.ejections > 0 {
+			h.ejections--
+		}
+		h.ejectedNow = false
+		h.requests, h.failures, h.latencySum = 0, 0, 0
+	}
+}
+
+// candidates returns the servers in the pool with enough traffic in the
+// interval to be compared, or nil if there are too few of them.
+func (d *Detector) candidates(now time.Time) []*hostStats {
+	var out []*hostStats
+	for _, h := range d.hosts {
+		if h.requests >= d.opts.MinRequests && !now.Before(h.ejectedUntil) {
+			out = append(out, h)
+		}
+	}
+	if len(out) < d.opts.MinHosts {
+		return nil
+	}
+	return out
+}
+
+func (d *Detector) sweepSuccessRate(now time.Time) {
+	hosts := d.candidates(now)
+	if hosts == nil {
+		return
+	}
+
+	rates := make([]float64, len(hosts))
+	var mean float64
+	for i, h := range hosts {
+		rates[i] = float64(h.requests-h.failures) / float64(h.requests)
+		mean += rates[i]
+	}
+	mean /= float64(len(hosts))
+
+	var variance float64
+	for _, r := range rates {
+		variance += (r - mean) * (r - mean)
+	}
+	stdev := math.Sqrt(variance / float64(len(hosts)))
+
+	threshold := mean - d.opts.SuccessRateFactor*stdev
+	for i, h := range hosts {
+		if rates[i] < threshold {
+			d.eject(h, now)
+		}
+	}
+}
+
+func (d *Detector) sweepLatency(now time.Time) {
+	hosts := d.candidates(now)
+	if hosts == nil {
+		return
+	}
+
+	means := make([]time.Duration, len(hosts))
+	for i, h := range hosts {
+		means[i] = h.latencySum / time.Duration(h.requests)
+	}
+	sorted := slices.Clone(means)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+
+	limit := time.Duration(float64(median) * d.opts.LatencyFactor)
+	for i, h := range hosts {
+		if means[i] > limit {
+			d.eject(h, now)
+		}
+	}
+}
+
+// SetServers updates the pool the detector watches. Servers that stay keep
+// their history; new ones start clean.
+func (d *Detector) SetServers(servers []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hosts := make(map[string]*hostStats, len(servers))
+	for _, s := range servers {
+		if h, ok := d.hosts[s]; ok {
+			hosts[s] = h
+		} else {
+			hosts[s] = &hostStats{}
+		}
+	}
+	d.servers = servers
+	d.hosts = hosts
+}
@@ -0,0 +1,178 @@
+package outlier
+
+import (
+	"FluxGate/loadbalancer"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestDetector(servers []string, opts Options) (*Detector, *clock) {
+	c := &clock{t: time.Unix(1000, 0)}
+	d := New(servers, opts)
+	d.now = c.now
+	d.lastSweep = c.t
+	return d, c
+}
+
+func TestConsecutiveFailuresEjectWithGrowingTime(t *testing.T) {
+	d, c := newTestDetector([]string{"a", "b", "c"}, Options{
+		Consecutive5xx: 3,
+		BaseEjection:   time.Second,
+		Interval:       time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		d.Record("a", true, time.Millisecond)
+	}
+	if !d.Ejected("a") {
+		t.Fatal("a should be ejected after 3 consecutive failures")
+	}
+	c.t = c.t.Add(1100 * time.Millisecond)
+	if d.Ejected("a") {
+		t.Fatal("first ejection should last the base time")
+	}
+
+	// second ejection lasts twice as long
+	for i := 0; i < 3; i++ {
+		d.Record("a", true, time.Millisecond)
+	}
+	c.t = c.t.Add(1500 * time.Millisecond)
+	if !d.Ejected("a") {
+		t.Fatal("repeat ejection should last 2x base")
+	}
+}
+
+func TestSuccessBreaksTheStreak(t *testing.T) {
+	d, _ := newTestDetector([]string{"a", "b"}, Options{Consecutive5xx: 2})
+
+	d.Record("a", true, 0)
+	d.Record("a", false, 0)
+	d.Record("a", true, 0)
+	if d.Ejected("a") {
+		t.Fatal("failures weren't consecutive")
+	}
+}
+
+func TestMaxEjectionPercentKeepsPoolServing(t *testing.T) {
+	d, _ := newTestDetector([]string{"a", "b", "c", "d"}, Options{Consecutive5xx: 1, MaxEjectionPercent: 50})
+
+	for _, s := range []string{"a", "b", "c", "d"} {
+		d.Record(s, true, 0)
+	}
+	ejected := 0
+	for _, s := range []string{"a", "b", "c", "d"} {
+		if d.Ejected(s) {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("expected 50%% (2) ejected, got %d", ejected)
+	}
+}
+
+func TestSuccessRateOutlierEjectedAtInterval(t *testing.T) {
+	servers := []string{"a", "b", "c", "d", "e"}
+	d, c := newTestDetector(servers, Options{
+		Consecutive5xx: 1000,
+		Interval:       10 * time.Second,
+		MinHosts:       5,
+		MinRequests:    10,
+	})
+
+	for i := 0; i < 20; i++ {
+		for _, s := range servers {
+			// e fails half its requests, interleaved so no streak builds up
+			d.Record(s, s == "e" && i%2 == 0, time.Millisecond)
+		}
+	}
+	if d.Ejected("e") {
+		t.Fatal("success rate is only judged at the end of an interval")
+	}
+
+	c.t = c.t.Add(11 * time.Second)
+	if !d.Ejected("e") {
+		t.Fatal("e should be ejected for its success rate")
+	}
+	if d.Ejected("a") {
+		t.Fatal("healthy server ejected")
+	}
+}
+
+func TestLatencyOutlierEjected(t *testing.T) {
+	servers := []string{"a", "b", "c", "d", "e"}
+	d, c := newTestDetector(servers, Options{
+		Interval:           10 * time.Second,
+		LatencyFactor:      3,
+		MinHosts:           5,
+		MinRequests:        10,
+		MaxEjectionPercent: 20,
+	})
+
+	for i := 0; i < 10; i++ {
+		for _, s := range servers {
+			rtt := 10 * time.Millisecond
+			if s == "c" {
+				rtt = 800 * time.Millisecond
+			}
+			d.Record(s, false, rtt)
+		}
+	}
+	c.t = c.t.Add(11 * time.Second)
+	if !d.Ejected("c") {
+		t.Fatal("c should be ejected for its latency")
+	}
+}
+
+func TestBalancerHidesEjectedServers(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	d, _ := newTestDetector(servers, Options{Consecutive5xx: 1})
+	b := Wrap(loadbalancer.NewRoundRobin(servers), d)
+
+	d.Record("b", true, 0)
+
+	if got := fmt.Sprint(b.Servers()); got != "[a c]" {
+		t.Fatalf("Servers() = %s", got)
+	}
+	for i := 0; i < 6; i++ {
+		s, err := b.NextServer()
+		if err != nil || s == "b" {
+			t.Fatalf("pick %d: %s, %v", i, s, err)
+		}
+	}
+}
+
+func TestBalancerWithEveryServerEjectedStillCounts(t *testing.T) {
+	servers := []string{"a", "b"}
+	d, _ := newTestDetector(servers, Options{Consecutive5xx: 1, MaxEjectionPercent: 100})
+	pool := loadbalancer.NewPool("least_conn", servers, nil)
+	b := Wrap(pool, d)
+
+	d.Record("a", true, 0)
+	d.Record("b", true, 0)
+	if len(b.Servers()) != 0 {
+		t.Fatalf("expected every server ejected, got %v", b.Servers())
+	}
+
+	s, err := b.NextServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight := func() (n int) {
+		for _, m := range pool.Members() {
+			n += m.InFlight
+		}
+		return n
+	}
+	if inFlight() != 1 {
+		t.Fatalf("pick of %s not counted in flight: %+v", s, pool.Members())
+	}
+	b.Done(s)
+	if inFlight() != 0 {
+		t.Fatalf("count left behind: %+v", pool.Members())
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrorKind classifies why an exchange with an upstream failed before it
+// produced a response.
+type ErrorKind string
+
+const (
+	ErrorDial    ErrorKind = "dial"    // connection refused, unreachable, DNS failure
+	ErrorTimeout ErrorKind = "timeout" // per-try, connect or response header deadline
+	ErrorTLS     ErrorKind = "tls"     // handshake or certificate failure
+	ErrorReset   ErrorKind = "reset"   // connection reset or closed before the response
+	ErrorOther   ErrorKind = "other"
+)
+
+// ErrorHeader tells the client the gateway, not the upstream, produced the error response.
+const ErrorHeader = "X-Gateway-Error"
+
+// ProxyError is a transport failure talking to an upstream, as opposed to an
+// error status the upstream itself returned.
+type ProxyError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ProxyError) Error() string {
+	return "upstream " + string(e.Kind) + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Status is the status the gateway answers with for the error.
+func (e *ProxyError) Status() int {
+	if e.Kind == ErrorTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// ErrorReporter is implemented by response writers that want the typed error
+// behind a gateway-generated 502 / 504 rather than just its status, such as
+// the retry middleware's.
+type ErrorReporter interface {
+	ReportProxyError(err *ProxyError)
+}
+
+// classifyError wraps a transport error from an exchange run under ctx.
+func classifyError(ctx context.Context, err error) *ProxyError {
+	kind := ErrorOther
+
+	var (
+		opErr     *net.OpError
+		dnsErr    *net.DNSError
+		recordErr tls.RecordHeaderError
+		alertErr  tls.AlertError
+		verifyErr *tls.CertificateVerificationError
+		authErr   x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		certErr   x509.CertificateInvalidError
+	)
+	switch {
+	case isTimeout(ctx, err):
+		kind = ErrorTimeout
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &certErr):
+		kind = ErrorTLS
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH), errors.As(err, &opErr) && opErr.Op == "dial":
+		kind = ErrorDial
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		kind = ErrorReset
+	}
+	return &ProxyError{Kind: kind, Err: err}
+}
+
+// writeProxyError answers the client for a failed exchange and hands the
+// typed error to w if it wants it.
+func writeProxyError(w http.ResponseWriter, perr *ProxyError) {
+	if rep, ok := w.(ErrorReporter); ok {
+		rep.ReportProxyError(perr)
+	}
+	w.Header().Set(ErrorHeader, string(perr.Kind))
+	status := perr.Status()
+	http.Error(w, http.StatusText(status), status)
+}
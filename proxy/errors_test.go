@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReverseProxyReportsDialError(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	rr := httptest.NewRecorder()
+	out := ReverseProxy(rr, httptest.NewRequest(http.MethodGet, "/", nil), dead.URL, Options{Timeout: time.Second})
+	if out.Err == nil || out.Err.Kind != ErrorDial {
+		t.Fatalf("expected dial error, got %+v", out.Err)
+	}
+	if rr.Code != http.StatusBadGateway || rr.Header().Get(ErrorHeader) != "dial" {
+		t.Fatalf("got %d %q", rr.Code, rr.Header().Get(ErrorHeader))
+	}
+}
+
+func TestReverseProxyReportsReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// read the request, then hang up without answering
+			conn.Read(make([]byte, 1024))
+			conn.Close()
+		}
+	}()
+
+	out := ReverseProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil),
+		"http://"+ln.Addr().String(), Options{Timeout: time.Second})
+	if out.Err == nil || out.Err.Kind != ErrorReset {
+		t.Fatalf("expected reset, got %+v", out.Err)
+	}
+}
+
+func TestReverseProxyReportsTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	rr := httptest.NewRecorder()
+	out := ReverseProxy(rr, httptest.NewRequest(http.MethodGet, "/", nil), slow.URL, Options{Timeout: 50 * time.Millisecond})
+	if out.Err == nil || out.Err.Kind != ErrorTimeout || rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected timeout 504, got %d %+v", rr.Code, out.Err)
+	}
+}
+
+type reporter struct {
+	*httptest.ResponseRecorder
+	got *ProxyError
+}
+
+func (r *reporter) ReportProxyError(err *ProxyError) { r.got = err }
+
+func TestReverseProxyHandsErrorToReporter(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	w := &reporter{ResponseRecorder: httptest.NewRecorder()}
+	ReverseProxy(w, httptest.NewRequest(http.MethodGet, "/", nil), dead.URL, Options{Timeout: time.Second})
+	if w.got == nil || w.got.Kind != ErrorDial {
+		t.Fatalf("reporter not told about the dial error: %+v", w.got)
+	}
+}
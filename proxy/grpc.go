@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes the gateway cares about
+const (
+	grpcStatusOK               = 0
+	grpcStatusDeadlineExceeded = 4
+	grpcStatusUnavailable      = 14
+)
+
+// IsGRPCRequest reports whether r is a gRPC call (application/grpc, +proto, +json...).
+func IsGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// isGRPCResponse reports whether resp is a gRPC response.
+func isGRPCResponse(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus extracts grpc-status from a response. It is normally sent as a
+// trailer, but trailers-only responses (errors) carry it in the headers.
+// It returns -1 if the response has no gRPC status.
+func grpcStatus(resp *http.Response) int {
+	v := resp.Trailer.Get("Grpc-Status")
+	if v == "" {
+		v = resp.Header.Get("Grpc-Status")
+	}
+	if v == "" {
+		return -1
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return -1
+	}
+	return code
+}
+
+// writeGRPCDeadlineExceeded ends a gRPC call that ran out of time before the
+// upstream answered with a trailers-only DEADLINE_EXCEEDED response.
+func writeGRPCDeadlineExceeded(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusDeadlineExceeded))
+	w.Header().Set("Grpc-Message", "deadline exceeded")
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseGRPCTimeout decodes a grpc-timeout header value: at most 8 digits,
+// making a positive number, followed by a unit (H, M, S, m, u, n).
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
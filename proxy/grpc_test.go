@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"1H", time.Hour, true},
+		{"5S", 5 * time.Second, true},
+		{"250m", 250 * time.Millisecond, true},
+		{"100u", 100 * time.Microsecond, true},
+		{"", 0, false},
+		{"10", 0, false},
+		{"0S", 0, false},
+		{"5x", 0, false},
+		{"123456789S", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseGRPCTimeout(tt.in)
+		if ok != tt.ok || got != tt.want {
+			t.Fatalf("parseGRPCTimeout(%q) = %v,%v want %v,%v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func grpcRequest(t *testing.T) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/pkg.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x00"))
+	r.Header.Set("Content-Type", "application/grpc")
+	return r
+}
+
+func TestReverseProxyKeepsGRPCDeadlineOnceHeadersArrive(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// stall mid-body
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	outcome := ReverseProxy(rr, grpcRequest(t), srv.URL, Options{Timeout: 100 * time.Millisecond, Protocol: "h2c"})
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stalled gRPC body held the call for %v", elapsed)
+	}
+	if outcome.Err == nil || outcome.Err.Kind != ErrorTimeout || !outcome.Failed() {
+		t.Fatalf("expected a timeout outcome, got %+v", outcome)
+	}
+	if st := rr.Result().Trailer.Get("Grpc-Status"); st != "4" {
+		t.Fatalf("expected grpc-status DEADLINE_EXCEEDED, got %q", st)
+	}
+}
+
+func TestReverseProxyGRPCOverTLS(t *testing.T) {
+	var gotProto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotProto = r.Proto
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// trust the test server's certificate for the duration of the test
+	saved := transport.TLSClientConfig
+	transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	clients.Clear()
+	defer func() {
+		transport.TLSClientConfig = saved
+		clients.Clear()
+	}()
+
+	rr := httptest.NewRecorder()
+	outcome := ReverseProxy(rr, grpcRequest(t), srv.URL, Options{Timeout: 2 * time.Second, Protocol: "h2"})
+
+	if outcome.Err != nil || outcome.GRPCStatus != 0 {
+		t.Fatalf("unexpected outcome %+v", outcome)
+	}
+	if gotProto != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2 over TLS, got %s", gotProto)
+	}
+	if st := rr.Result().Trailer.Get("Grpc-Status"); st != "0" {
+		t.Fatalf("expected grpc-status trailer 0, got %q", st)
+	}
+}
+
+func TestProxyHandlerGRPCTimeoutCannotExceedPerTry(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	route := &configuration.RouteConfig{Timeouts: configuration.TimeoutConfig{PerTryMs: 100}}
+	r := grpcRequest(t)
+	r.Header.Set("Grpc-Timeout", "1H")
+	ctx := context.WithValue(r.Context(), configuration.UpstreamCtxKey, srv.URL)
+	ctx = context.WithValue(ctx, configuration.RouteCtxKey, route)
+
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	ProxyHandler(nil).ServeHTTP(rr, r.WithContext(ctx))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("client Grpc-Timeout lifted per_try_ms: call took %v", elapsed)
+	}
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rr.Code)
+	}
+}
+
+func TestProxyHandlerClientDeadlinesDontTripBreaker(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	route := &configuration.RouteConfig{}
+	breakers := circuitbreaker.NewSet()
+	breakers.Sync(map[circuitbreaker.Key]configuration.CircuitBreakerConfig{
+		circuitbreaker.KeyFor(route, srv.URL): {Enabled: true, FailureThreshold: 2, OpenSeconds: 60},
+	})
+
+	for i := 0; i < 5; i++ {
+		r := grpcRequest(t)
+		r.Header.Set("Grpc-Timeout", "20m")
+		ctx := context.WithValue(r.Context(), configuration.UpstreamCtxKey, srv.URL)
+		ctx = context.WithValue(ctx, configuration.RouteCtxKey, route)
+
+		rr := httptest.NewRecorder()
+		ProxyHandler(breakers).ServeHTTP(rr, r.WithContext(ctx))
+		if rr.Code != http.StatusOK || rr.Header().Get("Grpc-Status") != "4" {
+			t.Fatalf("expected DEADLINE_EXCEEDED, got %d grpc-status %q", rr.Code, rr.Header().Get("Grpc-Status"))
+		}
+	}
+	if st := breakers.Get(route, srv.URL).State(); st != circuitbreaker.StateClosed {
+		t.Fatalf("client deadlines opened the breaker: %s", st)
+	}
+}
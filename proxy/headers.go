@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"FluxGate/utils"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are connection-specific and must not be forwarded by proxies
+// (RFC 7230 section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the standard hop-by-hop headers and any header
+// nominated by the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// copyRequestHeaders copies the client's end-to-end headers onto the upstream
+// request and adds the forwarding headers.
+func copyRequestHeaders(req *http.Request, r *http.Request) {
+	for k, v := range r.Header {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	removeHopHeaders(req.Header)
+
+	// "TE: trailers" is hop-by-hop but gRPC upstreams require it
+	for _, v := range r.Header.Values("Te") {
+		if strings.Contains(strings.ToLower(v), "trailers") {
+			req.Header.Set("Te", "trailers")
+			break
+		}
+	}
+	if IsUpgradeRequest(r) {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+
+	setForwardingHeaders(req.Header, r, utils.TrustedProxiesOf(r))
+}
+
+// setForwardingHeaders appends this hop to X-Forwarded-For and Forwarded.
+// Incoming forwarding headers are only kept when the peer is a trusted proxy;
+// otherwise the chain starts here.
+func setForwardingHeaders(h http.Header, r *http.Request, proxies utils.TrustedProxies) {
+	peer := utils.RemoteHost(r)
+	trusted := proxies.Contains(peer)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if !trusted {
+		h.Del("X-Forwarded-For")
+		h.Del("X-Forwarded-Host")
+		h.Del("X-Forwarded-Proto")
+		h.Del("Forwarded")
+	}
+
+	if prior := strings.Join(h.Values("X-Forwarded-For"), ", "); prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+peer)
+	} else {
+		h.Set("X-Forwarded-For", peer)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+
+	// RFC 7239
+	element := "for=" + forwardedNode(peer) + ";host=" + quoteForwarded(r.Host) + ";proto=" + proto
+	if prior := strings.Join(h.Values("Forwarded"), ", "); prior != "" {
+		h.Set("Forwarded", prior+", "+element)
+	} else {
+		h.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats an address for the Forwarded header; IPv6 addresses
+// must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return `"[` + ip + `]"`
+	}
+	return quoteForwarded(ip)
+}
+
+func quoteForwarded(v string) string {
+	if strings.ContainsAny(v, `:[]";, `) {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
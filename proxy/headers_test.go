@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"FluxGate/configuration"
+	"FluxGate/utils"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCopyRequestHeadersStripsHopByHop(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "keep-alive, X-Secret")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Proxy-Authorization", "Basic abc")
+	r.Header.Set("X-Secret", "1")
+	r.Header.Set("Te", "trailers")
+	r.Header.Set("X-Request-ID", "42")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://upstream", nil)
+	copyRequestHeaders(req, r)
+
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Authorization", "X-Secret", "Upgrade"} {
+		if v := req.Header.Get(h); v != "" {
+			t.Fatalf("expected %s to be stripped, got %q", h, v)
+		}
+	}
+	if v := req.Header.Get("Te"); v != "trailers" {
+		t.Fatalf("expected TE: trailers to survive, got %q", v)
+	}
+	if v := req.Header.Get("X-Request-ID"); v != "42" {
+		t.Fatalf("expected end-to-end header to be kept, got %q", v)
+	}
+}
+
+func TestForwardingHeadersHonourTrustedProxies(t *testing.T) {
+	trusted, err := utils.ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("parse trusted proxies: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		wantXFF       string
+		wantForwarded string
+	}{
+		{"trusted peer appends", "10.1.2.3:5000", "203.0.113.7, 10.1.2.3", "for=203.0.113.7, for=10.1.2.3;host=gw.example;proto=http"},
+		{"untrusted peer resets", "198.51.100.9:5000", "198.51.100.9", "for=198.51.100.9;host=gw.example;proto=http"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://gw.example/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", "203.0.113.7")
+			r.Header.Set("Forwarded", "for=203.0.113.7")
+			r = r.WithContext(context.WithValue(r.Context(), configuration.TrustedProxiesCtxKey, trusted))
+
+			req, _ := http.NewRequest(http.MethodGet, "http://upstream", nil)
+			copyRequestHeaders(req, r)
+
+			if got := req.Header.Get("X-Forwarded-For"); got != tt.wantXFF {
+				t.Fatalf("X-Forwarded-For = %q want %q", got, tt.wantXFF)
+			}
+			if got := req.Header.Get("Forwarded"); got != tt.wantForwarded {
+				t.Fatalf("Forwarded = %q want %q", got, tt.wantForwarded)
+			}
+			if got := req.Header.Get("X-Forwarded-Proto"); got != "http" {
+				t.Fatalf("X-Forwarded-Proto = %q want http", got)
+			}
+		})
+	}
+}
+
+func TestWriteResponseStripsHopByHop(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Connection":   {"X-Internal"},
+			"X-Internal":   {"1"},
+			"Keep-Alive":   {"timeout=5"},
+			"Content-Type": {"text/plain"},
+		},
+		Body: http.NoBody,
+	}
+	rr := httptest.NewRecorder()
+	writeResponse(rr, resp, false)
+
+	for _, h := range []string{"Connection", "X-Internal", "Keep-Alive"} {
+		if v := rr.Header().Get(h); v != "" {
+			t.Fatalf("expected %s to be stripped from the response, got %q", h, v)
+		}
+	}
+	if rr.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("expected Content-Type to be forwarded")
+	}
+}
@@ -3,14 +3,91 @@ package proxy
 import (
 	"FluxGate/circuitbreaker"
 	"FluxGate/configuration"
+	"FluxGate/loadbalancer"
+	metrics "FluxGate/matrics"
 	"net/http"
 	"time"
 )
 
-func ProxyHandler(breakers map[string]*circuitbreaker.CircuitBreaker) http.Handler {
+const defaultTryTimeout = 10 * time.Second
+
+// ProxyHandler forwards the request to the upstream picked into the request
+// context and feeds the result back into that upstream's circuit breaker.
+func ProxyHandler(breakers *circuitbreaker.Set) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		upstream := r.Context().Value(configuration.UpstreamCtxKey).(string)
-		timeout := 10 * time.Second
-		ReverseProxy(w, r, upstream, timeout)
+		gen, _ := r.Context().Value(configuration.BreakerGenerationCtxKey).(circuitbreaker.Generation)
+		opts := Options{Timeout: defaultTryTimeout}
+
+		route, ok := r.Context().Value(configuration.RouteCtxKey).(*configuration.RouteConfig)
+		if ok {
+			if route.LoadBalancer != nil {
+				// lets least_conn / least_request balancers count the request as finished
+				defer route.LoadBalancer.Done(upstream)
+			}
+			setStickyCookie(w, r, route, upstream)
+			timeouts := route.Timeouts
+			if cfg, ok := route.UpstreamFor(upstream); ok {
+				opts.Protocol = cfg.Protocol
+				timeouts = timeouts.Merge(cfg.Timeouts)
+			}
+			applyTimeouts(&opts, timeouts)
+		}
+
+		// a gRPC client's deadline becomes the proxy deadline, but only when it
+		// is shorter: a client can't lift the route's own per-try timeout
+		if t, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok && (t < opts.Timeout || opts.Timeout == 0) {
+			opts.Timeout = t
+			opts.ClientDeadline = true
+		}
+
+		start := time.Now()
+		outcome := ReverseProxy(w, r, upstream, opts)
+		if outcome.Canceled {
+			// says nothing about the upstream (client gone, or its own gRPC
+			// deadline passed), but frees a half-open trial
+			if cb := breakers.Get(route, upstream); cb != nil {
+				cb.Cancel(gen)
+			}
+			return
+		}
+		rtt := time.Since(start)
+		report(r, upstream, rtt, outcome, opts.Timeout)
+		if outcome.Err != nil {
+			metrics.RecordUpstreamError(string(outcome.Err.Kind))
+		}
+
+		if cb := breakers.Get(route, upstream); cb != nil {
+			cb.Record(gen, outcome.Failed(), rtt)
+		}
 	})
 }
+
+func applyTimeouts(opts *Options, t configuration.TimeoutConfig) {
+	if t.PerTryMs > 0 {
+		opts.Timeout = time.Duration(t.PerTryMs) * time.Millisecond
+	}
+	opts.ConnectTimeout = time.Duration(t.ConnectMs) * time.Millisecond
+	opts.TLSHandshakeTimeout = time.Duration(t.TLSHandshakeMs) * time.Millisecond
+	opts.ResponseHeaderTimeout = time.Duration(t.ResponseHeaderMs) * time.Millisecond
+}
+
+// report feeds the route's latency-aware balancer and outlier detector. An
+// exchange that failed without a response counts as taking the full per-try
+// timeout, so a server refusing connections quickly doesn't look fast.
+func report(r *http.Request, upstream string, rtt time.Duration, outcome Outcome, timeout time.Duration) {
+	route, ok := r.Context().Value(configuration.RouteCtxKey).(*configuration.RouteConfig)
+	if !ok {
+		return
+	}
+	if outcome.Err != nil && rtt < timeout {
+		rtt = timeout
+	}
+
+	if obs, ok := loadbalancer.As[loadbalancer.LatencyObserver](route.LoadBalancer); ok {
+		obs.Observe(upstream, rtt)
+	}
+	if route.OutlierDetector != nil {
+		route.OutlierDetector.Record(upstream, outcome.Failed(), rtt)
+	}
+}
@@ -1,14 +1,19 @@
 package proxy
 
 import (
-	"bytes"
+	"FluxGate/configuration"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// transport is the template every upstream client's transport is cloned from.
 var transport = &http.Transport{
 	Proxy:                 http.ProxyFromEnvironment,
 	MaxIdleConns:          100,
@@ -17,75 +22,221 @@ var transport = &http.Transport{
 	ExpectContinueTimeout: 1 * time.Second,
 }
 
-var httpClient = &http.Client{
-	Transport: transport,
-	Timeout:   0, // context controls timeout
+// transportKey identifies a transport tuned for one protocol / timeout combination.
+type transportKey struct {
+	protocol       string
+	connect        time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+}
+
+// clients caches one http.Client per transportKey so connections are pooled
+// across requests to upstreams sharing the same settings.
+var clients sync.Map // transportKey -> *http.Client
+
+func clientFor(opts Options) *http.Client {
+	key := transportKey{
+		protocol:       opts.Protocol,
+		connect:        opts.ConnectTimeout,
+		tlsHandshake:   opts.TLSHandshakeTimeout,
+		responseHeader: opts.ResponseHeaderTimeout,
+	}
+	if c, ok := clients.Load(key); ok {
+		return c.(*http.Client)
+	}
+
+	t := transport.Clone()
+	switch opts.Protocol {
+	case "h2":
+		// negotiate HTTP/2 over TLS via ALPN, falling back to HTTP/1.1
+		t.ForceAttemptHTTP2 = true
+	case "h2c":
+		// HTTP/2 with prior knowledge over cleartext, as gRPC services without TLS expect
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if key.connect > 0 {
+		t.DialContext = (&net.Dialer{Timeout: key.connect, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if key.tlsHandshake > 0 {
+		t.TLSHandshakeTimeout = key.tlsHandshake
+	}
+	if key.responseHeader > 0 {
+		t.ResponseHeaderTimeout = key.responseHeader
+	}
+
+	c, _ := clients.LoadOrStore(key, &http.Client{
+		Transport: t,
+		Timeout:   0, // context controls timeout
+	})
+	return c.(*http.Client)
+}
+
+// Options tunes a single upstream exchange.
+type Options struct {
+	Timeout  time.Duration // per-try deadline
+	Protocol string        // see configuration.UpstreamConfig.Protocol
+
+	// Timeout is the client's own gRPC deadline, shorter than the route's;
+	// running out of it says nothing about the upstream
+	ClientDeadline bool
+
+	// zero values keep the transport defaults
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// Outcome summarises an upstream exchange for health accounting.
+type Outcome struct {
+	Status     int         // HTTP status written to the client
+	GRPCStatus int         // -1 if the response is not gRPC
+	Canceled   bool        // the caller gave up (client gone, hedge lost); says nothing about the upstream
+	Err        *ProxyError // set when no response came back from the upstream
+}
+
+// Failed reports whether the exchange counts against the upstream's health.
+func (o Outcome) Failed() bool {
+	return o.Err != nil || o.Status >= 500 || o.GRPCStatus == grpcStatusUnavailable
 }
 
 func ReverseProxy(
 	w http.ResponseWriter,
 	r *http.Request,
 	upstreamURL string,
-	timeout time.Duration,
-) {
-	// read body
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-	r.Body.Close()
+	opts Options,
+) Outcome {
+	// the deadline covers the whole exchange, except for event streams where
+	// it only applies until the response headers arrive; a gRPC call's
+	// deadline always covers the whole call, streamed or not
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	deadline := time.AfterFunc(opts.Timeout, func() { cancel(context.DeadlineExceeded) })
+	defer deadline.Stop()
 
-	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	target := upstreamURL
+	if IsGRPCRequest(r) {
+		// gRPC routes on the method path, so it must reach the upstream
+		target = strings.TrimSuffix(upstreamURL, "/") + r.URL.Path
+	}
 
-	// recreate request
-	req, err := http.NewRequestWithContext(
-		ctx,
-		r.Method,
-		upstreamURL,
-		io.NopCloser(bytes.NewReader(bodyBytes)),
-	)
+	// recreate request, streaming the body straight through to the upstream
+	req, err := http.NewRequestWithContext(ctx, r.Method, target, r.Body)
 	if err != nil {
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
+		perr := &ProxyError{Kind: ErrorOther, Err: err}
+		writeProxyError(w, perr)
+		return Outcome{Status: perr.Status(), GRPCStatus: -1, Err: perr}
 	}
-
-	// copy headers
-	for k, v := range r.Header {
-		for _, vv := range v {
-			req.Header.Add(k, vv)
-		}
+	req.ContentLength = r.ContentLength
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
 	}
 
-	// forwarding headers
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		host = r.RemoteAddr
-	}
-	req.Header.Set("X-Forwarded-For", host)
-	req.Header.Set("X-Forwarded-Host", r.Host)
-	req.Header.Set("X-Forwarded-Proto", r.URL.Scheme)
+	copyRequestHeaders(req, r)
 
-	resp, err := httpClient.Do(req)
-	cancel()
+	resp, err := clientFor(opts).Do(req)
 	if err != nil {
-		// Network/connection error - will be retried by RetryHandler if appropriate
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return Outcome{Status: http.StatusBadGateway, GRPCStatus: -1, Canceled: true}
+		}
+		if opts.ClientDeadline && errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			writeGRPCDeadlineExceeded(w)
+			return Outcome{Status: http.StatusOK, GRPCStatus: grpcStatusDeadlineExceeded, Canceled: true}
+		}
+		// RetryHandler decides from the error kind whether to try again
+		perr := classifyError(ctx, err)
+		writeProxyError(w, perr)
+		return Outcome{Status: perr.Status(), GRPCStatus: -1, Err: perr}
 	}
 	defer resp.Body.Close()
 
+	streaming := IsStreamingResponse(resp)
+	if route, ok := r.Context().Value(configuration.RouteCtxKey).(*configuration.RouteConfig); ok && route.Streaming {
+		streaming = true
+	}
+	grpc := isGRPCResponse(resp)
+	if streaming && !grpc {
+		deadline.Stop()
+	}
+
 	// Write response regardless of status code
 	// RetryHandler will decide whether to retry based on status code
-	writeResponse(w, resp)
+	writeResponse(w, resp, streaming)
+
+	if grpc && errors.Is(context.Cause(ctx), context.DeadlineExceeded) && grpcStatus(resp) < 0 {
+		// the upstream stalled mid-call; end it the way gRPC reports deadlines
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcStatusDeadlineExceeded))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "deadline exceeded")
+		if opts.ClientDeadline {
+			return Outcome{Status: resp.StatusCode, GRPCStatus: grpcStatusDeadlineExceeded, Canceled: true}
+		}
+		perr := &ProxyError{Kind: ErrorTimeout, Err: context.DeadlineExceeded}
+		return Outcome{Status: resp.StatusCode, GRPCStatus: grpcStatusDeadlineExceeded, Err: perr}
+	}
+	return Outcome{Status: resp.StatusCode, GRPCStatus: grpcStatus(resp)}
+}
+
+// isTimeout reports whether err comes from a deadline: the per-try or total
+// request deadline, or one of the transport's connect / header timeouts.
+func isTimeout(ctx context.Context, err error) bool {
+	if errors.Is(context.Cause(ctx), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// IsStreamingResponse reports whether resp is an event stream or gRPC stream
+// that must reach the client incrementally rather than after the upstream finishes.
+func IsStreamingResponse(resp *http.Response) bool {
+	ct := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Type")))
+	return strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "application/grpc")
 }
 
-func writeResponse(w http.ResponseWriter, resp *http.Response) {
+// writeResponse copies resp to w. When flush is set every chunk read from the
+// upstream is flushed to the client straight away. Trailers are forwarded
+// once the body is done.
+func writeResponse(w http.ResponseWriter, resp *http.Response, flush bool) {
+	removeHopHeaders(resp.Header)
 	for k, vals := range resp.Header {
 		for _, v := range vals {
 			w.Header().Add(k, v)
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+
+	if !flush {
+		io.Copy(w, resp.Body)
+		copyTrailers(w, resp)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+	copyTrailers(w, resp)
+}
+
+// copyTrailers forwards resp's trailers (only populated after the body has
+// been read to EOF) using http.TrailerPrefix, so they need no announcement.
+func copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	for k, vals := range resp.Trailer {
+		for _, v := range vals {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
 }
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"FluxGate/configuration"
+	"FluxGate/loadbalancer"
+	"net/http"
+)
+
+// setStickyCookie pins the client to upstream on sticky routes, unless its
+// cookie already does.
+func setStickyCookie(w http.ResponseWriter, r *http.Request, route *configuration.RouteConfig, upstream string) {
+	if !route.Sticky.Enabled {
+		return
+	}
+
+	id := loadbalancer.ServerID(upstream)
+	name := route.Sticky.Cookie()
+	if c, err := r.Cookie(name); err == nil && c.Value == id {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   route.Sticky.TTLSeconds,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	w.Header().Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	"FluxGate/loadbalancer"
+	"FluxGate/utils"
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUpgradeIdleTimeout = 60 * time.Second
+	// connect, TLS handshake and upgrade response, when not configured
+	defaultUpgradeHandshakeTimeout = 10 * time.Second
+)
+
+// IsUpgradeRequest reports whether r asks to switch protocols (e.g. WebSocket).
+func IsUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeHandler proxies Connection: Upgrade requests to the upstream picked
+// into the request context. It is used instead of ProxyHandler since
+// http.Client cannot hand back the raw connection.
+func UpgradeHandler(breakers *circuitbreaker.Set) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Context().Value(configuration.RouteCtxKey).(*configuration.RouteConfig)
+		upstream := r.Context().Value(configuration.UpstreamCtxKey).(string)
+		gen, _ := r.Context().Value(configuration.BreakerGenerationCtxKey).(circuitbreaker.Generation)
+		// once upgraded, the connection counts in loadbalancer.ActiveConns
+		// rather than as a request in flight
+		var release sync.Once
+		done := func() {
+			if route.LoadBalancer != nil {
+				route.LoadBalancer.Done(upstream)
+			}
+		}
+		defer release.Do(done)
+		setStickyCookie(w, r, route, upstream)
+
+		idle := time.Duration(route.Upgrade.IdleTimeoutMs) * time.Millisecond
+		if idle <= 0 {
+			idle = defaultUpgradeIdleTimeout
+		}
+
+		timeouts := route.Timeouts
+		if cfg, ok := route.UpstreamFor(upstream); ok {
+			timeouts = timeouts.Merge(cfg.Timeouts)
+		}
+
+		status := UpgradeProxy(w, r, upstream, timeouts, idle, func() { release.Do(done) })
+		utils.UpdateCircuitBreaker(breakers.Get(route, upstream), gen, status)
+	})
+}
+
+// UpgradeProxy dials upstreamURL, replays the upgrade handshake and, if the
+// upstream switches protocols, hijacks the client connection and relays bytes
+// in both directions until either side closes or the pair is idle for
+// idleTimeout. The connect, TLS handshake and response header timeouts of
+// timeouts bound the handshake. upgraded, if not nil, is called once the
+// connection is counted in loadbalancer.ActiveConns. It returns the upstream
+// handshake status, or 502 / 504 if the handshake never completed.
+func UpgradeProxy(w http.ResponseWriter, r *http.Request, upstreamURL string, timeouts configuration.TimeoutConfig, idleTimeout time.Duration, upgraded func()) int {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		perr := &ProxyError{Kind: ErrorOther, Err: err}
+		writeProxyError(w, perr)
+		return perr.Status()
+	}
+
+	upConn, err := dialUpstream(u, timeouts)
+	if err != nil {
+		perr := classifyError(r.Context(), err)
+		writeProxyError(w, perr)
+		return perr.Status()
+	}
+	defer upConn.Close()
+
+	req, err := http.NewRequest(r.Method, upstreamURL, nil)
+	if err != nil {
+		perr := &ProxyError{Kind: ErrorOther, Err: err}
+		writeProxyError(w, perr)
+		return perr.Status()
+	}
+	copyRequestHeaders(req, r)
+
+	upConn.SetDeadline(time.Now().Add(handshakeTimeout(timeouts.ResponseHeaderMs)))
+	if err := req.Write(upConn); err != nil {
+		perr := classifyError(r.Context(), err)
+		writeProxyError(w, perr)
+		return perr.Status()
+	}
+	upReader := bufio.NewReader(upConn)
+	resp, err := http.ReadResponse(upReader, req)
+	if err != nil {
+		perr := classifyError(r.Context(), err)
+		writeProxyError(w, perr)
+		return perr.Status()
+	}
+	upConn.SetDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// upstream refused the upgrade, pass its answer through as-is
+		defer resp.Body.Close()
+		writeResponse(w, resp, false)
+		return resp.StatusCode
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return http.StatusSwitchingProtocols
+	}
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		return http.StatusSwitchingProtocols
+	}
+	defer clientConn.Close()
+
+	// the server's read/write deadlines stay on a hijacked connection
+	clientConn.SetDeadline(time.Time{})
+
+	// headers the gateway set for the client, e.g. a sticky-session cookie
+	for k, vals := range w.Header() {
+		resp.Header[k] = append(resp.Header[k], vals...)
+	}
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		return http.StatusSwitchingProtocols
+	}
+
+	loadbalancer.ActiveConns.Acquire(upstreamURL)
+	defer loadbalancer.ActiveConns.Release(upstreamURL)
+	if upgraded != nil {
+		upgraded()
+	}
+
+	relay := &idleRelay{timeout: idleTimeout}
+	relay.touch()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relay.copy(upConn, clientConn, clientBuf.Reader)
+		upConn.Close()
+		clientConn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		relay.copy(clientConn, upConn, upReader)
+		upConn.Close()
+		clientConn.Close()
+	}()
+	wg.Wait()
+
+	return http.StatusSwitchingProtocols
+}
+
+func dialUpstream(u *url.URL, timeouts configuration.TimeoutConfig) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: handshakeTimeout(timeouts.ConnectMs)}
+
+	switch u.Scheme {
+	case "http", "ws":
+		return dialer.Dial("tcp", hostPort(u, "80"))
+	case "https", "wss":
+		conn, err := dialer.Dial("tcp", hostPort(u, "443"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout(timeouts.TLSHandshakeMs)))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+}
+
+// handshakeTimeout turns a configured timeout in ms into a duration, with
+// the default for 0.
+func handshakeTimeout(ms int64) time.Duration {
+	if ms <= 0 {
+		return defaultUpgradeHandshakeTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// idleRelay tracks activity across both directions of an upgraded connection,
+// so a stream that only flows one way is not considered idle.
+type idleRelay struct {
+	timeout      time.Duration
+	lastActivity atomic.Int64
+}
+
+func (ir *idleRelay) touch() {
+	ir.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (ir *idleRelay) idleFor() time.Duration {
+	return time.Since(time.Unix(0, ir.lastActivity.Load()))
+}
+
+// copy moves bytes from src (buffered reader over srcConn) to dst until EOF,
+// an error, or the connection pair has been idle for the timeout.
+func (ir *idleRelay) copy(dst net.Conn, srcConn net.Conn, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		srcConn.SetReadDeadline(time.Now().Add(ir.timeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			ir.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && ir.idleFor() < ir.timeout {
+				// the other direction is still active
+				continue
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package retrybudget
+
+import (
+	"sync"
+	"time"
+)
+
+// Budget caps retries to a percentage of the requests seen over a sliding
+// window, plus a minimum number of retries per second so low-traffic routes
+// can still retry. Once an upstream is failing, retries can add at most
+// percent% extra load instead of multiplying it by MaxTries.
+type Budget struct {
+	mu sync.Mutex
+
+	ratio     float64 // retries allowed per request
+	minPerSec float64
+	buckets   []bucket // one per second of the window
+}
+
+type bucket struct {
+	second   int64
+	requests int64
+	retries  int64
+}
+
+// New creates a budget allowing percent retries per 100 requests plus
+// minPerSec retries per second, measured over window (rounded to seconds).
+func New(percent float64, minPerSec float64, window time.Duration) *Budget {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &Budget{
+		ratio:     percent / 100,
+		minPerSec: minPerSec,
+		buckets:   make([]bucket, seconds),
+	}
+}
+
+// Deposit records a request that may later need retrying.
+func (b *Budget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.current(time.Now()).requests++
+}
+
+// Withdraw records a retry if the budget allows it and reports whether it did.
+func (b *Budget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if !b.allows(now) {
+		return false
+	}
+	b.current(now).retries++
+	return true
+}
+
+// CanWithdraw reports whether Withdraw would allow a retry now, without
+// recording one.
+func (b *Budget) CanWithdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allows(time.Now())
+}
+
+func (b *Budget) allows(now time.Time) bool {
+	var requests, retries int64
+	for _, bk := range b.buckets {
+		if now.Unix()-bk.second < int64(len(b.buckets)) {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	allowed := b.ratio*float64(requests) + b.minPerSec*float64(len(b.buckets))
+	return float64(retries)+1 <= allowed
+}
+
+// current returns the bucket for now, recycling it if it holds an old second.
+func (b *Budget) current(now time.Time) *bucket {
+	sec := now.Unix()
+	bk := &b.buckets[sec%int64(len(b.buckets))]
+	if bk.second != sec {
+		*bk = bucket{second: sec}
+	}
+	return bk
+}
@@ -0,0 +1,46 @@
+package retrybudget
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudgetAllowsPercentageOfRequests(t *testing.T) {
+	b := New(20, 0, 10*time.Second)
+
+	for i := 0; i < 10; i++ {
+		b.Deposit()
+	}
+
+	// 20% of 10 requests
+	if !b.Withdraw() || !b.Withdraw() {
+		t.Fatalf("expected two retries to fit the budget")
+	}
+	if b.Withdraw() {
+		t.Fatalf("expected third retry to be denied")
+	}
+}
+
+func TestBudgetMinimumPerSecond(t *testing.T) {
+	b := New(0, 0.5, 2*time.Second)
+
+	if !b.Withdraw() {
+		t.Fatalf("expected the per-second minimum to allow a retry without traffic")
+	}
+	if b.Withdraw() {
+		t.Fatalf("expected a second retry within the window to be denied")
+	}
+}
+
+func TestBudgetCanWithdrawDoesNotSpend(t *testing.T) {
+	b := New(0, 1, time.Second)
+	if !b.CanWithdraw() || !b.CanWithdraw() {
+		t.Fatalf("expected a retry to be available")
+	}
+	if !b.Withdraw() {
+		t.Fatalf("peeking should not have spent the token")
+	}
+	if b.CanWithdraw() {
+		t.Fatalf("expected the budget to be spent")
+	}
+}
@@ -11,6 +11,12 @@ type CacheEntry struct {
 	Body       []byte
 	Header     http.Header
 	ExpiryTime time.Time
+
+	// when the response was as old as zero, so its Age is the time since
+	Stored time.Time
+	// headers the response varies on; set on the entry under a resource's
+	// plain key, which points at one entry per variant
+	Vary []string
 }
 
 type lruItem struct {
@@ -51,10 +57,9 @@ func (c *LRUCache) Get(key string) (CacheEntry, bool) {
 
 	item := elem.Value.(*lruItem)
 
-	// TTL check
+	// TTL check; expired entries stay until evicted so GetStale can still
+	// serve them
 	if time.Now().After(item.entry.ExpiryTime) {
-		c.ll.Remove(elem)
-		delete(c.items, key)
 		return CacheEntry{}, false
 	}
 
@@ -63,6 +68,24 @@ func (c *LRUCache) Get(key string) (CacheEntry, bool) {
 	return item.entry, true
 }
 
+// GetStale returns the entry under key whether or not it has expired, as
+// long as it expired no more than maxStale ago (0 = no limit).
+func (c *LRUCache) GetStale(key string, maxStale time.Duration) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return CacheEntry{}, false
+	}
+
+	entry := elem.Value.(*lruItem).entry
+	if maxStale > 0 && time.Since(entry.ExpiryTime) > maxStale {
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
+
 func (c *LRUCache) Set(key string, entry CacheEntry) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -36,3 +36,21 @@ func TestLRUCacheTTLAndEviction(t *testing.T) {
 		t.Fatalf("expected k2 to remain present")
 	}
 }
+
+func TestLRUCacheGetStale(t *testing.T) {
+	cache := NewLRUCache(2, time.Second)
+	cache.Set("k1", CacheEntry{Body: []byte("old"), ExpiryTime: time.Now().Add(-time.Minute)})
+
+	if _, ok := cache.Get("k1"); ok {
+		t.Fatal("expected an expired entry to miss")
+	}
+	if e, ok := cache.GetStale("k1", 0); !ok || string(e.Body) != "old" {
+		t.Fatal("expected the expired entry to be served stale")
+	}
+	if _, ok := cache.GetStale("k1", time.Second); ok {
+		t.Fatal("expected an entry expired for longer than max stale to miss")
+	}
+	if _, ok := cache.GetStale("k2", 0); ok {
+		t.Fatal("expected a miss for an unknown key")
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"net/http"
 )
 
-func UpdateCircuitBreaker(cb *circuitbreaker.CircuitBreaker, statusCode int) {
+func UpdateCircuitBreaker(cb circuitbreaker.CircuitBreaker, gen circuitbreaker.Generation, statusCode int) {
 	if cb == nil {
 		return
 	}
@@ -14,9 +14,5 @@ func UpdateCircuitBreaker(cb *circuitbreaker.CircuitBreaker, statusCode int) {
 		statusCode = http.StatusOK
 	}
 
-	if statusCode >= 500 {
-		cb.OnFailure()
-	} else {
-		cb.OnSuccess()
-	}
+	cb.Record(gen, statusCode >= 500, 0)
 }
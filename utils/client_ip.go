@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"FluxGate/configuration"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the proxies (IPs or CIDRs) whose X-Forwarded-For /
+// Forwarded headers are honoured. Requests from anywhere else have those
+// headers discarded.
+type TrustedProxies []*net.IPNet
+
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	nets, err := configuration.ParseNetworks(proxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	return nets, nil
+}
+
+// TrustedProxiesOf returns the trusted proxies the gateway put into r's
+// context, or none.
+func TrustedProxiesOf(r *http.Request) TrustedProxies {
+	t, _ := r.Context().Value(configuration.TrustedProxiesCtxKey).(TrustedProxies)
+	return t
+}
+
+// Contains reports whether ip belongs to a trusted proxy.
+func (t TrustedProxies) Contains(ip string) bool {
+	parsed := net.ParseIP(strings.Trim(ip, "[]"))
+	if parsed == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteHost returns the IP part of r.RemoteAddr.
+func RemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP returns the address of the original client. X-Forwarded-For is
+// only consulted when the direct peer is a trusted proxy, and is walked from
+// the right so a client can't spoof its way past the proxies we trust.
+func ClientIP(r *http.Request, trusted TrustedProxies) string {
+	ip := RemoteHost(r)
+	if !trusted.Contains(ip) {
+		return ip
+	}
+
+	hops := []string{}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = hops[i]
+		if !trusted.Contains(ip) {
+			break
+		}
+	}
+	return ip
+}
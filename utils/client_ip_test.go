@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("parse trusted proxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"no proxy", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"untrusted peer can't spoof", "203.0.113.7:1234", "1.2.3.4", "203.0.113.7"},
+		{"trusted peer", "10.0.0.1:1234", "198.51.100.2", "198.51.100.2"},
+		{"skips trusted hops from the right", "10.0.0.1:1234", "1.2.3.4, 198.51.100.2, 192.168.1.1", "198.51.100.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := ClientIP(r, trusted); got != tt.want {
+				t.Fatalf("ClientIP = %q want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,39 +2,54 @@ package utils
 
 import (
 	"FluxGate/circuitbreaker"
+	"FluxGate/configuration"
+	"FluxGate/healthcheck"
 	"FluxGate/loadbalancer"
 	"fmt"
+	"slices"
 )
 
-func PickHealthyServer(lb loadbalancer.LoadBalancer, breakers map[string]*circuitbreaker.CircuitBreaker) (string, error) {
+// PickHealthyServer asks the load balancer for servers until one passes its
+// active health check (if any) and is allowed by its circuit breaker.
+// Servers in exclude are skipped without consulting their breaker (e.g. the
+// upstream a hedged request is already running on).
+// The caller must call the route's LoadBalancer.Done on the returned server
+// once its request ends, and report the outcome to its breaker under the
+// returned generation.
+func PickHealthyServer(route *configuration.RouteConfig, breakers *circuitbreaker.Set, health *healthcheck.Monitor, exclude ...string) (string, circuitbreaker.Generation, error) {
+	lb := route.LoadBalancer
 
 	serversSeen := 0
 
-	servers := lb.Servers()
+	// count ejected servers too: lb.Servers() leaves them out, but NextServer
+	// still hands one out once every server is ejected
+	servers := loadbalancer.AllServers(lb)
 	if len(servers) == 0 {
-		return "", fmt.Errorf("no upstream servers configured")
+		return "", 0, fmt.Errorf("no upstream servers configured")
 	}
 
 	for {
 		server, err := lb.NextServer()
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 
-		_ = server
-
-		cb := breakers[server] // string key = server URL
-
-		if cb == nil || cb.Allow() {
-			// server allowed by circuit breaker
-			// allowed upstream
-			return server, nil
+		if !slices.Contains(exclude, server) && health.Healthy(server) {
+			cb := breakers.Get(route, server)
+			if cb == nil {
+				return server, 0, nil
+			}
+			if gen, ok := cb.Allow(); ok {
+				// server allowed by circuit breaker
+				return server, gen, nil
+			}
 		}
 
 		// skip blocked server, try another
+		lb.Done(server)
 		serversSeen++
 		if serversSeen >= len(servers) {
-			return "", fmt.Errorf("no healthy upstreams (all circuits open)")
+			return "", 0, fmt.Errorf("no healthy upstreams (all failing health checks or circuits open)")
 		}
 	}
 }